@@ -2,11 +2,10 @@ package acl
 
 import (
 	"context"
-	"fmt"
-	"net"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/coredns/coredns/request"
 	"github.com/ihac/acl/acl/filter"
 	"github.com/miekg/dns"
@@ -16,6 +15,17 @@ type acl struct {
 	Next plugin.Handler
 
 	Rules []Rule
+
+	// transport is the transport of the server block, i.e., dns, tls, https or grpc.
+	transport string
+	// reloader reloads local files once they are changed.
+	reloader *reloader
+	// explain enables explain queries, which are answered only to sources
+	// in explainAdmins.
+	explain       bool
+	explainAdmins filter.Filter
+	// zones indexes Rules by their zones.
+	zones *zoneTree
 }
 
 // Rule defines a list of Zones and some ACL policies which will be
@@ -23,15 +33,93 @@ type acl struct {
 type Rule struct {
 	Zones    []string
 	Policies []Policy
+
+	// trustedProxies defines the peers whose forwarded client information
+	// is trusted. Nil means none.
+	trustedProxies filter.Filter
+	// clientIPFrom defines where the real client address of queries from
+	// trusted proxies is taken from, in order of preference.
+	clientIPFrom []clientIPSource
+	// answerPolicies are enforced on the A/AAAA records in responses.
+	answerPolicies []answerPolicy
+	// rpzZones are the Response Policy Zones enforced after policies, in order.
+	rpzZones []*rpzZone
+	// geo is the database which 'geo' clauses of the policies look up.
+	geo *geoDB
+	// asn is the table which 'asn' clauses of the policies look up.
+	asn *asnDB
+
+	// qtypePolicies index Policies by the query types they are specific
+	// to, while otherPolicies are evaluated for other query types.
+	qtypePolicies map[uint16][]*Policy
+	otherPolicies []*Policy
+	// prefixes indexes Policies by their networks in longest-prefix mode.
+	// Nil means the policies are evaluated in order.
+	prefixes *prefixIndex
 }
 
 // Policy defines the ACL policy for DNS queries.
 // A policy performs the specified action (block/allow) on all DNS queries
 // matched by source IP or QTYPE.
 type Policy struct {
+	// name identifies policies loaded from policy files.
+	name string
+	// text describes the policy as it is configured.
+	text string
+
 	action string
-	qtype  uint16
-	filter filter.Filter
+	// response is the action taken towards queries matched by block
+	// policies, i.e., DROP or NXDOMAIN. Empty means BLOCK, i.e., REFUSED.
+	response string
+	qtype    uint16
+	// src is the source which filter is built from.
+	src     *source
+	filter  filter.Filter
+	limiter *rateLimiter
+	// domains restricts the policy to queries towards specific domains and
+	// their subdomains. Nil means any.
+	domains *domainSet
+	// geo restricts the policy to clients in (or outside of) specific
+	// countries. Nil means any.
+	geo *geoMatcher
+	// asn restricts the policy to clients in (or outside of) specific
+	// autonomous systems. Nil means any.
+	asn *asnMatcher
+	// tunnel restricts the policy to queries which look like DNS tunneling.
+	// Nil means any.
+	tunnel *tunnelMatcher
+
+	// protos restricts the policy to queries received over specific
+	// protocols, i.e., udp, tcp, tls, https or grpc. Empty means any.
+	protos []string
+	// opcodes restricts the policy to queries of specific opcodes, i.e.,
+	// QUERY, IQUERY, NOTIFY or UPDATE. Empty means any.
+	opcodes []int
+	// classes restricts the policy to queries of specific classes, i.e.,
+	// IN, CH, HS or ANY. Empty means any.
+	classes []uint16
+	// flags restricts the policy to queries with specific header flags set
+	// or unset. Nil means any.
+	flags *flagsMatcher
+	// edns restricts the policy to queries with (or without) OPT records of
+	// specific properties. Nil means any.
+	edns *ednsMatcher
+	// local restricts the policy to queries received on specific local
+	// addresses. Nil means any.
+	local filter.Filter
+	// ecs restricts the policy to queries carrying an EDNS0 Client Subnet
+	// option from trusted proxies with an address in specific networks.
+	// Nil means any.
+	ecs filter.Filter
+	// schedule restricts the policy to specific times. Nil means any time.
+	schedule *schedule
+	// exception exempts queries matched by the policy from it, by their
+	// clients or names. Nil means none.
+	exception *exception
+
+	// file makes the policy a placeholder of the policies loaded from a
+	// policy file, which are evaluated in its place.
+	file *policyFile
 }
 
 const (
@@ -39,63 +127,346 @@ const (
 	ALLOW string = "allow"
 	// BLOCK blocks unauthorized queries towards protected DNS zones.
 	BLOCK string = "block"
+	// RATELIMIT limits the query rate of each client and takes a
+	// configurable action towards queries over the limit.
+	RATELIMIT string = "ratelimit"
+	// DROP drops queries silently without any response.
+	DROP string = "drop"
+	// NXDOMAIN responds to queries with NXDOMAIN, as if the names did not
+	// exist.
+	NXDOMAIN string = "nxdomain"
+	// TRUNCATE responds to UDP queries with an empty truncated (TC=1) message,
+	// which forces clients to retry over TCP where the source is verified.
+	// TCP queries are not affected.
+	TRUNCATE string = "truncate"
 )
 
+// close releases the resources held by the rules, i.e., mapped snapshots of
+// network files and GeoIP databases. Lookups match nothing afterwards.
+func (a acl) close() error {
+	for _, rule := range a.Rules {
+		for _, p := range rule.Policies {
+			closeFilter(p.filter)
+			if p.exception != nil {
+				closeFilter(p.exception.filter)
+			}
+		}
+		for _, p := range rule.answerPolicies {
+			closeFilter(p.filter)
+		}
+		if rule.geo != nil {
+			rule.geo.close()
+		}
+	}
+	return nil
+}
+
 func (a acl) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if a.explain && isExplain(r) {
+		return a.serveExplain(w, r)
+	}
 	state := request.Request{W: w, Req: r}
-	for _, rule := range a.Rules {
-		// check zone
-		zone := plugin.Zones(rule.Zones).Matches(state.Name())
-		if zone == "" {
-			continue
+	var aw *answerWriter
+	for _, zr := range a.zones.lookup(state.Name()) {
+		rule, zone := a.Rules[zr.rule], zr.zone
+		if len(rule.answerPolicies) > 0 {
+			if aw == nil {
+				aw = &answerWriter{ResponseWriter: w, server: metrics.WithServer(ctx)}
+			}
+			aw.addPolicies(zone, rule.answerPolicies)
 		}
-		isBlocked, err := shouldBlock(rule.Policies, w, r)
+		action, err := shouldBlock(rule, a.transport, w, r)
 		if err != nil {
 			return dns.RcodeRefused, err
 		}
-		if isBlocked {
+		switch action {
+		case BLOCK:
 			m := new(dns.Msg)
 			m.SetRcode(r, dns.RcodeRefused)
 			w.WriteMsg(m)
 			RequestBlockCount.WithLabelValues(metrics.WithServer(ctx), zone).Inc()
 			// TODO: should we return Success here? (@ihac)
 			return dns.RcodeSuccess, nil
+		case NXDOMAIN:
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			w.WriteMsg(m)
+			RequestBlockCount.WithLabelValues(metrics.WithServer(ctx), zone).Inc()
+			return dns.RcodeSuccess, nil
+		case DROP:
+			RequestDropCount.WithLabelValues(metrics.WithServer(ctx), zone).Inc()
+			return dns.RcodeSuccess, nil
+		case TRUNCATE:
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Truncated = true
+			w.WriteMsg(m)
+			RequestTruncateCount.WithLabelValues(metrics.WithServer(ctx), zone).Inc()
+			return dns.RcodeSuccess, nil
+		}
+
+		if len(rule.rpzZones) == 0 {
+			continue
+		}
+		act, err := rpzQueryAction(rule, state)
+		if err != nil {
+			return dns.RcodeRefused, err
+		}
+		if act == nil {
+			if aw == nil {
+				aw = &answerWriter{ResponseWriter: w, server: metrics.WithServer(ctx)}
+			}
+			aw.proto = state.Proto()
+			aw.addRPZZones(zone, rule.rpzZones)
+			continue
+		}
+		RPZHitCount.WithLabelValues(metrics.WithServer(ctx), zone, act.kind).Inc()
+		switch act.kind {
+		case rpzPassthru:
+			continue
+		case rpzTCPOnly:
+			if state.Proto() != "udp" {
+				continue
+			}
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Truncated = true
+			w.WriteMsg(m)
+			return dns.RcodeSuccess, nil
+		}
+		if m := act.reply(r); m != nil {
+			w.WriteMsg(m)
 		}
+		return dns.RcodeSuccess, nil
 	}
 	RequestAllowCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	if aw != nil {
+		return plugin.NextOrFailure(state.Name(), a.Next, ctx, aw, r)
+	}
 	return plugin.NextOrFailure(state.Name(), a.Next, ctx, w, r)
 }
 
-func shouldBlock(policies []Policy, w dns.ResponseWriter, r *dns.Msg) (bool, error) {
-	state := request.Request{W: w, Req: r}
+// shouldBlock evaluates policies of the rule in order and returns the action
+// to be taken towards the query, i.e., ALLOW, BLOCK, DROP or TRUNCATE.
+func shouldBlock(rule Rule, transport string, w dns.ResponseWriter, r *dns.Msg) (string, error) {
+	action, _, err := evaluate(rule, transport, w, r, false)
+	return action, err
+}
 
-	ip := net.ParseIP(state.IP())
-	if ip == nil {
-		return true, fmt.Errorf("Illegal source ip '%s'", state.IP())
+// evaluate is like shouldBlock, and also returns the policy deciding the
+// action, or nil if none does. A dry run leaves the state of policies, i.e.,
+// rate limits and subdomain counters, unchanged.
+func evaluate(rule Rule, transport string, w dns.ResponseWriter, r *dns.Msg, dryRun bool) (string, *Policy, error) {
+	q := query{state: request.Request{W: w, Req: r}, dryRun: dryRun}
+	if err := q.setClient(rule); err != nil {
+		return BLOCK, nil, err
 	}
 
 	if len(r.Question) != 1 {
 		// TODO: what if #question == 0 or > 1? (@ihac)
-		return false, nil
+		return ALLOW, nil, nil
 	}
-	qtype := r.Question[0].Qtype
+	q.proto = protocol(transport, q.state)
+	q.qtype = r.Question[0].Qtype
+	q.qclass = r.Question[0].Qclass
+	q.opcode = r.Opcode
+	q.opt = r.IsEdns0()
+	q.flags = queryFlags(r, q.opt)
+	q.qname = r.Question[0].Name
+	q.localIP, q.hasLocalIP = addrOf(w.LocalAddr())
+	var action string
+	var policy *Policy
+	if rule.prefixes != nil {
+		action, policy = rule.prefixes.match(&q)
+	} else {
+		action, policy = matchPolicies(rule.policiesFor(q.qtype), &q)
+	}
+	if policy != nil {
+		return action, policy, nil
+	}
+	return ALLOW, nil, nil
+}
+
+// query holds the properties of a query which policies are matched against.
+type query struct {
+	state request.Request
+	ip    filter.Addr
+	// ecs is set if hasECS is true.
+	ecs    filter.Addr
+	hasECS bool
+	// localIP is set if hasLocalIP is true.
+	localIP    filter.Addr
+	hasLocalIP bool
+	proto      string
+	qtype      uint16
+	qclass     uint16
+	qname      string
+	opcode     int
+	// flags holds the header flags of the query along with its DO bit.
+	flags uint8
+	// opt is the OPT record of the query, or nil if none.
+	opt *dns.OPT
+	// dryRun evaluates the query without consuming rate limits or counting
+	// subdomains, e.g., for explain queries and offline checks.
+	dryRun bool
+}
+
+// matchPolicies evaluates policies in order and returns the first one
+// deciding the query, along with its action. It returns a nil policy if none
+// decides.
+func matchPolicies(policies []*Policy, q *query) (string, *Policy) {
 	for _, policy := range policies {
-		if !policy.filter.Contains(ip) {
-			continue
+		if action, matched := matchPolicy(policy, q); matched != nil {
+			return action, matched
+		}
+	}
+	return "", nil
+}
+
+// matchPolicy returns the policy deciding the query along with its action,
+// i.e., the policy itself or one of the policies loaded from its policy file,
+// or nil if none decides.
+func matchPolicy(policy *Policy, q *query) (string, *Policy) {
+	if policy.file != nil {
+		policies := policy.file.Policies()
+		for i := range policies {
+			if action, matched := matchPolicy(&policies[i], q); matched != nil {
+				return action, matched
+			}
 		}
+		return "", nil
+	}
 
-		if qtype != policy.qtype && policy.qtype != QtypeAll {
-			continue
+	if policy.filter != nil && !policy.filter.ContainsAddr(q.ip) {
+		return "", nil
+	}
+
+	if policy.geo != nil && !policy.geo.matches(q) {
+		return "", nil
+	}
+
+	if policy.asn != nil && !policy.asn.matches(q) {
+		return "", nil
+	}
+
+	if policy.domains != nil && !policy.domains.Contains(q.qname) {
+		return "", nil
+	}
+
+	if policy.ecs != nil && (!q.hasECS || !policy.ecs.ContainsAddr(q.ecs)) {
+		return "", nil
+	}
+
+	if q.qtype != policy.qtype && policy.qtype != QtypeAll {
+		return "", nil
+	}
+
+	if policy.flags != nil && !policy.flags.matches(q) {
+		return "", nil
+	}
+
+	if policy.edns != nil && !policy.edns.matches(q) {
+		return "", nil
+	}
+
+	if len(policy.protos) > 0 && !containsString(policy.protos, q.proto) {
+		return "", nil
+	}
+
+	if len(policy.opcodes) > 0 && !containsInt(policy.opcodes, q.opcode) {
+		return "", nil
+	}
+
+	if len(policy.classes) > 0 && !containsUint16(policy.classes, q.qclass) {
+		return "", nil
+	}
+
+	if policy.local != nil && (!q.hasLocalIP || !policy.local.ContainsAddr(q.localIP)) {
+		return "", nil
+	}
+
+	if policy.schedule != nil && !policy.schedule.active() {
+		return "", nil
+	}
+
+	if policy.exception != nil && policy.exception.matches(q) {
+		return "", nil
+	}
+
+	// checked last, as it counts the subdomains queried by clients.
+	if policy.tunnel != nil && !policy.tunnel.matches(q) {
+		return "", nil
+	}
+	// matched.
+	switch policy.action {
+	case ALLOW:
+		return ALLOW, policy
+	case BLOCK:
+		if policy.response != "" {
+			return policy.response, policy
 		}
-		// matched.
-		switch policy.action {
-		case ALLOW:
-			return false, nil
-		case BLOCK:
-			return true, nil
+		return BLOCK, policy
+	case TRUNCATE:
+		// TCP queries go on to the next policy.
+		if q.state.Proto() != "udp" {
+			return "", nil
+		}
+		return TRUNCATE, policy
+	case RATELIMIT:
+		// queries within the limit go on to the next policy.
+		var within bool
+		if q.dryRun {
+			within = policy.limiter.Peek(q.ip.IP())
+		} else {
+			within = policy.limiter.Allow(q.ip.IP())
+		}
+		if within {
+			return "", nil
+		}
+		// it makes no sense to ask TCP clients to retry over TCP.
+		if policy.limiter.response == TRUNCATE && q.state.Proto() != "udp" {
+			return BLOCK, policy
+		}
+		return policy.limiter.response, policy
+	}
+	return "", nil
+}
+
+// protocol returns the protocol over which the query is received, i.e., udp,
+// tcp, tls, https or grpc.
+func protocol(trans string, state request.Request) string {
+	switch trans {
+	case transport.TLS, transport.HTTPS, transport.GRPC:
+		return trans
+	}
+	return state.Proto()
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint16(values []uint16, v uint16) bool {
+	for _, value := range values {
+		if value == v {
+			return true
 		}
 	}
-	return false, nil
+	return false
 }
 
 func (a acl) Name() string {
@@ -15,8 +15,10 @@ var aclTestFiles = map[string]string{
 }
 
 type testResponseWriter struct {
-	remoteIP net.Addr
-	Rcode    int
+	remoteIP  net.Addr
+	localAddr net.Addr
+	Rcode     int
+	Msg       *dns.Msg
 }
 
 func (t *testResponseWriter) setRemoteIP(rawIP string) {
@@ -25,8 +27,17 @@ func (t *testResponseWriter) setRemoteIP(rawIP string) {
 	t.remoteIP = &net.UDPAddr{IP: ip, Port: port, Zone: ""}
 }
 
-// LocalAddr returns the local address, 127.0.0.1:53.
+func (t *testResponseWriter) setRemoteTCPIP(rawIP string) {
+	ip := net.ParseIP(rawIP)
+	port := 65667
+	t.remoteIP = &net.TCPAddr{IP: ip, Port: port, Zone: ""}
+}
+
+// LocalAddr returns the local address, 127.0.0.1:53 by default.
 func (t *testResponseWriter) LocalAddr() net.Addr {
+	if t.localAddr != nil {
+		return t.localAddr
+	}
 	ip := net.ParseIP("127.0.0.1")
 	port := 53
 	return &net.UDPAddr{IP: ip, Port: port, Zone: ""}
@@ -40,6 +51,7 @@ func (t *testResponseWriter) RemoteAddr() net.Addr {
 // WriteMsg implement dns.ResponseWriter interface.
 func (t *testResponseWriter) WriteMsg(m *dns.Msg) error {
 	t.Rcode = m.Rcode
+	t.Msg = m
 	return nil
 }
 
@@ -152,6 +164,20 @@ func Test_acl_ServeDNS(t *testing.T) {
 			dns.RcodeSuccess,
 			false,
 		},
+		{
+			"Blacklist 3 IPv6 BLOCKED",
+			caddy.NewTestController("dns", `
+			acl example.org {
+				block type A net ANY
+			}`),
+			args{
+				"www.example.org.",
+				"2001:db8::1",
+				dns.TypeA,
+			},
+			dns.RcodeRefused,
+			false,
+		},
 		{
 			"Blacklist 4 Single IP BLOCKED",
 			caddy.NewTestController("dns", `
@@ -401,3 +427,274 @@ func Test_acl_ServeDNS(t *testing.T) {
 		})
 	}
 }
+
+func Test_acl_ServeDNS_truncate(t *testing.T) {
+	tests := []struct {
+		name          string
+		sourceIP      string
+		tcp           bool
+		wantRcode     int
+		wantTruncated bool
+	}{
+		{"Truncate UDP", "192.168.0.2", false, dns.RcodeSuccess, true},
+		{"Truncate TCP let through", "192.168.0.2", true, dns.RcodeSuccess, false},
+		{"Truncate TCP then block", "192.168.1.2", true, dns.RcodeRefused, false},
+		{"Truncate not matched", "10.1.0.2", false, dns.RcodeSuccess, false},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseACL(caddy.NewTestController("dns", `
+			acl example.org {
+				truncate type ANY net 192.168.0.0/16
+				block type ANY net 192.168.1.0/24
+			}`))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+			w := &testResponseWriter{}
+			if tt.tcp {
+				w.setRemoteTCPIP(tt.sourceIP)
+			} else {
+				w.setRemoteIP(tt.sourceIP)
+			}
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.org.", dns.TypeA)
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+			if truncated := w.Msg != nil && w.Msg.Truncated; truncated != tt.wantTruncated {
+				t.Errorf("acl.ServeDNS() Truncated = %v, want %v", truncated, tt.wantTruncated)
+			}
+			if tt.wantTruncated && len(w.Msg.Answer) != 0 {
+				t.Errorf("acl.ServeDNS() returns %d answers with TC=1, want 0", len(w.Msg.Answer))
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_transport(t *testing.T) {
+	config := `
+	acl example.org {
+		allow type AXFR net ANY proto tcp listen 10.0.0.1 fd00::53/128
+		block type AXFR net ANY
+		block type ANY net ANY proto udp listen 192.168.0.0/16
+		block type A net 10.1.0.0/16 proto tls https
+	}`
+
+	tests := []struct {
+		name      string
+		transport string
+		tcp       bool
+		localIP   string
+		qtype     uint16
+		wantRcode int
+	}{
+		{"AXFR over TCP on management interface", "dns", true, "10.0.0.1", dns.TypeAXFR, dns.RcodeSuccess},
+		{"AXFR over UDP on management interface", "dns", false, "10.0.0.1", dns.TypeAXFR, dns.RcodeRefused},
+		{"AXFR over TCP on other interface", "dns", true, "10.0.0.2", dns.TypeAXFR, dns.RcodeRefused},
+		{"AXFR over TCP on IPv6 management interface", "dns", true, "fd00::53", dns.TypeAXFR, dns.RcodeSuccess},
+		{"AXFR over TCP on other IPv6 interface", "dns", true, "fd00::54", dns.TypeAXFR, dns.RcodeRefused},
+		{"AXFR over TLS on management interface", "tls", true, "10.0.0.1", dns.TypeAXFR, dns.RcodeRefused},
+		{"UDP on public interface", "dns", false, "192.168.1.1", dns.TypeA, dns.RcodeRefused},
+		{"TCP on public interface", "dns", true, "192.168.1.1", dns.TypeA, dns.RcodeSuccess},
+		{"UDP on other interface", "dns", false, "10.0.0.1", dns.TypeMX, dns.RcodeSuccess},
+		{"TLS from blocked network", "tls", true, "10.0.0.1", dns.TypeA, dns.RcodeRefused},
+		{"HTTPS from blocked network", "https", true, "10.0.0.1", dns.TypeA, dns.RcodeRefused},
+		{"gRPC from blocked network", "grpc", true, "10.0.0.1", dns.TypeA, dns.RcodeSuccess},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseACL(caddy.NewTestController("dns", config))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+			a.transport = tt.transport
+
+			w := &testResponseWriter{}
+			if tt.tcp {
+				w.setRemoteTCPIP("10.1.0.2")
+				w.localAddr = &net.TCPAddr{IP: net.ParseIP(tt.localIP), Port: 53}
+			} else {
+				w.setRemoteIP("10.1.0.2")
+				w.localAddr = &net.UDPAddr{IP: net.ParseIP(tt.localIP), Port: 53}
+			}
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.org.", tt.qtype)
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_netset(t *testing.T) {
+	files := map[string]string{
+		"acl-test-threats.txt": "10.0.0.0/8\n192.168.0.0/16\n",
+		"acl-test-corp.txt":    "10.1.0.0/16\n",
+	}
+	envSetup(files)
+	defer envCleanup(files)
+
+	a, err := parseACL(caddy.NewTestController("dns", `
+	acl example.org {
+		netset threats file acl-test-threats.txt
+		netset corp file acl-test-corp.txt net 192.168.1.0/24
+		netset all net @threats 172.16.0.0/12
+		block type A net @threats except @corp 10.2.0.0/16
+		block type MX net @all
+		block type AAAA net 2001:db8::/32 except 2001:db8:1::/48
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+	serve := func(source string, qtype uint16) int {
+		w := &testResponseWriter{}
+		w.setRemoteIP(source)
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.", qtype)
+		if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+			t.Fatalf("acl.ServeDNS() error = %v", err)
+		}
+		return w.Rcode
+	}
+
+	tests := []struct {
+		name      string
+		source    string
+		qtype     uint16
+		wantRcode int
+	}{
+		{"In set", "10.3.0.1", dns.TypeA, dns.RcodeRefused},
+		{"Excepted by set file", "10.1.0.1", dns.TypeA, dns.RcodeSuccess},
+		{"Excepted by set net", "192.168.1.1", dns.TypeA, dns.RcodeSuccess},
+		{"Excepted inline", "10.2.0.1", dns.TypeA, dns.RcodeSuccess},
+		{"Not in set", "172.16.0.1", dns.TypeA, dns.RcodeSuccess},
+		{"Nested set", "172.16.0.1", dns.TypeMX, dns.RcodeRefused},
+		{"Nested set file", "10.1.0.1", dns.TypeMX, dns.RcodeRefused},
+		{"IPv6", "2001:db8:2::1", dns.TypeAAAA, dns.RcodeRefused},
+		{"Excepted IPv6", "2001:db8:1::1", dns.TypeAAAA, dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rcode := serve(tt.source, tt.qtype); rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", rcode, tt.wantRcode)
+			}
+		})
+	}
+
+	// the exclusion is reloaded with its files.
+	envSetup(map[string]string{"acl-test-corp.txt": "10.3.0.0/16\n"})
+	if err := a.Rules[0].Policies[0].filter.(*reloadableFilter).load(); err != nil {
+		t.Fatalf("reloadableFilter.load() error = %v", err)
+	}
+	if rcode := serve("10.1.0.1", dns.TypeA); rcode != dns.RcodeRefused {
+		t.Errorf("acl.ServeDNS() Rcode after reload = %v, want %v", rcode, dns.RcodeRefused)
+	}
+	if rcode := serve("10.3.0.1", dns.TypeA); rcode != dns.RcodeSuccess {
+		t.Errorf("acl.ServeDNS() Rcode after reload = %v, want %v", rcode, dns.RcodeSuccess)
+	}
+}
+
+func Test_acl_ServeDNS_exception(t *testing.T) {
+	a, err := parseACL(caddy.NewTestController("dns", `
+	acl example.org corp. {
+		block type ANY net 192.168.0.0/16 except net 192.168.1.0/24 name *.corp. mail.example.org
+		block type MX net 10.0.0.0/8 except name example.org
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	tests := []struct {
+		name      string
+		source    string
+		qname     string
+		qtype     uint16
+		wantRcode int
+	}{
+		{"Not excepted", "192.168.0.1", "www.example.org.", dns.TypeA, dns.RcodeRefused},
+		{"Excepted by net", "192.168.1.1", "www.example.org.", dns.TypeA, dns.RcodeSuccess},
+		{"Excepted by wildcard", "192.168.0.1", "www.corp.", dns.TypeA, dns.RcodeSuccess},
+		{"Wildcard excludes parent", "192.168.0.1", "corp.", dns.TypeA, dns.RcodeRefused},
+		{"Excepted by name", "192.168.0.1", "MAIL.example.org.", dns.TypeA, dns.RcodeSuccess},
+		{"Excepted by name subdomain", "192.168.0.1", "a.mail.example.org.", dns.TypeA, dns.RcodeSuccess},
+		{"Excepted by name only", "10.0.0.1", "www.example.org.", dns.TypeMX, dns.RcodeSuccess},
+		{"Not matched", "10.0.0.1", "www.corp.", dns.TypeMX, dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testResponseWriter{}
+			w.setRemoteIP(tt.source)
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, tt.qtype)
+			if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_opcodeClass(t *testing.T) {
+	a, err := parseACL(caddy.NewTestController("dns", `
+	acl example.org {
+		allow type ANY opcode NOTIFY net 192.0.2.1
+		block type ANY opcode NOTIFY UPDATE
+		allow type ANY class CH net 10.0.0.0/8
+		block type ANY class CH HS
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	tests := []struct {
+		name      string
+		source    string
+		opcode    int
+		qclass    uint16
+		wantRcode int
+	}{
+		{"Query", "198.51.100.1", dns.OpcodeQuery, dns.ClassINET, dns.RcodeSuccess},
+		{"Notify from primary", "192.0.2.1", dns.OpcodeNotify, dns.ClassINET, dns.RcodeSuccess},
+		{"Notify from others", "198.51.100.1", dns.OpcodeNotify, dns.ClassINET, dns.RcodeRefused},
+		{"Update", "192.0.2.1", dns.OpcodeUpdate, dns.ClassINET, dns.RcodeRefused},
+		{"CHAOS from inside", "10.0.0.1", dns.OpcodeQuery, dns.ClassCHAOS, dns.RcodeSuccess},
+		{"CHAOS from outside", "198.51.100.1", dns.OpcodeQuery, dns.ClassCHAOS, dns.RcodeRefused},
+		{"Hesiod from outside", "198.51.100.1", dns.OpcodeQuery, dns.ClassHESIOD, dns.RcodeRefused},
+		{"Class ANY", "198.51.100.1", dns.OpcodeQuery, dns.ClassANY, dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testResponseWriter{}
+			w.setRemoteIP(tt.source)
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeSOA)
+			m.Opcode = tt.opcode
+			m.Question[0].Qclass = tt.qclass
+			if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package acl
+
+import (
+	"net"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin"
+	"github.com/ihac/acl/acl/filter"
+	"github.com/miekg/dns"
+)
+
+const (
+	// answerStrip strips offending records from responses.
+	answerStrip = "strip"
+	// answerRefuse replaces responses containing offending records with REFUSED.
+	answerRefuse = "refuse"
+	// answerNXDomain replaces responses containing offending records with NXDOMAIN.
+	answerNXDomain = "nxdomain"
+)
+
+// answerPolicy defines the ACL policy for the A/AAAA records in responses,
+// e.g., to defend against DNS rebinding by blocking answers pointing at
+// private networks.
+type answerPolicy struct {
+	// text describes the policy as it is configured.
+	text   string
+	action string
+	filter filter.Filter
+	// except defines the zones which the policy is not enforced on.
+	except []string
+	// response is the way of dealing with offending records, i.e.,
+	// answerStrip, answerRefuse or answerNXDomain.
+	response string
+}
+
+// match reports whether the policy matches a record in the response to qname.
+func (p answerPolicy) match(qname string, ip net.IP) bool {
+	if len(p.except) > 0 && plugin.Zones(p.except).Matches(qname) != "" {
+		return false
+	}
+	return p.filter.Contains(ip)
+}
+
+// answerWriter is a dns.ResponseWriter which enforces answer policies and
+// response triggers of Response Policy Zones on responses before writing them.
+type answerWriter struct {
+	dns.ResponseWriter
+
+	policies []answerPolicy
+	// policyZones are the zones of the rules of policies, by index, which
+	// label the metrics of the policies deciding records.
+	policyZones []string
+	rpzZones    []*rpzZone
+	// rpzRuleZones are the zones of the rules of rpzZones, by index.
+	rpzRuleZones []string
+	// proto is the protocol over which the query is received.
+	proto  string
+	server string
+}
+
+// addPolicies adds the answer policies of the rule of zone.
+func (aw *answerWriter) addPolicies(zone string, policies []answerPolicy) {
+	for _, p := range policies {
+		aw.policies = append(aw.policies, p)
+		aw.policyZones = append(aw.policyZones, zone)
+	}
+}
+
+// addRPZZones adds the Response Policy Zones of the rule of zone.
+func (aw *answerWriter) addRPZZones(zone string, zones []*rpzZone) {
+	for _, z := range zones {
+		aw.rpzZones = append(aw.rpzZones, z)
+		aw.rpzRuleZones = append(aw.rpzRuleZones, zone)
+	}
+}
+
+// WriteMsg implements the dns.ResponseWriter interface.
+func (aw *answerWriter) WriteMsg(res *dns.Msg) error {
+	qname := ""
+	if len(res.Question) > 0 {
+		qname = res.Question[0].Name
+	}
+
+	answer := res.Answer[:0]
+	stripped := false
+	for _, rr := range res.Answer {
+		i := aw.blockedBy(qname, rr)
+		if i < 0 {
+			answer = append(answer, rr)
+			continue
+		}
+		ResponseBlockCount.WithLabelValues(aw.server, aw.policyZones[i]).Inc()
+		switch aw.policies[i].response {
+		case answerRefuse:
+			return aw.ResponseWriter.WriteMsg(replaceResponse(res, dns.RcodeRefused))
+		case answerNXDomain:
+			return aw.ResponseWriter.WriteMsg(replaceResponse(res, dns.RcodeNameError))
+		}
+		stripped = true
+	}
+	res.Answer = answer
+	if stripped {
+		res.Answer = stripOrphanRRSIGs(res.Answer)
+	}
+
+	for i, z := range aw.rpzZones {
+		act := z.responseAction(res)
+		if act == nil {
+			continue
+		}
+		RPZHitCount.WithLabelValues(aw.server, aw.rpzRuleZones[i], act.kind).Inc()
+		switch act.kind {
+		case rpzPassthru:
+			return aw.ResponseWriter.WriteMsg(res)
+		case rpzTCPOnly:
+			if aw.proto != "udp" {
+				return aw.ResponseWriter.WriteMsg(res)
+			}
+			m := new(dns.Msg)
+			m.SetReply(res)
+			m.Truncated = true
+			return aw.ResponseWriter.WriteMsg(m)
+		}
+		if m := act.reply(res); m != nil {
+			return aw.ResponseWriter.WriteMsg(m)
+		}
+		// dropped.
+		return nil
+	}
+	return aw.ResponseWriter.WriteMsg(res)
+}
+
+// Write implements the dns.ResponseWriter interface.
+func (aw *answerWriter) Write(buf []byte) (int, error) {
+	res := new(dns.Msg)
+	if err := res.Unpack(buf); err != nil {
+		return aw.ResponseWriter.Write(buf)
+	}
+	return len(buf), aw.WriteMsg(res)
+}
+
+// blockedBy returns the index of the policy which blocks rr, or -1 if it is
+// allowed.
+func (aw *answerWriter) blockedBy(qname string, rr dns.RR) int {
+	var ip net.IP
+	switch r := rr.(type) {
+	case *dns.A:
+		ip = r.A
+	case *dns.AAAA:
+		ip = r.AAAA
+	default:
+		return -1
+	}
+	for i, p := range aw.policies {
+		if !p.match(qname, ip) {
+			continue
+		}
+		if p.action == BLOCK {
+			return i
+		}
+		return -1
+	}
+	return -1
+}
+
+// stripOrphanRRSIGs removes the RRSIGs whose covered RRsets have no records
+// left in answer, e.g., after all A records of a name are stripped.
+func stripOrphanRRSIGs(answer []dns.RR) []dns.RR {
+	type rrset struct {
+		name  string
+		rtype uint16
+	}
+	rrsets := make(map[rrset]bool)
+	for _, rr := range answer {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			rrsets[rrset{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}] = true
+		}
+	}
+	kept := answer[:0]
+	for _, rr := range answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if ok && !rrsets[rrset{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}] {
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+// replaceResponse creates an empty response to res with rcode.
+func replaceResponse(res *dns.Msg, rcode int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(res, rcode)
+	m.RecursionAvailable = res.RecursionAvailable
+	return m
+}
+
+// parseAnswerPolicy parses an answer policy following 'answer'. Local files
+// which the policy is loaded from are watched by rl.
+func parseAnswerPolicy(c *caddy.Controller, action string, rl *reloader, sets netSets) (answerPolicy, error) {
+	/*
+	 * ACTION answer net SOURCE [except zones ZONES...] [response strip | refuse | nxdomain]
+	 *
+	 * ACTION: allow | block
+	 */
+	p := answerPolicy{action: action, response: answerStrip}
+	if p.action != ALLOW && p.action != BLOCK {
+		return p, c.Errf("Unexpected token '%s'; expect '%s' or '%s'", action, ALLOW, BLOCK)
+	}
+
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return p, c.ArgErr()
+	}
+	src := source{}
+	for len(args) > 0 {
+		var values []string
+		clause := strings.ToLower(args[0])
+		values, args = clauseValues(args[1:])
+		switch clause {
+		case "net", "file":
+			if err := src.add(c, clause, values, sets); err != nil {
+				return p, err
+			}
+		case "except":
+			if len(values) < 2 || strings.ToLower(values[0]) != "zones" {
+				return p, c.Errf("Unexpected tokens '%s'; expect 'except zones ZONES...'", strings.Join(values, " "))
+			}
+			for _, zone := range values[1:] {
+				p.except = append(p.except, plugin.Host(zone).Normalize())
+			}
+		case "response":
+			if len(values) != 1 {
+				return p, c.ArgErr()
+			}
+			p.response = strings.ToLower(values[0])
+			if p.response != answerStrip && p.response != answerRefuse && p.response != answerNXDomain {
+				return p, c.Errf("Unexpected token '%s'; expect '%s', '%s' or '%s'", values[0], answerStrip, answerRefuse, answerNXDomain)
+			}
+		default:
+			return p, c.Errf("Unexpected token '%s'; expect 'net', 'file', 'except' or 'response'", clause)
+		}
+	}
+	if src.empty() {
+		return p, c.Errf("no 'net' or 'file' is specified")
+	}
+	var err error
+	p.filter, err = src.filter(c, rl)
+	return p, err
+}
@@ -0,0 +1,236 @@
+package acl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// answerHandler responds to all queries with answers.
+func answerHandler(answers ...string) plugin.Handler {
+	return plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, answer := range answers {
+			rr, err := dns.NewRR(answer)
+			if err != nil {
+				return dns.RcodeServerFailure, err
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+}
+
+func Test_acl_ServeDNS_answer(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		qname       string
+		answers     []string
+		wantRcode   int
+		wantAnswers int
+	}{
+		{
+			"Strip private answers",
+			`acl example.org {
+				block answer net PRIVATE
+			}`,
+			"www.example.org.",
+			[]string{"www.example.org. 300 IN A 192.168.1.1", "www.example.org. 300 IN A 1.2.3.4"},
+			dns.RcodeSuccess,
+			1,
+		},
+		{
+			"Public answers",
+			`acl example.org {
+				block answer net PRIVATE
+			}`,
+			"www.example.org.",
+			[]string{"www.example.org. 300 IN A 1.2.3.4", "www.example.org. 300 IN A 1.2.3.5"},
+			dns.RcodeSuccess,
+			2,
+		},
+		{
+			"Refuse private answers",
+			`acl example.org {
+				block answer net PRIVATE response refuse
+			}`,
+			"www.example.org.",
+			[]string{"www.example.org. 300 IN A 1.2.3.4", "www.example.org. 300 IN A 10.0.0.1"},
+			dns.RcodeRefused,
+			0,
+		},
+		{
+			"NXDOMAIN private answers",
+			`acl example.org {
+				block answer net PRIVATE response nxdomain
+			}`,
+			"www.example.org.",
+			[]string{"www.example.org. 300 IN A 172.16.0.1"},
+			dns.RcodeNameError,
+			0,
+		},
+		{
+			"Except zones",
+			`acl example.org {
+				block answer net PRIVATE except zones corp.example.org
+			}`,
+			"www.corp.example.org.",
+			[]string{"www.corp.example.org. 300 IN A 192.168.1.1"},
+			dns.RcodeSuccess,
+			1,
+		},
+		{
+			"Allow answer before block",
+			`acl example.org {
+				allow answer net 192.168.1.0/24
+				block answer net PRIVATE
+			}`,
+			"www.example.org.",
+			[]string{"www.example.org. 300 IN A 192.168.1.1", "www.example.org. 300 IN A 192.168.2.1"},
+			dns.RcodeSuccess,
+			1,
+		},
+		{
+			"Other zones",
+			`acl example.org {
+				block answer net PRIVATE
+			}`,
+			"www.example.com.",
+			[]string{"www.example.com. 300 IN A 192.168.1.1"},
+			dns.RcodeSuccess,
+			1,
+		},
+		{
+			"Strip IPv6 answers",
+			`acl example.org {
+				block answer net fc00::/7
+			}`,
+			"www.example.org.",
+			[]string{"www.example.org. 300 IN AAAA fd00::1", "www.example.org. 300 IN AAAA 2001:db8::1"},
+			dns.RcodeSuccess,
+			1,
+		},
+		{
+			"Refuse IPv6 answers",
+			`acl example.org {
+				block answer net fc00::/7 response refuse
+			}`,
+			"www.example.org.",
+			[]string{"www.example.org. 300 IN AAAA 2001:db8::1", "www.example.org. 300 IN AAAA fd12:3456::1"},
+			dns.RcodeRefused,
+			0,
+		},
+		{
+			"IPv6 networks and IPv4 answers",
+			`acl example.org {
+				block answer net fc00::/7
+			}`,
+			"www.example.org.",
+			[]string{"www.example.org. 300 IN A 192.168.1.1", "www.example.org. 300 IN AAAA fe80::1"},
+			dns.RcodeSuccess,
+			2,
+		},
+		{
+			"Strip RRSIGs of stripped records",
+			`acl example.org {
+				block answer net PRIVATE
+			}`,
+			"www.example.org.",
+			[]string{
+				"www.example.org. 300 IN CNAME host.example.org.",
+				"www.example.org. 300 IN RRSIG CNAME 8 3 300 20300101000000 20200101000000 12345 example.org. dGVzdA==",
+				"host.example.org. 300 IN A 192.168.1.1",
+				"host.example.org. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 12345 example.org. dGVzdA==",
+			},
+			dns.RcodeSuccess,
+			2,
+		},
+		{
+			"Keep RRSIGs of remaining records",
+			`acl example.org {
+				block answer net PRIVATE
+			}`,
+			"www.example.org.",
+			[]string{
+				"www.example.org. 300 IN A 192.168.1.1",
+				"www.example.org. 300 IN A 1.2.3.4",
+				"www.example.org. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 12345 example.org. dGVzdA==",
+			},
+			dns.RcodeSuccess,
+			2,
+		},
+		{
+			"Query blocked",
+			`acl example.org {
+				block type ANY net 10.1.0.0/16
+				block answer net PRIVATE
+			}`,
+			"www.example.org.",
+			[]string{"www.example.org. 300 IN A 1.2.3.4"},
+			dns.RcodeRefused,
+			0,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseACL(caddy.NewTestController("dns", tt.config))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			a.Next = answerHandler(tt.answers...)
+
+			w := &testResponseWriter{}
+			w.setRemoteIP("10.1.0.2")
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, dns.TypeA)
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+			if len(w.Msg.Answer) != tt.wantAnswers {
+				t.Errorf("acl.ServeDNS() returns %d answers, want %d", len(w.Msg.Answer), tt.wantAnswers)
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_answerZone(t *testing.T) {
+	a, err := parseACL(caddy.NewTestController("dns", `
+	acl example.org {
+		allow answer net 10.0.0.0/8
+	}
+	acl sub.example.org {
+		block answer net PRIVATE
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = answerHandler("www.sub.example.org. 300 IN A 192.168.1.1")
+
+	// the rule of the policy blocking the record labels the metrics.
+	before := testutil.ToFloat64(ResponseBlockCount.WithLabelValues("", "sub.example.org."))
+	w := &testResponseWriter{}
+	w.setRemoteIP("10.1.0.2")
+	m := new(dns.Msg)
+	m.SetQuestion("www.sub.example.org.", dns.TypeA)
+	if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+		t.Fatalf("acl.ServeDNS() error = %v", err)
+	}
+	if len(w.Msg.Answer) != 0 {
+		t.Errorf("acl.ServeDNS() returns %d answers, want 0", len(w.Msg.Answer))
+	}
+	if got := testutil.ToFloat64(ResponseBlockCount.WithLabelValues("", "sub.example.org.")) - before; got != 1 {
+		t.Errorf("ResponseBlockCount of zone sub.example.org. increases by %v, want 1", got)
+	}
+}
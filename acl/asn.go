@@ -0,0 +1,246 @@
+package acl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy"
+	"github.com/ihac/acl/acl/filter"
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbMetadataMarker starts the metadata of MaxMind databases, which tells
+// them from TSV files.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// asnDB maps the addresses of clients to their ASNs, loaded from a local
+// ip2asn TSV file or a MaxMind ASN database. It is reloaded once the file
+// changes.
+type asnDB struct {
+	name string
+
+	mu    sync.RWMutex
+	table *filter.RangeMap
+}
+
+// asnRecord is the part of a record of a MaxMind ASN database which is
+// decoded.
+type asnRecord struct {
+	ASN uint32 `maxminddb:"autonomous_system_number"`
+}
+
+func newASNDB(name string) (*asnDB, error) {
+	db := &asnDB{name: name}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// load (re)loads the table from the file.
+func (db *asnDB) load() error {
+	table, err := loadASNTable(db.name)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.table = table
+	db.mu.Unlock()
+	return nil
+}
+
+// asn returns the ASN of a, or false if a is not routed.
+func (db *asnDB) asn(a filter.Addr) (uint32, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.table.Get(a)
+}
+
+// loadASNTable loads the ranges of ASNs from a MaxMind database, or from an
+// ip2asn TSV file, which may be gzip-compressed.
+func loadASNTable(name string) (*filter.RangeMap, error) {
+	data, err := readFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var table *filter.RangeMap
+	if bytes.Contains(data, mmdbMetadataMarker) {
+		table, err = loadASNFromMMDB(data)
+	} else {
+		table, err = loadASNFromTSV(name, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	table.Sort()
+	return table, nil
+}
+
+// readFile reads a local file, which is decompressed if gzip-compressed.
+func readFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return data, nil
+}
+
+func loadASNFromMMDB(data []byte) (*filter.RangeMap, error) {
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	table := filter.NewRangeMap()
+	networks := reader.Networks()
+	for networks.Next() {
+		var record asnRecord
+		n, err := networks.Network(&record)
+		if err != nil {
+			return nil, err
+		}
+		if record.ASN == 0 {
+			continue
+		}
+		if ones, _ := n.Mask.Size(); ones >= 96 && isV4Compatible(n.IP) {
+			// IPv4 networks are held in ::/96 of IPv6 databases.
+			n = &net.IPNet{IP: n.IP[12:], Mask: net.CIDRMask(ones-96, 32)}
+		}
+		if err := table.InsertNet(*n, record.ASN); err != nil {
+			return nil, err
+		}
+	}
+	if err := networks.Err(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// isV4Compatible reports whether ip is in ::/96.
+func isV4Compatible(ip net.IP) bool {
+	if len(ip) != net.IPv6len {
+		return false
+	}
+	for _, b := range ip[:12] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// loadASNFromTSV loads ranges from an ip2asn TSV file, whose lines are
+// 'range_start range_end AS_number country_code AS_description'. Ranges of
+// AS 0 are not routed.
+func loadASNFromTSV(name string, data []byte) (*filter.RangeMap, error) {
+	table := filter.NewRangeMap()
+	lineNum := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lineNum++
+		line := stripComment(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: Unexpected tokens '%s'", name, lineNum, line)
+		}
+		start, end := net.ParseIP(strings.TrimSpace(fields[0])), net.ParseIP(strings.TrimSpace(fields[1]))
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("%s:%d: Illegal IP range '%s-%s'", name, lineNum, fields[0], fields[1])
+		}
+		asn, err := parseASN(strings.TrimSpace(fields[2]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, lineNum, err)
+		}
+		if asn == 0 {
+			continue
+		}
+		if err := table.Insert(start, end, asn); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return table, nil
+}
+
+// parseASN parses an AS number, which may be prefixed by 'AS'.
+func parseASN(raw string) (uint32, error) {
+	if len(raw) > 2 && strings.EqualFold(raw[:2], "AS") {
+		raw = raw[2:]
+	}
+	asn, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Illegal AS number '%s'", raw)
+	}
+	return uint32(asn), nil
+}
+
+// asnMatcher matches clients by their ASNs.
+type asnMatcher struct {
+	// db is the table of the rule, which is set once the rule is parsed.
+	db   *asnDB
+	asns []uint32
+	// negate matches clients outside of the ASNs, including those not
+	// routed.
+	negate bool
+}
+
+// parseASNMatcher parses the ASNs of an 'asn' clause, separated by commas or
+// spaces, which are negated by a leading '!'.
+func parseASNMatcher(c *caddy.Controller, values []string) (*asnMatcher, error) {
+	m := &asnMatcher{}
+	raw := strings.Join(values, ",")
+	if strings.HasPrefix(raw, "!") {
+		m.negate = true
+		raw = raw[1:]
+	}
+	for _, v := range strings.Split(raw, ",") {
+		if v == "" {
+			continue
+		}
+		asn, err := parseASN(v)
+		if err != nil {
+			return nil, c.Errf("%v", err)
+		}
+		m.asns = append(m.asns, asn)
+	}
+	if len(m.asns) == 0 {
+		return nil, c.ArgErr()
+	}
+	return m, nil
+}
+
+// matches reports whether the client of the query is matched.
+func (m *asnMatcher) matches(q *query) bool {
+	asn, ok := m.db.asn(q.ip)
+	matched := false
+	if ok {
+		for _, v := range m.asns {
+			if v == asn {
+				matched = true
+				break
+			}
+		}
+	}
+	return matched != m.negate
+}
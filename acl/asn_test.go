@@ -0,0 +1,186 @@
+package acl
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/ihac/acl/acl/filter"
+	"github.com/miekg/dns"
+)
+
+const asnTestTable = `# range_start	range_end	AS_number	country_code	AS_description
+1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET
+1.0.1.0	1.0.3.255	0	None	Not routed
+104.131.0.0	104.131.255.255	14061	US	DIGITALOCEAN-ASN
+52.0.0.0	52.79.255.255	16509	US	AMAZON-02
+2001:db8::	2001:db8:ffff:ffff:ffff:ffff:ffff:ffff	64500	ZZ	EXAMPLE
+`
+
+func testAddr(s string) filter.Addr {
+	a, _ := filter.AddrFromIP(net.ParseIP(s))
+	return a
+}
+
+// mmdbASN writes a record of an ASN database.
+func mmdbASN(buf *bytes.Buffer, asn string) {
+	v, _ := strconv.ParseUint(asn, 10, 32)
+	mmdbMap(buf, 1)
+	mmdbString(buf, "autonomous_system_number")
+	mmdbUint(buf, 6, v)
+}
+
+func Test_acl_ServeDNS_asn(t *testing.T) {
+	if err := ioutil.WriteFile("acl-test-asn.tsv", []byte(asnTestTable), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("acl-test-asn.tsv")
+
+	a, err := parseACL(caddy.NewTestController("dns", `acl example.org {
+		asn_db acl-test-asn.tsv
+		allow type ANY net 104.131.1.0/24
+		block type ANY asn 14061,AS16509
+		block type MX asn !13335
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	tests := []struct {
+		name      string
+		source    string
+		qtype     uint16
+		wantRcode int
+	}{
+		{"Listed ASN", "104.131.2.3", dns.TypeA, dns.RcodeRefused},
+		{"Other listed ASN", "52.1.2.3", dns.TypeA, dns.RcodeRefused},
+		{"Allowed before", "104.131.1.3", dns.TypeA, dns.RcodeSuccess},
+		{"ASN not listed", "1.0.0.1", dns.TypeA, dns.RcodeSuccess},
+		{"Not routed", "1.0.2.1", dns.TypeA, dns.RcodeSuccess},
+		{"Negated ASN", "1.0.0.1", dns.TypeMX, dns.RcodeSuccess},
+		{"Negated other ASN", "2001:db8::1", dns.TypeMX, dns.RcodeRefused},
+		{"Negated not routed", "1.0.2.1", dns.TypeMX, dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testResponseWriter{}
+			w.setRemoteIP(tt.source)
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.org.", tt.qtype)
+			if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_asnDB(t *testing.T) {
+	if err := ioutil.WriteFile("acl-test-asn.tsv", []byte(asnTestTable), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("acl-test-asn.tsv")
+	writeTestMMDB(t, "acl-test-asn.mmdb", map[string]string{
+		"104.131.0.0/16": "14061",
+		"2001:db8::/32":  "64500",
+	}, mmdbASN)
+	defer os.Remove("acl-test-asn.mmdb")
+
+	tests := []struct {
+		file  string
+		addr  string
+		want  uint32
+		found bool
+	}{
+		{"acl-test-asn.tsv", "1.0.0.200", 13335, true},
+		{"acl-test-asn.tsv", "1.0.2.1", 0, false},
+		{"acl-test-asn.tsv", "52.79.255.255", 16509, true},
+		{"acl-test-asn.tsv", "2001:db8:1::1", 64500, true},
+		{"acl-test-asn.tsv", "8.8.8.8", 0, false},
+		{"acl-test-asn.mmdb", "104.131.2.3", 14061, true},
+		{"acl-test-asn.mmdb", "::ffff:104.131.2.3", 14061, true},
+		{"acl-test-asn.mmdb", "2001:db8::1", 64500, true},
+		{"acl-test-asn.mmdb", "52.1.2.3", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file+"/"+tt.addr, func(t *testing.T) {
+			db, err := newASNDB(tt.file)
+			if err != nil {
+				t.Fatalf("newASNDB() error = %v", err)
+			}
+			got, found := db.asn(testAddr(tt.addr))
+			if got != tt.want || found != tt.found {
+				t.Errorf("asnDB.asn() = %v, %v, want %v, %v", got, found, tt.want, tt.found)
+			}
+		})
+	}
+
+	// the table is reloaded.
+	db, err := newASNDB("acl-test-asn.tsv")
+	if err != nil {
+		t.Fatalf("newASNDB() error = %v", err)
+	}
+	if err := ioutil.WriteFile("acl-test-asn.tsv", []byte("1.0.0.0\t1.0.0.255\tAS64501\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.load(); err != nil {
+		t.Fatalf("asnDB.load() error = %v", err)
+	}
+	if got, _ := db.asn(testAddr("1.0.0.1")); got != 64501 {
+		t.Errorf("asnDB.asn() after reload = %v, want 64501", got)
+	}
+	if _, found := db.asn(testAddr("52.1.2.3")); found {
+		t.Errorf("asnDB.asn() after reload finds a dropped range")
+	}
+}
+
+func Test_setup_asn(t *testing.T) {
+	files := map[string]string{
+		"acl-test-asn.tsv":           asnTestTable,
+		"acl-test-asn-bad-range.tsv": "1.0.0.9\t1.0.0.0\t13335\n",
+		"acl-test-asn-bad-asn.tsv":   "1.0.0.0\t1.0.0.255\tCLOUDFLARE\n",
+		"acl-test-asn-bad-line.tsv":  "1.0.0.0 1.0.0.255 13335\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(name)
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"ASNs", "asn_db acl-test-asn.tsv\nblock type ANY asn 14061 AS16509", false},
+		{"Negated ASNs", "asn_db acl-test-asn.tsv\nblock type ANY asn !13335,64500 net 10.0.0.0/8", false},
+		{"Table after policies", "block type ANY asn 14061\nasn_db acl-test-asn.tsv", false},
+		{"No table", "block type ANY asn 14061", true},
+		{"Missing table", "asn_db acl-test-missing.tsv", true},
+		{"Table twice", "asn_db acl-test-asn.tsv\nasn_db acl-test-asn.tsv", true},
+		{"Illegal range", "asn_db acl-test-asn-bad-range.tsv", true},
+		{"Illegal ASN in table", "asn_db acl-test-asn-bad-asn.tsv", true},
+		{"Illegal line", "asn_db acl-test-asn-bad-line.tsv", true},
+		{"Illegal ASN", "asn_db acl-test-asn.tsv\nblock type ANY asn DIGITALOCEAN", true},
+		{"ASN out of range", "asn_db acl-test-asn.tsv\nblock type ANY asn 4294967296", true},
+		{"No ASN", "asn_db acl-test-asn.tsv\nblock type ANY asn !", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseACL(caddy.NewTestController("dns", "acl {\n"+tt.config+"\n}"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseACL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
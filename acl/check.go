@@ -0,0 +1,260 @@
+package acl
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Checker evaluates queries against the acl stanzas of a server block
+// offline, without running a server. Only the query phase is evaluated,
+// i.e., answer policies and response triggers of RPZ are not.
+type Checker struct {
+	// Keys are the keys of the server block, e.g., 'example.org:53'.
+	Keys []string
+
+	acl acl
+}
+
+// CheckQuery is a query to be checked.
+type CheckQuery struct {
+	Name string
+	Type uint16
+	// Source is the address the query is received from.
+	Source net.IP
+	// Local is the local address the query is received on. Nil means
+	// unknown.
+	Local net.IP
+	// TCP reports whether the query is received over TCP rather than UDP.
+	TCP bool
+}
+
+// CheckResult is the outcome of checking a query.
+type CheckResult struct {
+	// Zones are the zones of the rule deciding the query, or empty if no
+	// rule does.
+	Zones []string
+	// Policy describes the policy or RPZ deciding the query, or empty if
+	// none does.
+	Policy string
+	// Action is the action taken towards the query, i.e., allow, block,
+	// nxdomain, drop, truncate, or an RPZ action such as 'rpz nxdomain'.
+	Action string
+}
+
+// offlineKey marks controllers of offline checks in their storage, so that
+// parsing them writes nothing to the filesystem, e.g., snapshots.
+type offlineKey struct{}
+
+// isOffline reports whether c parses acl stanzas for offline checks.
+func isOffline(c *caddy.Controller) bool {
+	return c.Get(offlineKey{}) != nil
+}
+
+// NewCheckers parses the acl stanzas of all server blocks in a Corefile.
+// Server blocks without acl are skipped. Snapshots of cached network files
+// are loaded if they are up to date, but never written.
+func NewCheckers(filename string, input io.Reader) ([]*Checker, error) {
+	blocks, err := caddyfile.Parse(filename, input, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var checkers []*Checker
+	for _, block := range blocks {
+		tokens := block.Tokens["acl"]
+		if len(tokens) == 0 {
+			continue
+		}
+		c := caddy.NewTestController("dns", "")
+		c.Dispenser = caddyfile.NewDispenserTokens(filename, tokens)
+		c.ServerBlockKeys = block.Keys
+		c.Set(offlineKey{}, true)
+		a, err := parseACL(c)
+		if err != nil {
+			return nil, err
+		}
+		a.transport, _ = parse.Transport(block.Keys[0])
+		checkers = append(checkers, &Checker{Keys: block.Keys, acl: a})
+	}
+	return checkers, nil
+}
+
+// Match returns the zone of the server block matching qname, or empty if
+// none does.
+func (ch *Checker) Match(qname string) string {
+	zones := make([]string, len(ch.Keys))
+	for i, key := range ch.Keys {
+		zones[i] = plugin.Host(key).Normalize()
+	}
+	return plugin.Zones(zones).Matches(dns.Fqdn(qname))
+}
+
+// String describes the compiled rules.
+func (ch *Checker) String() string {
+	var b strings.Builder
+	for _, rule := range ch.acl.Rules {
+		fmt.Fprintf(&b, "acl %s {\n", strings.Join(rule.Zones, " "))
+		for _, p := range rule.Policies {
+			fmt.Fprintf(&b, "    %s\n", p.text)
+			if p.file == nil {
+				continue
+			}
+			last := ""
+			for _, fp := range p.file.Policies() {
+				// policies for multiple qtypes share the same text.
+				if fp.text != last {
+					fmt.Fprintf(&b, "        %s", fp.text)
+					if fp.response != "" {
+						fmt.Fprintf(&b, " (response %s)", fp.response)
+					}
+					b.WriteString("\n")
+					last = fp.text
+				}
+			}
+		}
+		for _, p := range rule.answerPolicies {
+			fmt.Fprintf(&b, "    %s\n", p.text)
+		}
+		for _, z := range rule.rpzZones {
+			fmt.Fprintf(&b, "    rpz %s\n", z.file)
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// Check evaluates the query against the rules in the same way as ServeDNS.
+// It is a dry run, which leaves rate limits and subdomain counters unchanged,
+// so that the result does not depend on the queries checked before.
+func (ch *Checker) Check(q CheckQuery) (CheckResult, error) {
+	w := &checkWriter{}
+	if q.TCP {
+		w.remote = &net.TCPAddr{IP: q.Source}
+		if q.Local != nil {
+			w.local = &net.TCPAddr{IP: q.Local}
+		}
+	} else {
+		w.remote = &net.UDPAddr{IP: q.Source}
+		if q.Local != nil {
+			w.local = &net.UDPAddr{IP: q.Local}
+		}
+	}
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(q.Name), q.Type)
+
+	result := CheckResult{Action: ALLOW}
+	traces, err := ch.acl.trace(w, r)
+	if err != nil {
+		return result, err
+	}
+	for _, t := range traces {
+		if t.decides() {
+			return t.result(), nil
+		}
+		if t.policy != nil && result.Policy == "" {
+			// the first policy allowing the query.
+			result.Zones, result.Policy = t.zones, t.policy.text
+		}
+	}
+	return result, nil
+}
+
+// ruleTrace is the outcome of evaluating a query against a rule.
+type ruleTrace struct {
+	zones []string
+	// action is taken by policy, or ALLOW if policy is nil.
+	action string
+	policy *Policy
+	// rpz is the response policy zone whose query trigger matches, with
+	// its action rpzAction.
+	rpz       *rpzZone
+	rpzAction *rpzAction
+	// proto is the protocol the query is received over, i.e., udp or tcp.
+	proto string
+}
+
+// decides reports whether the rule decides the query, i.e., the query does
+// not go on to the next rule.
+func (t ruleTrace) decides() bool {
+	if t.action != ALLOW {
+		return true
+	}
+	if t.rpzAction == nil {
+		return false
+	}
+	switch t.rpzAction.kind {
+	case rpzPassthru:
+		return false
+	case rpzTCPOnly:
+		return t.proto == "udp"
+	}
+	return true
+}
+
+// result describes the outcome of a rule deciding the query.
+func (t ruleTrace) result() CheckResult {
+	if t.action != ALLOW {
+		return CheckResult{Zones: t.zones, Policy: t.policy.text, Action: t.action}
+	}
+	return CheckResult{Zones: t.zones, Policy: "rpz " + t.rpz.file, Action: "rpz " + t.rpzAction.kind}
+}
+
+// trace evaluates the query phase of r in the same way as ServeDNS, and
+// returns the outcome of each rule evaluated in order, up to the one
+// deciding the query if any. The evaluation is a dry run, so that tracing
+// does not consume the rate limits of clients.
+func (a acl) trace(w dns.ResponseWriter, r *dns.Msg) ([]ruleTrace, error) {
+	state := request.Request{W: w, Req: r}
+	var traces []ruleTrace
+	for _, zr := range a.zones.lookup(state.Name()) {
+		rule := a.Rules[zr.rule]
+		action, policy, err := evaluate(rule, a.transport, w, r, true)
+		if err != nil {
+			return traces, err
+		}
+		t := ruleTrace{zones: rule.Zones, action: action, policy: policy, proto: state.Proto()}
+		if action == ALLOW && len(rule.rpzZones) > 0 {
+			ip, _, err := clientIP(rule, state)
+			if err != nil {
+				return traces, err
+			}
+			for _, z := range rule.rpzZones {
+				if act := z.queryAction(ip, state.Name()); act != nil {
+					t.rpz, t.rpzAction = z, act
+					break
+				}
+			}
+		}
+		traces = append(traces, t)
+		if t.decides() {
+			break
+		}
+	}
+	return traces, nil
+}
+
+// checkWriter is a dns.ResponseWriter which discards all responses.
+type checkWriter struct {
+	remote net.Addr
+	local  net.Addr
+}
+
+var _ dns.ResponseWriter = &checkWriter{}
+
+func (w *checkWriter) LocalAddr() net.Addr         { return w.local }
+func (w *checkWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *checkWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (w *checkWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *checkWriter) Close() error                { return nil }
+func (w *checkWriter) TsigStatus() error           { return nil }
+func (w *checkWriter) TsigTimersOnly(bool)         {}
+func (w *checkWriter) Hijack()                     {}
@@ -0,0 +1,163 @@
+package acl
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestChecker_Check(t *testing.T) {
+	envSetup(rpzTestFiles)
+	defer envCleanup(rpzTestFiles)
+
+	corefile := `
+example.org {
+    acl {
+        allow type ANY net 10.0.0.0/8
+        block type TXT net ANY
+        block type MX net 192.168.0.0/16 response nxdomain
+    }
+    acl sub.example.org example.com {
+        truncate type ANY net 172.16.0.0/12
+        rpz acl-test-rpz.db
+    }
+}
+tls://example.net {
+    acl {
+        block type ANY net ANY proto tls
+    }
+}
+.:53 {
+    whoami
+}
+`
+	checkers, err := NewCheckers("Corefile", strings.NewReader(corefile))
+	if err != nil {
+		t.Fatalf("NewCheckers() error = %v", err)
+	}
+	if len(checkers) != 2 {
+		t.Fatalf("NewCheckers() returns %d checkers, want 2", len(checkers))
+	}
+	if zone := checkers[0].Match("www.example.org"); zone != "example.org." {
+		t.Errorf("Checker.Match() = %q, want %q", zone, "example.org.")
+	}
+	if zone := checkers[0].Match("example.com."); zone != "" {
+		t.Errorf("Checker.Match() = %q, want empty", zone)
+	}
+	rules := checkers[0].String()
+	for _, want := range []string{"acl example.org. {\n", "    block type TXT net ANY\n", "    rpz acl-test-rpz.db\n"} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("Checker.String() = %q, want to contain %q", rules, want)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		checker    int
+		query      CheckQuery
+		wantAction string
+		wantPolicy string
+	}{
+		{"Allowed", 0, CheckQuery{Name: "foo.example.org", Type: dns.TypeTXT, Source: net.ParseIP("10.1.2.3")}, ALLOW, "allow type ANY net 10.0.0.0/8"},
+		{"Blocked", 0, CheckQuery{Name: "foo.example.org", Type: dns.TypeTXT, Source: net.ParseIP("192.168.0.1")}, BLOCK, "block type TXT net ANY"},
+		{"Block response", 0, CheckQuery{Name: "foo.example.org", Type: dns.TypeMX, Source: net.ParseIP("192.168.0.1")}, NXDOMAIN, "block type MX net 192.168.0.0/16 response nxdomain"},
+		{"Not matched", 0, CheckQuery{Name: "foo.example.org", Type: dns.TypeA, Source: net.ParseIP("192.168.0.1")}, ALLOW, ""},
+		{"Second rule", 0, CheckQuery{Name: "www.sub.example.org", Type: dns.TypeA, Source: net.ParseIP("172.16.0.1")}, TRUNCATE, "truncate type ANY net 172.16.0.0/12"},
+		{"Second rule over TCP", 0, CheckQuery{Name: "www.sub.example.org", Type: dns.TypeA, Source: net.ParseIP("172.16.0.1"), TCP: true}, ALLOW, ""},
+		{"RPZ", 0, CheckQuery{Name: "nxdomain.example.com", Type: dns.TypeA, Source: net.ParseIP("10.0.0.1")}, "rpz nxdomain", "rpz acl-test-rpz.db"},
+		{"RPZ passthru", 0, CheckQuery{Name: "passthru.nxdomain.example.com", Type: dns.TypeA, Source: net.ParseIP("10.0.0.1")}, ALLOW, ""},
+		{"RPZ TCP-only over TCP", 0, CheckQuery{Name: "tcp.example.com", Type: dns.TypeA, Source: net.ParseIP("10.0.0.1"), TCP: true}, ALLOW, ""},
+		{"Transport", 1, CheckQuery{Name: "example.net", Type: dns.TypeA, Source: net.ParseIP("10.0.0.1"), TCP: true}, BLOCK, "block type ANY net ANY proto tls"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkers[tt.checker].Check(tt.query)
+			if err != nil {
+				t.Fatalf("Checker.Check() error = %v", err)
+			}
+			if got.Action != tt.wantAction {
+				t.Errorf("Checker.Check() action = %v, want %v", got.Action, tt.wantAction)
+			}
+			if got.Policy != tt.wantPolicy {
+				t.Errorf("Checker.Check() policy = %q, want %q", got.Policy, tt.wantPolicy)
+			}
+		})
+	}
+
+	if _, err := NewCheckers("Corefile", strings.NewReader("example.org {\n acl {\n  block type ANY net 10.0.0.0/33\n }\n}\n")); err == nil || !strings.Contains(err.Error(), "Corefile:3") {
+		t.Errorf("NewCheckers() error = %v, want an error at Corefile:3", err)
+	}
+}
+
+func TestChecker_Check_dryRun(t *testing.T) {
+	corefile := `
+example.org {
+    acl {
+        ratelimit 1/h burst 1 type A net ANY
+        block type TXT tunnel unique 1
+    }
+}
+`
+	checkers, err := NewCheckers("Corefile", strings.NewReader(corefile))
+	if err != nil {
+		t.Fatalf("NewCheckers() error = %v", err)
+	}
+
+	queries := []CheckQuery{
+		{Name: "www.example.org", Type: dns.TypeA, Source: net.ParseIP("10.1.2.3")},
+		{Name: "mzxw6ytboi2gk3tq.example.org", Type: dns.TypeTXT, Source: net.ParseIP("10.1.2.3")},
+		{Name: "mfrggzdfmztwq2lk.example.org", Type: dns.TypeTXT, Source: net.ParseIP("10.1.2.3")},
+	}
+	// checks neither consume rate limits nor count subdomains, so the
+	// results do not depend on the order of queries.
+	for _, q := range queries {
+		first, err := checkers[0].Check(q)
+		if err != nil {
+			t.Fatalf("Checker.Check() error = %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			got, err := checkers[0].Check(q)
+			if err != nil {
+				t.Fatalf("Checker.Check() error = %v", err)
+			}
+			if got.Action != first.Action || got.Policy != first.Policy {
+				t.Errorf("Checker.Check(%s) = %v by %q, want %v by %q", q.Name, got.Action, got.Policy, first.Action, first.Policy)
+			}
+		}
+		if first.Action != ALLOW {
+			t.Errorf("Checker.Check(%s) action = %v, want %v", q.Name, first.Action, ALLOW)
+		}
+	}
+}
+
+func TestNewCheckers_cache(t *testing.T) {
+	files := map[string]string{"acl-test-cache.txt": "10.1.0.0/16\n"}
+	envSetup(files)
+	defer envCleanup(files)
+	nf := networkFile{pattern: "acl-test-cache.txt", cache: true}
+	defer os.Remove(nf.snapshotPath())
+
+	checkers, err := NewCheckers("Corefile", strings.NewReader(`
+example.org {
+    acl {
+        block type ANY file acl-test-cache.txt cache
+    }
+}
+`))
+	if err != nil {
+		t.Fatalf("NewCheckers() error = %v", err)
+	}
+	if _, err := os.Stat(nf.snapshotPath()); !os.IsNotExist(err) {
+		t.Errorf("NewCheckers() writes snapshot '%s'", nf.snapshotPath())
+	}
+	result, err := checkers[0].Check(CheckQuery{Name: "example.org", Type: dns.TypeA, Source: net.ParseIP("10.1.0.1")})
+	if err != nil {
+		t.Fatalf("Checker.Check() error = %v", err)
+	}
+	if result.Action != BLOCK {
+		t.Errorf("Checker.Check() action = %q, want %q", result.Action, BLOCK)
+	}
+}
@@ -0,0 +1,175 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// clientIPFromECS takes the client address from the EDNS0 Client Subnet option.
+	clientIPFromECS = "ecs"
+	// clientIPFromProxy takes the client address from the PROXY protocol header.
+	clientIPFromProxy = "proxy"
+	// clientIPFromHeader takes the client address from a header of DoH requests.
+	clientIPFromHeader = "header"
+)
+
+// ProxyProtocolWriter is implemented by the dns.ResponseWriter of listeners
+// which accept PROXY protocol v1/v2. RemoteAddr of such writers returns the
+// address of the proxy, while ProxySourceAddr returns the source address
+// carried in the PROXY header, or nil if there is none. The listeners of
+// CoreDNS itself do not implement it, so 'client_ip proxy' is skipped there.
+type ProxyProtocolWriter interface {
+	ProxySourceAddr() net.Addr
+}
+
+// HTTPRequestWriter is implemented by the dns.ResponseWriter of DoH listeners
+// which expose the underlying HTTP request. The DoH listener of CoreDNS
+// itself does not implement it, so 'client_ip header' is skipped there.
+type HTTPRequestWriter interface {
+	HTTPRequest() *http.Request
+}
+
+// clientIPSource defines a source of forwarded client information.
+type clientIPSource struct {
+	from string
+	// header is the name of the HTTP header, only used by clientIPFromHeader.
+	header string
+}
+
+// clientIP returns the IP address of the client which the query originates
+// from, and the EDNS0 Client Subnet address carried by the query, if any.
+// Forwarded client information is ignored unless the peer is one of the
+// trusted proxies of the rule, so that it cannot be spoofed.
+func clientIP(rule Rule, state request.Request) (net.IP, net.IP, error) {
+	ip := net.ParseIP(state.IP())
+	if ip == nil {
+		return nil, nil, fmt.Errorf("Illegal source ip '%s'", state.IP())
+	}
+	if rule.trustedProxies == nil || !rule.trustedProxies.Contains(ip) {
+		return ip, nil, nil
+	}
+
+	ecs := ecsAddress(state.Req)
+	for _, source := range rule.clientIPFrom {
+		switch source.from {
+		case clientIPFromECS:
+			if ecs != nil {
+				return ecs, ecs, nil
+			}
+		case clientIPFromProxy:
+			pw, ok := state.W.(ProxyProtocolWriter)
+			if !ok {
+				continue
+			}
+			if client := addrIP(pw.ProxySourceAddr()); client != nil {
+				return client, ecs, nil
+			}
+		case clientIPFromHeader:
+			hw, ok := state.W.(HTTPRequestWriter)
+			if !ok || hw.HTTPRequest() == nil {
+				continue
+			}
+			values := hw.HTTPRequest().Header[http.CanonicalHeaderKey(source.header)]
+			if client := forwardedIP(rule, source.header, values); client != nil {
+				return client, ecs, nil
+			}
+		}
+	}
+	return ip, ecs, nil
+}
+
+// forwardedIP returns the client address from the values of a forwarding
+// header, e.g., X-Forwarded-For or Forwarded. Each proxy appends the address
+// of its peer to the list, so the list is walked from right to left and the
+// first address which is not a trusted proxy is the client; anything left to
+// it might be forged by the client.
+func forwardedIP(rule Rule, header string, values []string) net.IP {
+	var addrs []string
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+	if strings.EqualFold(header, "Forwarded") {
+		addrs = forwardedFor(addrs)
+	}
+
+	var client net.IP
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := parseForwardedAddr(addrs[i])
+		if ip == nil {
+			// stop at any malformed address.
+			break
+		}
+		client = ip
+		if !rule.trustedProxies.Contains(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedFor extracts the 'for' parameters of Forwarded elements (RFC 7239).
+func forwardedFor(elements []string) []string {
+	var addrs []string
+	for _, element := range elements {
+		for _, pair := range strings.Split(element, ";") {
+			pair = strings.TrimSpace(pair)
+			if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+				addrs = append(addrs, strings.Trim(pair[4:], `"`))
+			}
+		}
+	}
+	return addrs
+}
+
+// parseForwardedAddr parses an address in a forwarding header, which can be an
+// IP address with or without port, or a bracketed IPv6 address.
+func parseForwardedAddr(addr string) net.IP {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// addrIP returns the IP address of addr.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return parseForwardedAddr(addr.String())
+}
+
+// ecsAddress returns the address of the EDNS0 Client Subnet option in r.
+func ecsAddress(r *dns.Msg) net.IP {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		subnet, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		// a source prefix length of 0 means the client opts out.
+		if subnet.SourceNetmask == 0 || subnet.Address == nil {
+			return nil
+		}
+		return subnet.Address
+	}
+	return nil
+}
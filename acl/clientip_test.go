@@ -0,0 +1,312 @@
+package acl
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/ihac/acl/acl/filter"
+	"github.com/miekg/dns"
+)
+
+func newMsgWithECS(qname string, qtype uint16, ecs string, netmask uint8) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	if ecs == "" {
+		return m
+	}
+	m.SetEdns0(4096, false)
+	ip := net.ParseIP(ecs)
+	subnet := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: netmask,
+		Address:       ip.To4(),
+	}
+	if ip.To4() == nil {
+		subnet.Family = 2
+		subnet.Address = ip
+	}
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, subnet)
+	return m
+}
+
+func Test_acl_ServeDNS_ecs(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		sourceIP  string
+		ecs       string
+		netmask   uint8
+		wantRcode int
+	}{
+		{
+			"Client IP from trusted proxy BLOCKED",
+			`acl example.org {
+				trusted_proxies 10.0.0.0/24
+				client_ip ecs
+				block type ANY net 192.168.0.0/16
+			}`,
+			"10.0.0.1",
+			"192.168.1.0",
+			24,
+			dns.RcodeRefused,
+		},
+		{
+			"Client IP from trusted proxy ALLOWED",
+			`acl example.org {
+				trusted_proxies 10.0.0.0/24
+				client_ip ecs
+				block type ANY net 10.0.0.0/8
+			}`,
+			"10.0.0.1",
+			"192.168.1.0",
+			24,
+			dns.RcodeSuccess,
+		},
+		{
+			"Client IP from trusted proxy without ECS",
+			`acl example.org {
+				trusted_proxies 10.0.0.0/24
+				client_ip ecs
+				block type ANY net 10.0.0.0/8
+			}`,
+			"10.0.0.1",
+			"",
+			0,
+			dns.RcodeRefused,
+		},
+		{
+			"Client IP from trusted proxy with ECS opt-out",
+			`acl example.org {
+				trusted_proxies 10.0.0.0/24
+				client_ip ecs
+				block type ANY net 10.0.0.0/8
+			}`,
+			"10.0.0.1",
+			"0.0.0.0",
+			0,
+			dns.RcodeRefused,
+		},
+		{
+			"Client IP from untrusted peer",
+			`acl example.org {
+				trusted_proxies 10.0.0.0/24
+				client_ip ecs
+				block type ANY net 192.168.0.0/16
+			}`,
+			"10.0.1.1",
+			"192.168.1.0",
+			24,
+			dns.RcodeSuccess,
+		},
+		{
+			"ECS matcher BLOCKED",
+			`acl example.org {
+				trusted_proxies 10.0.0.0/24
+				block type ANY net ANY ecs 192.168.0.0/16
+			}`,
+			"10.0.0.1",
+			"192.168.1.0",
+			24,
+			dns.RcodeRefused,
+		},
+		{
+			"ECS matcher ALLOWED",
+			`acl example.org {
+				trusted_proxies 10.0.0.0/24
+				block type ANY net ANY ecs 192.168.0.0/16
+			}`,
+			"10.0.0.1",
+			"172.16.1.0",
+			24,
+			dns.RcodeSuccess,
+		},
+		{
+			"ECS matcher IPv6 ALLOWED",
+			`acl example.org {
+				trusted_proxies 10.0.0.0/24
+				block type ANY net ANY ecs 192.168.0.0/16
+			}`,
+			"10.0.0.1",
+			"2001:db8::",
+			56,
+			dns.RcodeSuccess,
+		},
+		{
+			"ECS matcher IPv6 BLOCKED",
+			`acl example.org {
+				trusted_proxies 10.0.0.0/24
+				block type ANY net ANY ecs 2001:db8::/32
+			}`,
+			"10.0.0.1",
+			"2001:db8::",
+			56,
+			dns.RcodeRefused,
+		},
+		{
+			"Client IP from IPv6 trusted proxy BLOCKED",
+			`acl example.org {
+				trusted_proxies fd00::1
+				client_ip ecs
+				block type ANY net 2001:db8::/32
+			}`,
+			"fd00::1",
+			"2001:db8::",
+			56,
+			dns.RcodeRefused,
+		},
+		{
+			"Client IP from untrusted IPv6 peer",
+			`acl example.org {
+				trusted_proxies fd00::1
+				client_ip ecs
+				block type ANY net 2001:db8::/32
+			}`,
+			"fd00::2",
+			"2001:db8::",
+			56,
+			dns.RcodeSuccess,
+		},
+		{
+			"ECS matcher from untrusted peer",
+			`acl example.org {
+				trusted_proxies 10.0.0.0/24
+				block type ANY net ANY ecs 192.168.0.0/16
+			}`,
+			"10.0.1.1",
+			"192.168.1.0",
+			24,
+			dns.RcodeSuccess,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseACL(caddy.NewTestController("dns", tt.config))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+			w := &testResponseWriter{}
+			w.setRemoteIP(tt.sourceIP)
+			m := newMsgWithECS("www.example.org.", dns.TypeA, tt.ecs, tt.netmask)
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+type proxyProtocolResponseWriter struct {
+	testResponseWriter
+	sourceAddr net.Addr
+}
+
+func (p *proxyProtocolResponseWriter) ProxySourceAddr() net.Addr { return p.sourceAddr }
+
+type httpRequestResponseWriter struct {
+	testResponseWriter
+	req *http.Request
+}
+
+func (h *httpRequestResponseWriter) HTTPRequest() *http.Request { return h.req }
+
+func Test_acl_ServeDNS_proxy(t *testing.T) {
+	config := `acl example.org {
+		trusted_proxies 10.0.0.0/24
+		client_ip proxy header X-Forwarded-For
+		block type ANY net 192.168.0.0/16
+	}`
+
+	tests := []struct {
+		name      string
+		peerIP    string
+		proxySrc  string
+		xff       []string
+		wantRcode int
+	}{
+		{"PROXY protocol BLOCKED", "10.0.0.1", "192.168.1.1", nil, dns.RcodeRefused},
+		{"PROXY protocol ALLOWED", "10.0.0.1", "172.16.1.1", nil, dns.RcodeSuccess},
+		{"PROXY protocol from untrusted peer", "10.0.1.1", "192.168.1.1", nil, dns.RcodeSuccess},
+		{"X-Forwarded-For BLOCKED", "10.0.0.1", "", []string{"192.168.1.1"}, dns.RcodeRefused},
+		{"X-Forwarded-For through trusted proxies", "10.0.0.1", "", []string{"192.168.1.1, 10.0.0.2"}, dns.RcodeRefused},
+		{"X-Forwarded-For forged by client", "10.0.0.1", "", []string{"192.168.1.1, 172.16.1.1"}, dns.RcodeSuccess},
+		{"X-Forwarded-For multiple headers", "10.0.0.1", "", []string{"172.16.1.1", "192.168.1.1"}, dns.RcodeRefused},
+		{"X-Forwarded-For from untrusted peer", "10.0.1.1", "", []string{"192.168.1.1"}, dns.RcodeSuccess},
+		{"PROXY protocol preferred", "10.0.0.1", "172.16.1.1", []string{"192.168.1.1"}, dns.RcodeSuccess},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseACL(caddy.NewTestController("dns", config))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+			var w dns.ResponseWriter
+			var tw *testResponseWriter
+			if tt.proxySrc != "" {
+				pw := &proxyProtocolResponseWriter{sourceAddr: &net.TCPAddr{IP: net.ParseIP(tt.proxySrc), Port: 40212}}
+				w, tw = pw, &pw.testResponseWriter
+			} else {
+				req := httptest.NewRequest("POST", "/dns-query", nil)
+				for _, v := range tt.xff {
+					req.Header.Add("X-Forwarded-For", v)
+				}
+				hw := &httpRequestResponseWriter{req: req}
+				w, tw = hw, &hw.testResponseWriter
+			}
+			tw.setRemoteTCPIP(tt.peerIP)
+
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.org.", dns.TypeA)
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if tw.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", tw.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_forwardedIP(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/24")
+	rule := Rule{}
+	rule.trustedProxies, _ = filter.New("ranges", []net.IPNet{*trusted})
+
+	tests := []struct {
+		name   string
+		header string
+		values []string
+		want   string
+	}{
+		{"Single address", "X-Forwarded-For", []string{"192.168.1.1"}, "192.168.1.1"},
+		{"Address with port", "X-Forwarded-For", []string{"192.168.1.1:4711"}, "192.168.1.1"},
+		{"Bracketed IPv6", "X-Forwarded-For", []string{"[2001:db8::1]"}, "2001:db8::1"},
+		{"Rightmost untrusted", "X-Forwarded-For", []string{"1.1.1.1, 192.168.1.1, 10.0.0.3"}, "192.168.1.1"},
+		{"All trusted", "X-Forwarded-For", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"Malformed", "X-Forwarded-For", []string{"unknown"}, "<nil>"},
+		{"Forwarded", "Forwarded", []string{`for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forwardedIP(rule, tt.header, tt.values); got.String() != tt.want {
+				t.Errorf("forwardedIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/ihac/acl/acl/filter"
+)
+
+// zoneTree indexes rules by their zones, with a node per label from the
+// root, so that the rules whose zones match a name are found by walking the
+// labels of the name once.
+type zoneTree struct {
+	children map[string]*zoneTree
+	// rules are the rules with a zone at or above the node, in order, along
+	// with their longest zone matching names at the node.
+	rules []zoneRule
+	// own are the rules with a zone at the node.
+	own []zoneRule
+}
+
+// zoneRule is a rule found in a zoneTree, along with its zone matching the
+// name looked up.
+type zoneRule struct {
+	rule int
+	zone string
+}
+
+// newZoneTree indexes rules by their zones, which are normalized.
+func newZoneTree(rules []Rule) *zoneTree {
+	root := &zoneTree{}
+	for i, rule := range rules {
+		for _, zone := range rule.Zones {
+			node := root.insert(zone)
+			node.own = append(node.own, zoneRule{rule: i, zone: zone})
+		}
+	}
+	root.inherit(nil)
+	return root
+}
+
+// insert returns the node of zone, creating it if necessary.
+func (t *zoneTree) insert(zone string) *zoneTree {
+	curr := t
+	end := len(zone)
+	if end > 0 && zone[end-1] == '.' {
+		end--
+	}
+	for end > 0 {
+		start := strings.LastIndexByte(zone[:end], '.') + 1
+		label := zone[start:end]
+		next, ok := curr.children[label]
+		if !ok {
+			if curr.children == nil {
+				curr.children = make(map[string]*zoneTree)
+			}
+			next = &zoneTree{}
+			curr.children[label] = next
+		}
+		curr = next
+		end = start - 1
+	}
+	return curr
+}
+
+// inherit sets the rules of the node and its descendants, given the rules of
+// its parent.
+func (t *zoneTree) inherit(parent []zoneRule) {
+	t.rules = append([]zoneRule(nil), parent...)
+	for _, own := range t.own {
+		i := sort.Search(len(t.rules), func(i int) bool { return t.rules[i].rule >= own.rule })
+		if i < len(t.rules) && t.rules[i].rule == own.rule {
+			// a longer zone of the same rule.
+			t.rules[i].zone = own.zone
+			continue
+		}
+		t.rules = append(t.rules, zoneRule{})
+		copy(t.rules[i+1:], t.rules[i:])
+		t.rules[i] = own
+	}
+	t.own = nil
+	for _, child := range t.children {
+		child.inherit(t.rules)
+	}
+}
+
+// lookup returns the rules whose zones match name, in order. name is
+// expected to be in lower case.
+func (t *zoneTree) lookup(name string) []zoneRule {
+	curr := t
+	end := len(name)
+	if end > 0 && name[end-1] == '.' {
+		end--
+	}
+	for end > 0 {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		next, ok := curr.children[name[start:end]]
+		if !ok {
+			break
+		}
+		curr = next
+		end = start - 1
+	}
+	return curr.rules
+}
+
+// compile indexes the policies of the rule by query type, so that only the
+// policies which may match the qtype of a query are evaluated.
+func (r *Rule) compile() {
+	r.qtypePolicies = make(map[uint16][]*Policy)
+	for i := range r.Policies {
+		p := &r.Policies[i]
+		if p.file == nil && p.qtype != QtypeAll {
+			r.qtypePolicies[p.qtype] = nil
+		}
+	}
+	for i := range r.Policies {
+		p := &r.Policies[i]
+		// policy files may be reloaded with other qtypes.
+		if p.file != nil || p.qtype == QtypeAll {
+			for qtype := range r.qtypePolicies {
+				r.qtypePolicies[qtype] = append(r.qtypePolicies[qtype], p)
+			}
+			r.otherPolicies = append(r.otherPolicies, p)
+			continue
+		}
+		r.qtypePolicies[p.qtype] = append(r.qtypePolicies[p.qtype], p)
+	}
+}
+
+// policiesFor returns the policies of the rule which may match queries of
+// qtype, in order.
+func (r *Rule) policiesFor(qtype uint16) []*Policy {
+	if policies, ok := r.qtypePolicies[qtype]; ok {
+		return policies
+	}
+	return r.otherPolicies
+}
+
+// addrOf returns the IP address of addr, without allocations for UDP and TCP
+// addresses. It reports false if addr holds no IP address.
+func addrOf(addr net.Addr) (filter.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return filter.AddrFromIP(a.IP)
+	case *net.TCPAddr:
+		return filter.AddrFromIP(a.IP)
+	case nil:
+		return filter.Addr{}, false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return filter.AddrFromIP(net.ParseIP(host))
+}
+
+// setClient sets the address of the client which the query originates from,
+// and the EDNS0 Client Subnet address carried by the query if it is from
+// trusted proxies. Only queries from trusted proxies involve parsing.
+func (q *query) setClient(rule Rule) error {
+	peer, ok := addrOf(q.state.W.RemoteAddr())
+	if !ok {
+		return fmt.Errorf("Illegal source ip '%s'", q.state.IP())
+	}
+	q.ip = peer
+	if rule.trustedProxies == nil || !rule.trustedProxies.ContainsAddr(peer) {
+		return nil
+	}
+	ip, ecs, err := clientIP(rule, q.state)
+	if err != nil {
+		return err
+	}
+	q.ip, _ = filter.AddrFromIP(ip)
+	if ecs != nil {
+		q.ecs, q.hasECS = filter.AddrFromIP(ecs)
+	}
+	return nil
+}
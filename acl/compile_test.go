@@ -0,0 +1,186 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+func Test_zoneTree_lookup(t *testing.T) {
+	rules := []Rule{
+		{Zones: []string{"example.org."}},
+		{Zones: []string{"."}},
+		{Zones: []string{"sub.example.org.", "example.com."}},
+		{Zones: []string{"example.org.", "a.sub.example.org."}},
+	}
+	tree := newZoneTree(rules)
+
+	tests := []struct {
+		name string
+		want []zoneRule
+	}{
+		{"example.org.", []zoneRule{{0, "example.org."}, {1, "."}, {3, "example.org."}}},
+		{"www.example.org.", []zoneRule{{0, "example.org."}, {1, "."}, {3, "example.org."}}},
+		{"www.sub.example.org.", []zoneRule{{0, "example.org."}, {1, "."}, {2, "sub.example.org."}, {3, "example.org."}}},
+		{"www.a.sub.example.org.", []zoneRule{{0, "example.org."}, {1, "."}, {2, "sub.example.org."}, {3, "a.sub.example.org."}}},
+		{"example.com.", []zoneRule{{1, "."}, {2, "example.com."}}},
+		{"org.", []zoneRule{{1, "."}}},
+		{".", []zoneRule{{1, "."}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tree.lookup(tt.name); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("zoneTree.lookup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := newZoneTree(rules[:1]).lookup("example.com."); len(got) != 0 {
+		t.Errorf("zoneTree.lookup() = %v, want none", got)
+	}
+}
+
+func TestRule_policiesFor(t *testing.T) {
+	a, err := parseACL(caddy.NewTestController("dns", `acl {
+		lint off
+		block type A net 10.0.0.0/8
+		allow type ANY net 192.168.0.0/16
+		block type MX net ANY
+		block type A net ANY
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	rule := a.Rules[0]
+	texts := func(policies []*Policy) []string {
+		var texts []string
+		for _, p := range policies {
+			texts = append(texts, p.text)
+		}
+		return texts
+	}
+
+	tests := []struct {
+		qtype uint16
+		want  []string
+	}{
+		{dns.TypeA, []string{"block type A net 10.0.0.0/8", "allow type ANY net 192.168.0.0/16", "block type A net ANY"}},
+		{dns.TypeMX, []string{"allow type ANY net 192.168.0.0/16", "block type MX net ANY"}},
+		{dns.TypeTXT, []string{"allow type ANY net 192.168.0.0/16"}},
+	}
+	for _, tt := range tests {
+		t.Run(dns.TypeToString[tt.qtype], func(t *testing.T) {
+			if got := texts(rule.policiesFor(tt.qtype)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Rule.policiesFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_addrOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		addr   net.Addr
+		want   string
+		wantOK bool
+	}{
+		{"UDP", &net.UDPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 53}, "10.0.0.1", true},
+		{"TCP", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, "2001:db8::1", true},
+		{"Other", &net.IPAddr{IP: net.ParseIP("10.0.0.1")}, "10.0.0.1", true},
+		{"Nil", nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := addrOf(tt.addr)
+			if ok != tt.wantOK {
+				t.Fatalf("addrOf() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && got.String() != tt.want {
+				t.Errorf("addrOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// benchACL creates an acl of many zones and policies, in which queries
+// towards www.example.org. go through all policies of the last rule.
+func benchACL(tb testing.TB) acl {
+	var config strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&config, "acl zone%d.example.org example.com%d {\n lint off\n", i, i)
+		for j := 0; j < 20; j++ {
+			fmt.Fprintf(&config, " block type AAAA net 10.%d.%d.0/24\n", i, j)
+		}
+		config.WriteString("}\n")
+	}
+	config.WriteString("acl example.org {\n lint off\n")
+	for j := 0; j < 100; j++ {
+		fmt.Fprintf(&config, " block type A net 10.%d.0.0/16 proto tcp\n", j)
+		fmt.Fprintf(&config, " block type MX net 10.%d.0.0/16\n", j)
+	}
+	config.WriteString(" allow type ANY net 192.168.0.0/16\n}\n")
+
+	a, err := parseACL(caddy.NewTestController("dns", config.String()))
+	if err != nil {
+		tb.Fatalf("cannot parse acl from config: %v", err)
+	}
+	return a
+}
+
+// benchDecide evaluates the query against the rules in the same way as
+// ServeDNS, without writing a response.
+func benchDecide(a acl, w dns.ResponseWriter, r *dns.Msg) string {
+	for _, zr := range a.zones.lookup(r.Question[0].Name) {
+		action, err := shouldBlock(a.Rules[zr.rule], a.transport, w, r)
+		if err != nil || action != ALLOW {
+			return action
+		}
+	}
+	return ALLOW
+}
+
+func Test_acl_evaluate_allocs(t *testing.T) {
+	a := benchACL(t)
+	// servers keep their local addresses rather than creating them per query.
+	w := &testResponseWriter{localAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}}
+	w.setRemoteIP("192.168.0.1")
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.org.", dns.TypeA)
+
+	if action := benchDecide(a, w, r); action != ALLOW {
+		t.Fatalf("benchDecide() = %v, want %v", action, ALLOW)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { benchDecide(a, w, r) }); allocs != 0 {
+		t.Errorf("benchDecide() allocates %v times per query, want 0", allocs)
+	}
+}
+
+func Benchmark_acl_evaluate(b *testing.B) {
+	a := benchACL(b)
+	// servers keep their local addresses rather than creating them per query.
+	w := &testResponseWriter{localAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}}
+	w.setRemoteIP("192.168.0.1")
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.org.", dns.TypeA)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchDecide(a, w, r)
+	}
+}
+
+func Benchmark_zoneTree_lookup(b *testing.B) {
+	a := benchACL(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.zones.lookup("www.zone42.example.org.")
+	}
+}
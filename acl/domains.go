@@ -0,0 +1,324 @@
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+// domainTrie is a suffix trie of domain names, keyed by labels from the
+// root. A name in the trie matches itself and all of its subdomains.
+type domainTrie struct {
+	root domainNode
+}
+
+type domainNode struct {
+	// children is only allocated for nodes with subdomains, which keeps
+	// the leaves, i.e., most of the nodes, small.
+	children map[string]*domainNode
+	terminal bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{}
+}
+
+// Insert adds a domain name in lower case to the trie.
+func (t *domainTrie) Insert(name string) {
+	curr := &t.root
+	end := len(name)
+	if end > 0 && name[end-1] == '.' {
+		end--
+	}
+	for end > 0 {
+		if curr.terminal {
+			// covered by a shorter suffix.
+			return
+		}
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		label := name[start:end]
+		next, ok := curr.children[label]
+		if !ok {
+			if curr.children == nil {
+				curr.children = make(map[string]*domainNode)
+			}
+			next = &domainNode{}
+			curr.children[label] = next
+		}
+		curr = next
+		end = start - 1
+	}
+	curr.terminal = true
+	// subdomains are covered by this name now.
+	curr.children = nil
+}
+
+// Contains reports whether name in lower case or any of its parent domains
+// is in the trie.
+func (t *domainTrie) Contains(name string) bool {
+	curr := &t.root
+	if curr.terminal {
+		// the root is the parent of all names.
+		return true
+	}
+	end := len(name)
+	if end > 0 && name[end-1] == '.' {
+		end--
+	}
+	for end > 0 {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		next, ok := curr.children[name[start:end]]
+		if !ok {
+			return false
+		}
+		if next.terminal {
+			return true
+		}
+		curr = next
+		end = start - 1
+	}
+	return false
+}
+
+// domainNames is a set of domain names, which match themselves and their
+// subdomains, and of wildcards, i.e., names given as '*.NAME', which only
+// match the subdomains.
+type domainNames struct {
+	names     *domainTrie
+	wildcards *domainTrie
+}
+
+func newDomainNames() *domainNames {
+	return &domainNames{names: newDomainTrie(), wildcards: newDomainTrie()}
+}
+
+// Insert adds a domain name or a wildcard in lower case to the set.
+func (dn *domainNames) Insert(name string) {
+	if strings.HasPrefix(name, "*.") {
+		dn.wildcards.Insert(name[2:])
+		return
+	}
+	dn.names.Insert(name)
+}
+
+// Contains reports whether name in lower case is in the set.
+func (dn *domainNames) Contains(name string) bool {
+	if dn.names.Contains(name) {
+		return true
+	}
+	// wildcards match the parent domains of the name.
+	if name == "." || name == "" {
+		return false
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		if i+1 == len(name) {
+			// the parent of a top-level domain is the root.
+			return dn.wildcards.Contains(".")
+		}
+		return dn.wildcards.Contains(name[i+1:])
+	}
+	return false
+}
+
+// domainSet is a set of domain names listed inline or loaded from local
+// files, with names excluded from the set. It is reloaded once the files
+// change.
+type domainSet struct {
+	// names are listed inline rather than in files.
+	names       []string
+	files       []string
+	exceptFiles []string
+
+	mu      sync.RWMutex
+	include *domainNames
+	exclude *domainNames
+}
+
+func newDomainSet(files, exceptFiles []string) (*domainSet, error) {
+	ds := &domainSet{files: files, exceptFiles: exceptFiles}
+	if err := ds.load(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// load (re)loads the set from its files.
+func (ds *domainSet) load() error {
+	include, exclude := newDomainNames(), newDomainNames()
+	for _, name := range ds.names {
+		include.Insert(dns.Fqdn(strings.ToLower(name)))
+	}
+	for _, file := range ds.files {
+		if err := loadDomainsFromLocalFile(file, include, exclude); err != nil {
+			return err
+		}
+	}
+	for _, file := range ds.exceptFiles {
+		// all names in exception files are excluded.
+		if err := loadDomainsFromLocalFile(file, exclude, exclude); err != nil {
+			return err
+		}
+	}
+	ds.mu.Lock()
+	ds.include, ds.exclude = include, exclude
+	ds.mu.Unlock()
+	return nil
+}
+
+// Contains reports whether name is in the set.
+func (ds *domainSet) Contains(name string) bool {
+	name = strings.ToLower(name)
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.include.Contains(name) && !ds.exclude.Contains(name)
+}
+
+// loadDomainsFromLocalFile loads domain names from a local file into include,
+// and names of adblock-style exceptions into exclude. Three formats are
+// supported and can be mixed in one file:
+//   - hosts-file style, e.g., '0.0.0.0 ads.example.com'.
+//   - one domain per line, e.g., 'ads.example.com'.
+//   - adblock style, e.g., '||ads.example.com^', and '@@||example.com^' for
+//     exceptions.
+//
+// Lines with illegal domain names are skipped.
+func loadDomainsFromLocalFile(fileName string, include, exclude *domainNames) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	skipped, unsupported := 0, 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// adblock cosmetic rules, e.g., 'example.com##.ad', hide elements of
+		// pages rather than block domains, and must not be mistaken for
+		// domains followed by comments.
+		if isCosmeticRule(line) {
+			unsupported++
+			continue
+		}
+		line = stripComment(line)
+		// skip empty line and adblock comments.
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		names, isException, ok := parseDomainLine(line)
+		if !ok {
+			unsupported++
+			continue
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// wildcards only match the subdomains of their names.
+			wildcard := strings.HasPrefix(name, "*.")
+			name = strings.TrimPrefix(name, "*.")
+			if !isHostname(name) {
+				skipped++
+				continue
+			}
+			if isHostsReserved(name) {
+				continue
+			}
+			name = dns.Fqdn(name)
+			if wildcard {
+				name = "*." + name
+			}
+			if isException {
+				exclude.Insert(name)
+			} else {
+				include.Insert(name)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	if skipped > 0 {
+		log.Warningf("Skip %d illegal domain names in %s", skipped, fileName)
+	}
+	if unsupported > 0 {
+		log.Warningf("Skip %d adblock rules which block more than domains in %s", unsupported, fileName)
+	}
+	return nil
+}
+
+// isCosmeticRule reports whether line is an adblock element hiding rule,
+// e.g., 'example.com##.ad', or one of its exceptions and extensions.
+func isCosmeticRule(line string) bool {
+	for _, sep := range []string{"##", "#@#", "#?#", "#$#"} {
+		if strings.Contains(line, sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDomainLine returns the domain names in a line, and whether they are
+// adblock-style exceptions. It returns false for adblock rules which block
+// anything other than whole domains, e.g., rules with paths or modifiers,
+// since blocking their domains would block far more than the rule does.
+func parseDomainLine(line string) ([]string, bool, bool) {
+	isException := strings.HasPrefix(line, "@@")
+	line = strings.TrimPrefix(line, "@@")
+	if strings.HasPrefix(line, "||") {
+		line = line[2:]
+		if idx := strings.IndexAny(line, "^$/|*"); idx >= 0 {
+			if rest := line[idx:]; rest != "^" && rest != "^|" {
+				return nil, false, false
+			}
+			line = line[:idx]
+		}
+		return []string{line}, isException, true
+	}
+	if isException || strings.ContainsAny(line, "/^$|") {
+		// other adblock rules, e.g., '/banner/*' or '|https://'.
+		return nil, false, false
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		// hosts-file style.
+		return fields[1:], false, true
+	}
+	return fields, false, true
+}
+
+// isHostname reports whether name consists of hostname labels, which rules
+// out adblock patterns such as '-banner-' or 'ad_frame='.
+func isHostname(name string) bool {
+	if _, ok := dns.IsDomainName(name); !ok || name == "" || name == "." {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			if !(ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isHostsReserved reports whether name is one of the local names which
+// usually appear in hosts files.
+func isHostsReserved(name string) bool {
+	switch strings.TrimSuffix(name, ".") {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost",
+		"ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix",
+		"ip6-allnodes", "ip6-allrouters", "ip6-allhosts", "0.0.0.0":
+		return true
+	}
+	return false
+}
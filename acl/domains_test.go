@@ -0,0 +1,208 @@
+package acl
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+var domainsTestFiles = map[string]string{
+	"acl-test-domains.txt": `# hosts-file style
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com
+::1 ip6-localhost
+# one domain per line
+Malware.Example.NET.
+*.wildcard.example.org
+# adblock style
+! adblock comment
+[Adblock Plus 2.0]
+||adblock.example.com^
+||options.example.com^$third-party
+@@||good.adblock.example.com^
+||paths.example.com/ads/
+@@||good.paths.example.com^$document
+example.com##.ad
+cosmetic.example.com#@#.ad
+cosmetic.example.com#?#div:-abp-has(.ad)
+/banner/*
+-ad-banner-
+ad_frame=
+bad..name
+`,
+	"acl-test-domains-except.txt": `safe.malware.example.net
+`,
+}
+
+func Test_domainTrie(t *testing.T) {
+	trie := newDomainTrie()
+	trie.Insert("www.example.com.")
+	trie.Insert("example.net.")
+	trie.Insert("sub.example.net.")
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"www.example.com.", true},
+		{"a.www.example.com.", true},
+		{"example.com.", false},
+		{"ww.example.com.", false},
+		{"example.net.", true},
+		{"deep.sub.example.net.", true},
+		{"example.org.", false},
+		{"net.", false},
+		{".", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trie.Contains(tt.name); got != tt.want {
+				t.Errorf("domainTrie.Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_domainTrie_root(t *testing.T) {
+	trie := newDomainTrie()
+	trie.Insert(".")
+	trie.Insert("example.com.")
+	for _, name := range []string{".", "com.", "www.example.com."} {
+		if !trie.Contains(name) {
+			t.Errorf("domainTrie.Contains(%q) = false, want true", name)
+		}
+	}
+
+	wildcards := newDomainNames()
+	wildcards.Insert("*.")
+	if wildcards.Contains(".") {
+		t.Errorf("domainNames.Contains(\".\") = true, want false")
+	}
+	for _, name := range []string{"com.", "example.com."} {
+		if !wildcards.Contains(name) {
+			t.Errorf("domainNames.Contains(%q) = false, want true", name)
+		}
+	}
+}
+
+func Test_loadDomainsFromLocalFile(t *testing.T) {
+	envSetup(domainsTestFiles)
+	defer envCleanup(domainsTestFiles)
+
+	include, exclude := newDomainNames(), newDomainNames()
+	if err := loadDomainsFromLocalFile("acl-test-domains.txt", include, exclude); err != nil {
+		t.Fatalf("loadDomainsFromLocalFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		wantInclude bool
+		wantExclude bool
+	}{
+		{"ads.example.com.", true, false},
+		{"tracker.example.com.", true, false},
+		{"localhost.", false, false},
+		{"ip6-localhost.", false, false},
+		{"malware.example.net.", true, false},
+		{"wildcard.example.org.", false, false},
+		{"www.wildcard.example.org.", true, false},
+		{"adblock.example.com.", true, false},
+		{"options.example.com.", false, false},
+		{"paths.example.com.", false, false},
+		{"good.paths.example.com.", false, false},
+		{"cosmetic.example.com.", false, false},
+		{"good.adblock.example.com.", true, true},
+		{"example.com.", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := include.Contains(tt.name); got != tt.wantInclude {
+				t.Errorf("include.Contains() = %v, want %v", got, tt.wantInclude)
+			}
+			if got := exclude.Contains(tt.name); got != tt.wantExclude {
+				t.Errorf("exclude.Contains() = %v, want %v", got, tt.wantExclude)
+			}
+		})
+	}
+
+	if err := loadDomainsFromLocalFile("not-exist.txt", include, exclude); err == nil {
+		t.Errorf("loadDomainsFromLocalFile() returns no error for missing file")
+	}
+}
+
+func Test_acl_ServeDNS_domains(t *testing.T) {
+	envSetup(domainsTestFiles)
+	defer envCleanup(domainsTestFiles)
+
+	a, err := parseACL(caddy.NewTestController("dns", `
+	acl . {
+		allow type ANY net 10.0.0.0/8 domains acl-test-domains.txt
+		block type ANY domains acl-test-domains.txt except domains acl-test-domains-except.txt
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	tests := []struct {
+		name      string
+		qname     string
+		sourceIP  string
+		wantRcode int
+	}{
+		{"Blocked domain", "ads.example.com.", "192.168.0.1", dns.RcodeRefused},
+		{"Blocked subdomain", "x.ADS.example.com.", "192.168.0.1", dns.RcodeRefused},
+		{"Blocked adblock", "adblock.example.com.", "192.168.0.1", dns.RcodeRefused},
+		{"Adblock exception", "good.adblock.example.com.", "192.168.0.1", dns.RcodeSuccess},
+		{"Except domains", "www.safe.malware.example.net.", "192.168.0.1", dns.RcodeSuccess},
+		{"Not listed", "example.com.", "192.168.0.1", dns.RcodeSuccess},
+		{"Wildcard subdomain", "www.wildcard.example.org.", "192.168.0.1", dns.RcodeRefused},
+		{"Wildcard apex", "wildcard.example.org.", "192.168.0.1", dns.RcodeSuccess},
+		{"Allowed network", "ads.example.com.", "10.0.0.1", dns.RcodeSuccess},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testResponseWriter{}
+			w.setRemoteIP(tt.sourceIP)
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, dns.TypeA)
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_domainSet_reload(t *testing.T) {
+	envSetup(domainsTestFiles)
+	defer envCleanup(domainsTestFiles)
+
+	ds, err := newDomainSet([]string{"acl-test-domains.txt"}, nil)
+	if err != nil {
+		t.Fatalf("cannot load domains: %v", err)
+	}
+	rl := newReloader()
+	rl.Watch("acl-test-domains.txt", ds.load)
+	if ds.Contains("new.example.com.") {
+		t.Fatalf("domainSet.Contains() = true before reload, want false")
+	}
+
+	content := domainsTestFiles["acl-test-domains.txt"] + "new.example.com\n"
+	if err := ioutil.WriteFile("acl-test-domains.txt", []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rl.check()
+	if !ds.Contains("new.example.com.") {
+		t.Errorf("domainSet.Contains() = false after reload, want true")
+	}
+}
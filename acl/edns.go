@@ -0,0 +1,229 @@
+package acl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+// header flags of queries, along with the DO bit of their OPT records, which
+// 'flags' clauses match.
+const (
+	flagRD uint8 = 1 << iota
+	flagCD
+	flagAD
+	flagDO
+)
+
+var flagNames = map[string]uint8{
+	"rd": flagRD,
+	"cd": flagCD,
+	"ad": flagAD,
+	"do": flagDO,
+}
+
+// ednsOptionCodes maps the names of EDNS options to their codes.
+var ednsOptionCodes = map[string]uint16{
+	"llq":       dns.EDNS0LLQ,
+	"ul":        dns.EDNS0UL,
+	"nsid":      dns.EDNS0NSID,
+	"dau":       dns.EDNS0DAU,
+	"dhu":       dns.EDNS0DHU,
+	"n3u":       dns.EDNS0N3U,
+	"ecs":       dns.EDNS0SUBNET,
+	"expire":    dns.EDNS0EXPIRE,
+	"cookie":    dns.EDNS0COOKIE,
+	"keepalive": dns.EDNS0TCPKEEPALIVE,
+	"padding":   dns.EDNS0PADDING,
+	"chain":     13,
+	"keytag":    14,
+	"ede":       15,
+}
+
+// queryFlags returns the header flags of r, along with its DO bit.
+func queryFlags(r *dns.Msg, opt *dns.OPT) uint8 {
+	var flags uint8
+	if r.RecursionDesired {
+		flags |= flagRD
+	}
+	if r.CheckingDisabled {
+		flags |= flagCD
+	}
+	if r.AuthenticatedData {
+		flags |= flagAD
+	}
+	if opt != nil && opt.Do() {
+		flags |= flagDO
+	}
+	return flags
+}
+
+// flagsMatcher matches queries by their header flags, which are all either
+// set or unset.
+type flagsMatcher struct {
+	set   uint8
+	unset uint8
+}
+
+// parseFlags parses the flags of a 'flags' clause, i.e., RD, CD, AD or DO,
+// each of which is negated by a leading '!'.
+func parseFlags(c *caddy.Controller, values []string) (*flagsMatcher, error) {
+	f := &flagsMatcher{}
+	for _, v := range values {
+		name := strings.ToLower(v)
+		negate := strings.HasPrefix(name, "!")
+		flag, ok := flagNames[strings.TrimPrefix(name, "!")]
+		if !ok {
+			return nil, c.Errf("Unexpected token '%s'; expect 'rd', 'cd', 'ad' or 'do', optionally negated by '!'", v)
+		}
+		if (f.set|f.unset)&flag != 0 {
+			return nil, c.Errf("Flag '%s' is specified more than once", strings.TrimPrefix(name, "!"))
+		}
+		if negate {
+			f.unset |= flag
+		} else {
+			f.set |= flag
+		}
+	}
+	return f, nil
+}
+
+func (f *flagsMatcher) matches(q *query) bool {
+	return q.flags&f.set == f.set && q.flags&f.unset == 0
+}
+
+// uint16Range is a range of uint16 values, both included.
+type uint16Range struct {
+	min, max uint16
+}
+
+func (r uint16Range) contains(v uint16) bool {
+	return v >= r.min && v <= r.max
+}
+
+// ednsMatcher matches queries by their OPT records. Queries without OPT
+// records are only matched by 'off'.
+type ednsMatcher struct {
+	// off matches queries without OPT records, and on matches those with.
+	off bool
+	on  bool
+	// versions and sizes restrict the EDNS versions and advertised UDP
+	// payload sizes. Nil means any.
+	versions *uint16Range
+	sizes    *uint16Range
+	// options matches queries carrying any of the EDNS options. Empty means
+	// any.
+	options []uint16
+}
+
+// parseEDNS parses the settings of an 'edns' clause.
+func parseEDNS(c *caddy.Controller, values []string) (*ednsMatcher, error) {
+	/*
+	 * edns off | [on] [version N|MIN-MAX] [size N|MIN-MAX] [option CODE[,CODE...]]
+	 */
+	e := &ednsMatcher{}
+	for i := 0; i < len(values); i++ {
+		setting := strings.ToLower(values[i])
+		switch setting {
+		case "off":
+			e.off = true
+			continue
+		case "on":
+			e.on = true
+			continue
+		case "version", "size", "option":
+		default:
+			return nil, c.Errf("Unexpected token '%s'; expect 'off', 'on', 'version', 'size' or 'option'", values[i])
+		}
+		if i+1 == len(values) {
+			return nil, c.ArgErr()
+		}
+		i++
+		raw := values[i]
+		switch setting {
+		case "version":
+			r, err := parseUint16Range(raw, 255)
+			if err != nil {
+				return nil, c.Errf("Illegal EDNS version '%s'", raw)
+			}
+			e.versions = &r
+		case "size":
+			r, err := parseUint16Range(raw, 65535)
+			if err != nil {
+				return nil, c.Errf("Illegal UDP payload size '%s'", raw)
+			}
+			e.sizes = &r
+		case "option":
+			for _, v := range strings.Split(raw, ",") {
+				code, err := parseEDNSOption(v)
+				if err != nil {
+					return nil, c.Errf("%v", err)
+				}
+				e.options = append(e.options, code)
+			}
+		}
+	}
+	if e.off && (e.on || e.versions != nil || e.sizes != nil || len(e.options) > 0) {
+		return nil, c.Errf("'edns off' can not be combined with other settings")
+	}
+	if !e.off && !e.on && e.versions == nil && e.sizes == nil && len(e.options) == 0 {
+		return nil, c.ArgErr()
+	}
+	return e, nil
+}
+
+// parseUint16Range parses a value N or a range MIN-MAX, up to max.
+func parseUint16Range(raw string, max uint64) (uint16Range, error) {
+	lo, hi := raw, raw
+	if idx := strings.Index(raw, "-"); idx >= 0 {
+		lo, hi = raw[:idx], raw[idx+1:]
+	}
+	min, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil || min > max {
+		return uint16Range{}, strconv.ErrSyntax
+	}
+	end, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil || end > max || end < min {
+		return uint16Range{}, strconv.ErrSyntax
+	}
+	return uint16Range{uint16(min), uint16(end)}, nil
+}
+
+// parseEDNSOption parses the name or the code of an EDNS option.
+func parseEDNSOption(raw string) (uint16, error) {
+	if code, ok := ednsOptionCodes[strings.ToLower(raw)]; ok {
+		return code, nil
+	}
+	code, err := strconv.ParseUint(raw, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Illegal EDNS option '%s'", raw)
+	}
+	return uint16(code), nil
+}
+
+func (e *ednsMatcher) matches(q *query) bool {
+	if e.off {
+		return q.opt == nil
+	}
+	if q.opt == nil {
+		return false
+	}
+	if e.versions != nil && !e.versions.contains(uint16(q.opt.Version())) {
+		return false
+	}
+	if e.sizes != nil && !e.sizes.contains(q.opt.UDPSize()) {
+		return false
+	}
+	if len(e.options) == 0 {
+		return true
+	}
+	for _, o := range q.opt.Option {
+		if containsUint16(e.options, o.Option()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package acl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func Test_acl_ServeDNS_flags(t *testing.T) {
+	a, err := parseACL(caddy.NewTestController("dns", `acl example.org {
+		allow type ANY net 10.0.0.0/8
+		block type ANY flags !rd
+		block type ANY flags cd ad
+		block type MX flags do
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	tests := []struct {
+		name      string
+		source    string
+		qtype     uint16
+		rd        bool
+		cd        bool
+		ad        bool
+		do        bool
+		wantRcode int
+	}{
+		{"Recursive", "192.0.2.1", dns.TypeA, true, false, false, false, dns.RcodeSuccess},
+		{"Non-recursive", "192.0.2.1", dns.TypeA, false, false, false, false, dns.RcodeRefused},
+		{"Non-recursive from inside", "10.0.0.1", dns.TypeA, false, false, false, false, dns.RcodeSuccess},
+		{"CD only", "192.0.2.1", dns.TypeA, true, true, false, false, dns.RcodeSuccess},
+		{"CD and AD", "192.0.2.1", dns.TypeA, true, true, true, false, dns.RcodeRefused},
+		{"DO", "192.0.2.1", dns.TypeMX, true, false, false, true, dns.RcodeRefused},
+		{"DO of other type", "192.0.2.1", dns.TypeA, true, false, false, true, dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testResponseWriter{}
+			w.setRemoteIP(tt.source)
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.org.", tt.qtype)
+			m.RecursionDesired = tt.rd
+			m.CheckingDisabled = tt.cd
+			m.AuthenticatedData = tt.ad
+			if tt.do {
+				m.SetEdns0(1232, true)
+			}
+			if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_edns(t *testing.T) {
+	a, err := parseACL(caddy.NewTestController("dns", `acl example.org {
+		block type ANY edns size 4097-65535
+		block type ANY edns version 1-255
+		block type ANY edns option nsid,65001
+		block type TXT edns off
+		truncate type MX edns on
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		edns      bool
+		size      uint16
+		version   uint8
+		options   []dns.EDNS0
+		wantRcode int
+	}{
+		{"No OPT", dns.TypeA, false, 0, 0, nil, dns.RcodeSuccess},
+		{"Common size", dns.TypeA, true, 1232, 0, nil, dns.RcodeSuccess},
+		{"Oversized buffer", dns.TypeA, true, 8192, 0, nil, dns.RcodeRefused},
+		{"Largest size", dns.TypeA, true, 4096, 0, nil, dns.RcodeSuccess},
+		{"Unknown version", dns.TypeA, true, 1232, 1, nil, dns.RcodeRefused},
+		{"Option by name", dns.TypeA, true, 1232, 0, []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}}, dns.RcodeRefused},
+		{"Option by code", dns.TypeA, true, 1232, 0, []dns.EDNS0{&dns.EDNS0_LOCAL{Code: 65001}}, dns.RcodeRefused},
+		{"Other option", dns.TypeA, true, 1232, 0, []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"}}, dns.RcodeSuccess},
+		{"No OPT of TXT", dns.TypeTXT, false, 0, 0, nil, dns.RcodeRefused},
+		{"OPT of TXT", dns.TypeTXT, true, 1232, 0, nil, dns.RcodeSuccess},
+		{"OPT of MX", dns.TypeMX, true, 1232, 0, nil, dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testResponseWriter{}
+			w.setRemoteIP("192.0.2.1")
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.org.", tt.qtype)
+			if tt.edns {
+				m.SetEdns0(tt.size, false)
+				opt := m.IsEdns0()
+				opt.SetVersion(tt.version)
+				opt.Option = tt.options
+			}
+			if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_setup_flags_edns(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"Flags", "block type ANY flags !RD cd AD !do", false},
+		{"EDNS settings", "block type ANY edns on version 0 size 512-4096 option ecs,COOKIE,15 net 10.0.0.0/8", false},
+		{"EDNS off", "block type ANY edns off", false},
+		{"No flag", "block type ANY flags", true},
+		{"Illegal flag", "block type ANY flags qr", true},
+		{"Flag set and unset", "block type ANY flags rd !rd", true},
+		{"No EDNS setting", "block type ANY edns", true},
+		{"Unknown EDNS setting", "block type ANY edns buffer 512", true},
+		{"Missing EDNS value", "block type ANY edns size", true},
+		{"EDNS off with settings", "block type ANY edns off size 512", true},
+		{"Illegal version", "block type ANY edns version 256", true},
+		{"Illegal size range", "block type ANY edns size 4096-512", true},
+		{"Illegal size", "block type ANY edns size 65536", true},
+		{"Illegal option", "block type ANY edns option nsid,foo", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseACL(caddy.NewTestController("dns", "acl {\n"+tt.config+"\n}"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseACL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package acl
+
+import (
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/ihac/acl/acl/filter"
+	"github.com/miekg/dns"
+)
+
+// exception exempts queries from a policy, by the client or the query name.
+// A query is exempted if it matches any of them.
+type exception struct {
+	src    *source
+	filter filter.Filter
+	// names match themselves and their subdomains, while wildcards, i.e.,
+	// names given as '*.NAME', only match the subdomains.
+	names *domainNames
+}
+
+// parseException parses the 'net', 'file' and 'name' clauses following an
+// 'except' clause, and returns the remaining clauses. Local files which the
+// networks are loaded from are watched by rl.
+func parseException(c *caddy.Controller, args []string, rl *reloader, sets netSets) (*exception, []string, error) {
+	e := &exception{names: newDomainNames()}
+	src := source{}
+	hasNames := false
+	for len(args) > 0 {
+		clause := strings.ToLower(args[0])
+		if clause != "net" && clause != "file" && clause != "name" {
+			break
+		}
+		var values []string
+		values, args = clauseValues(args[1:])
+		if clause != "name" {
+			if err := src.add(c, clause, values, sets); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if len(values) == 0 {
+			return nil, nil, c.ArgErr()
+		}
+		for _, v := range values {
+			name := strings.ToLower(dns.Fqdn(v))
+			if _, ok := dns.IsDomainName(strings.TrimPrefix(name, "*.")); !ok {
+				return nil, nil, c.Errf("Illegal name '%s'", v)
+			}
+			e.names.Insert(name)
+		}
+		hasNames = true
+	}
+	if src.empty() && !hasNames {
+		return nil, nil, c.Errf("Unexpected tokens '%s'; expect 'except net SOURCE...' or 'except name NAME...'", strings.Join(args, " "))
+	}
+	if !src.empty() {
+		var err error
+		e.src = &src
+		if e.filter, err = src.filter(c, rl); err != nil {
+			return nil, nil, err
+		}
+	}
+	return e, args, nil
+}
+
+// matches reports whether the query is exempted.
+func (e *exception) matches(q *query) bool {
+	if e.filter != nil && e.filter.ContainsAddr(q.ip) {
+		return true
+	}
+	return e.names.Contains(strings.ToLower(q.qname))
+}
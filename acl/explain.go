@@ -0,0 +1,185 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// explainZone is the zone of explain queries, which are CHAOS TXT queries
+// in the form of:
+//
+//	[client-IP.][type-QTYPE.][proto-PROTO.]QNAME.explain.acl.
+//
+// They are answered with the rules evaluated for a query towards QNAME, and
+// the policy deciding it. IP defaults to the address of the requesting
+// client, with dots or colons replaced by dashes, e.g., 'client-10-1-2-3' or
+// 'client-2001-db8--1'. QTYPE defaults to A, and PROTO (udp or tcp) to the
+// protocol of the explain query.
+const explainZone = "explain.acl."
+
+// explainQuery is a query to be explained.
+type explainQuery struct {
+	name   string
+	qtype  uint16
+	client net.IP
+	proto  string
+}
+
+// isExplain reports whether r is an explain query.
+func isExplain(r *dns.Msg) bool {
+	if len(r.Question) != 1 {
+		return false
+	}
+	q := r.Question[0]
+	return q.Qclass == dns.ClassCHAOS && q.Qtype == dns.TypeTXT && dns.IsSubDomain(explainZone, strings.ToLower(q.Name))
+}
+
+// serveExplain answers an explain query. Explain queries from sources other
+// than admins are refused.
+func (a acl) serveExplain(w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	state := request.Request{W: w, Req: r}
+	m := new(dns.Msg)
+	if !a.explainAdmins.Contains(net.ParseIP(state.IP())) {
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	}
+
+	eq, err := parseExplainName(state.Name())
+	if err != nil {
+		m.SetRcode(r, dns.RcodeFormatError)
+		m.Answer = []dns.RR{explainTXT(state.QName(), "error: "+err.Error())}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	}
+	if eq.client == nil {
+		eq.client = net.ParseIP(state.IP())
+	}
+	if eq.proto == "" {
+		eq.proto = state.Proto()
+	}
+
+	// the explained query is evaluated as if it was received from the
+	// client on the same local address.
+	ew := &checkWriter{}
+	var local net.IP
+	if w.LocalAddr() != nil {
+		local = net.ParseIP(state.LocalIP())
+	}
+	if eq.proto == "tcp" {
+		ew.remote, ew.local = &net.TCPAddr{IP: eq.client}, &net.TCPAddr{IP: local}
+	} else {
+		ew.remote, ew.local = &net.UDPAddr{IP: eq.client}, &net.UDPAddr{IP: local}
+	}
+	er := new(dns.Msg)
+	er.SetQuestion(eq.name, eq.qtype)
+	if opt := r.IsEdns0(); opt != nil && eq.client.Equal(net.ParseIP(state.IP())) {
+		// keep the ECS option of the requesting client.
+		er.Extra = append(er.Extra, opt)
+	}
+
+	traces, err := a.trace(ew, er)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	m.SetReply(r)
+	m.Authoritative = true
+	for _, line := range explainLines(eq, traces) {
+		m.Answer = append(m.Answer, explainTXT(state.QName(), line))
+	}
+	// long traces are truncated to the UDP size of the client, with TC set,
+	// so that it retries over TCP for the whole trace.
+	state.SizeAndDo(m)
+	w.WriteMsg(state.Scrub(m))
+	return dns.RcodeSuccess, nil
+}
+
+// parseExplainName parses the query to be explained from the name of an
+// explain query.
+func parseExplainName(name string) (explainQuery, error) {
+	eq := explainQuery{qtype: dns.TypeA}
+	labels := dns.SplitDomainName(strings.TrimSuffix(strings.ToLower(name), explainZone))
+	for len(labels) > 0 {
+		label := labels[0]
+		switch {
+		case strings.HasPrefix(label, "client-"):
+			eq.client = parseExplainIP(strings.TrimPrefix(label, "client-"))
+			if eq.client == nil {
+				return eq, fmt.Errorf("Illegal client '%s'", label)
+			}
+		case strings.HasPrefix(label, "type-"):
+			qtype, err := parseQype(strings.ToUpper(strings.TrimPrefix(label, "type-")))
+			if err != nil {
+				return eq, fmt.Errorf("Illegal type '%s'", label)
+			}
+			eq.qtype = qtype
+		case strings.HasPrefix(label, "proto-"):
+			eq.proto = strings.TrimPrefix(label, "proto-")
+			if eq.proto != "udp" && eq.proto != "tcp" {
+				return eq, fmt.Errorf("Illegal protocol '%s'; expect 'proto-udp' or 'proto-tcp'", label)
+			}
+		default:
+			eq.name = dns.Fqdn(strings.Join(labels, "."))
+			return eq, nil
+		}
+		labels = labels[1:]
+	}
+	eq.name = "."
+	return eq, nil
+}
+
+// parseExplainIP parses an IP address with dots or colons replaced by
+// dashes.
+func parseExplainIP(raw string) net.IP {
+	if ip := net.ParseIP(strings.Replace(raw, "-", ".", -1)); ip != nil {
+		return ip
+	}
+	return net.ParseIP(strings.Replace(raw, "-", ":", -1))
+}
+
+// explainLines describes the query, the outcome of each rule evaluated, and
+// the result.
+func explainLines(eq explainQuery, traces []ruleTrace) []string {
+	lines := []string{fmt.Sprintf("query %s %s from %s (%s)", eq.name, dns.TypeToString[eq.qtype], eq.client, eq.proto)}
+	result := CheckResult{Action: ALLOW}
+	for _, t := range traces {
+		zones := strings.Join(t.zones, " ")
+		if t.policy != nil {
+			lines = append(lines, fmt.Sprintf("acl %s: %s by '%s'", zones, t.action, t.policy.text))
+		} else {
+			lines = append(lines, fmt.Sprintf("acl %s: no matching policy", zones))
+		}
+		if t.rpzAction != nil {
+			lines = append(lines, fmt.Sprintf("acl %s: rpz %s by 'rpz %s'", zones, t.rpzAction.kind, t.rpz.file))
+		}
+		if t.decides() {
+			result = t.result()
+		} else if t.policy != nil && result.Policy == "" {
+			// the first policy allowing the query.
+			result.Zones, result.Policy = t.zones, t.policy.text
+		}
+	}
+	if result.Policy == "" {
+		return append(lines, "result: allow (no matching policy)")
+	}
+	return append(lines, fmt.Sprintf("result: %s by '%s' in acl %s", result.Action, result.Policy, strings.Join(result.Zones, " ")))
+}
+
+// explainTXT creates a CHAOS TXT record holding line, which is split into
+// strings of at most 255 bytes.
+func explainTXT(name, line string) dns.RR {
+	var txt []string
+	for len(line) > 255 {
+		txt = append(txt, line[:255])
+		line = line[255:]
+	}
+	txt = append(txt, line)
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: txt,
+	}
+}
@@ -0,0 +1,308 @@
+package acl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func Test_parseExplainName(t *testing.T) {
+	tests := []struct {
+		name    string
+		qname   string
+		want    explainQuery
+		wantErr bool
+	}{
+		{"Name", "www.example.org.explain.acl.", explainQuery{name: "www.example.org.", qtype: dns.TypeA}, false},
+		{"Root", "explain.acl.", explainQuery{name: ".", qtype: dns.TypeA}, false},
+		{"Parameters", "client-10-1-2-3.type-aaaa.proto-tcp.www.example.org.explain.acl.", explainQuery{name: "www.example.org.", qtype: dns.TypeAAAA, client: net.ParseIP("10.1.2.3"), proto: "tcp"}, false},
+		{"IPv6 client", "client-2001-db8--1.example.org.explain.acl.", explainQuery{name: "example.org.", qtype: dns.TypeA, client: net.ParseIP("2001:db8::1")}, false},
+		{"Parameters after name", "www.type-aaaa.example.org.explain.acl.", explainQuery{name: "www.type-aaaa.example.org.", qtype: dns.TypeA}, false},
+		{"Illegal client", "client-10-1-2.example.org.explain.acl.", explainQuery{}, true},
+		{"Illegal type", "type-xyz.example.org.explain.acl.", explainQuery{}, true},
+		{"Illegal protocol", "proto-tls.example.org.explain.acl.", explainQuery{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExplainName(tt.qname)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExplainName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseExplainName() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_explain(t *testing.T) {
+	envSetup(rpzTestFiles)
+	defer envCleanup(rpzTestFiles)
+
+	config := `acl example.org {
+		explain 10.0.0.0/8 192.168.0.0/16
+		block type A net 192.168.1.0/24
+		allow type ANY net 192.168.0.0/16
+	}
+	acl sub.example.org example.com {
+		block type ANY net 172.16.0.0/12
+		rpz acl-test-rpz.db
+	}`
+
+	tests := []struct {
+		name      string
+		config    string
+		source    string
+		qname     string
+		wantRcode int
+		want      []string
+	}{
+		{
+			"Requesting client",
+			config,
+			"192.168.1.5",
+			"www.example.org.explain.acl.",
+			dns.RcodeSuccess,
+			[]string{
+				"query www.example.org. A from 192.168.1.5 (udp)",
+				"acl example.org.: block by 'block type A net 192.168.1.0/24'",
+				"result: block by 'block type A net 192.168.1.0/24' in acl example.org.",
+			},
+		},
+		{
+			"Given client",
+			config,
+			"10.0.0.1",
+			"client-192-168-1-5.type-aaaa.www.sub.example.org.explain.acl.",
+			dns.RcodeSuccess,
+			[]string{
+				"query www.sub.example.org. AAAA from 192.168.1.5 (udp)",
+				"acl example.org.: allow by 'allow type ANY net 192.168.0.0/16'",
+				"acl sub.example.org. example.com.: no matching policy",
+				"result: allow by 'allow type ANY net 192.168.0.0/16' in acl example.org.",
+			},
+		},
+		{
+			"RPZ",
+			config,
+			"10.0.0.1",
+			"client-10-0-0-1.nxdomain.example.com.explain.acl.",
+			dns.RcodeSuccess,
+			[]string{
+				"query nxdomain.example.com. A from 10.0.0.1 (udp)",
+				"acl sub.example.org. example.com.: no matching policy",
+				"acl sub.example.org. example.com.: rpz nxdomain by 'rpz acl-test-rpz.db'",
+				"result: rpz nxdomain by 'rpz acl-test-rpz.db' in acl sub.example.org. example.com.",
+			},
+		},
+		{
+			"No rule",
+			config,
+			"10.0.0.1",
+			"example.net.explain.acl.",
+			dns.RcodeSuccess,
+			[]string{
+				"query example.net. A from 10.0.0.1 (udp)",
+				"result: allow (no matching policy)",
+			},
+		},
+		{
+			"Not admin",
+			config,
+			"172.16.0.1",
+			"www.example.org.explain.acl.",
+			dns.RcodeRefused,
+			nil,
+		},
+		{
+			"Illegal parameter",
+			config,
+			"10.0.0.1",
+			"type-xyz.www.example.org.explain.acl.",
+			dns.RcodeFormatError,
+			[]string{"error: Illegal type 'type-xyz'"},
+		},
+		{
+			"Protocol",
+			`acl example.org {
+				explain 172.16.0.0/12
+				block type ANY net 172.16.0.0/12
+			}`,
+			"172.16.0.1",
+			"proto-tcp.www.example.org.explain.acl.",
+			dns.RcodeSuccess,
+			[]string{
+				"query www.example.org. A from 172.16.0.1 (tcp)",
+				"acl example.org.: block by 'block type ANY net 172.16.0.0/12'",
+				"result: block by 'block type ANY net 172.16.0.0/12' in acl example.org.",
+			},
+		},
+		{
+			"IPv6 admin",
+			`acl example.org {
+				explain fd00::/8
+				block type ANY net 172.16.0.0/12
+			}`,
+			"fd00::1",
+			"client-172-16-0-1.www.example.org.explain.acl.",
+			dns.RcodeSuccess,
+			[]string{
+				"query www.example.org. A from 172.16.0.1 (udp)",
+				"acl example.org.: block by 'block type ANY net 172.16.0.0/12'",
+				"result: block by 'block type ANY net 172.16.0.0/12' in acl example.org.",
+			},
+		},
+		{
+			"Loopback admin by default",
+			`acl example.org {
+				explain
+				block type ANY net 172.16.0.0/12
+			}`,
+			"::1",
+			"client-172-16-0-1.www.example.org.explain.acl.",
+			dns.RcodeSuccess,
+			[]string{
+				"query www.example.org. A from 172.16.0.1 (udp)",
+				"acl example.org.: block by 'block type ANY net 172.16.0.0/12'",
+				"result: block by 'block type ANY net 172.16.0.0/12' in acl example.org.",
+			},
+		},
+		{
+			"Not loopback admin",
+			`acl example.org {
+				explain
+				block type ANY net 172.16.0.0/12
+			}`,
+			"10.0.0.1",
+			"client-172-16-0-1.www.example.org.explain.acl.",
+			dns.RcodeRefused,
+			nil,
+		},
+		{
+			"Disabled",
+			`acl example.org {
+				block type ANY net 172.16.0.0/12
+			}`,
+			"172.16.0.1",
+			"www.example.org.explain.acl.",
+			dns.RcodeSuccess,
+			nil,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseACL(caddy.NewTestController("dns", tt.config))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+			w := &testResponseWriter{}
+			w.setRemoteIP(tt.source)
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, dns.TypeTXT)
+			m.Question[0].Qclass = dns.ClassCHAOS
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+			var got []string
+			if w.Msg != nil {
+				for _, rr := range w.Msg.Answer {
+					got = append(got, rr.(*dns.TXT).Txt[0])
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("acl.ServeDNS() answers = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_explainTruncated(t *testing.T) {
+	var config strings.Builder
+	config.WriteString("acl example.org {\n explain 10.0.0.0/8\n}\n")
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&config, "acl example.org {\n block type MX net 172.16.%d.0/24\n}\n", i)
+	}
+	a, err := parseACL(caddy.NewTestController("dns", config.String()))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	for _, tcp := range []bool{false, true} {
+		w := &testResponseWriter{}
+		if tcp {
+			w.setRemoteTCPIP("10.0.0.1")
+		} else {
+			w.setRemoteIP("10.0.0.1")
+		}
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.explain.acl.", dns.TypeTXT)
+		m.Question[0].Qclass = dns.ClassCHAOS
+		if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+			t.Fatalf("acl.ServeDNS() error = %v", err)
+		}
+		if w.Msg.Truncated == tcp {
+			t.Errorf("acl.ServeDNS() over TCP %v Truncated = %v, want %v", tcp, w.Msg.Truncated, !tcp)
+		}
+		if !tcp && w.Msg.Len() > dns.MinMsgSize {
+			t.Errorf("acl.ServeDNS() answer size = %d, want at most %d", w.Msg.Len(), dns.MinMsgSize)
+		}
+		if tcp && len(w.Msg.Answer) != 33 {
+			t.Errorf("acl.ServeDNS() over TCP returns %d answers, want 33", len(w.Msg.Answer))
+		}
+	}
+}
+
+func Test_acl_ServeDNS_explainDryRun(t *testing.T) {
+	a, err := parseACL(caddy.NewTestController("dns", `acl example.org {
+		explain 10.9.9.9
+		ratelimit 1/h burst 1 prefix 32 type ANY net ANY
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		w := &testResponseWriter{}
+		w.setRemoteIP("10.9.9.9")
+		m := new(dns.Msg)
+		m.SetQuestion("client-10-1-0-2.www.example.org.explain.acl.", dns.TypeTXT)
+		m.Question[0].Qclass = dns.ClassCHAOS
+		if _, err := a.ServeDNS(ctx, w, m); err != nil {
+			t.Fatalf("acl.ServeDNS() error = %v", err)
+		}
+		if w.Rcode != dns.RcodeSuccess {
+			t.Fatalf("acl.ServeDNS() of explain query Rcode = %v, want %v", w.Rcode, dns.RcodeSuccess)
+		}
+	}
+
+	// explain queries leave the bucket of the client full.
+	for _, want := range []int{dns.RcodeSuccess, dns.RcodeRefused} {
+		w := &testResponseWriter{}
+		w.setRemoteIP("10.1.0.2")
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.", dns.TypeA)
+		if _, err := a.ServeDNS(ctx, w, m); err != nil {
+			t.Fatalf("acl.ServeDNS() error = %v", err)
+		}
+		if w.Rcode != want {
+			t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package filter
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Addr is an IP address of fixed size, which is passed around by value
+// without allocations. IPv4 addresses are held in the IPv4-mapped IPv6 form.
+type Addr [16]byte
+
+var v4InV6Prefix = [12]byte{10: 0xff, 11: 0xff}
+
+// AddrFromIP converts ip into an Addr. It reports false if ip is neither a
+// 4-byte nor a 16-byte address.
+func AddrFromIP(ip net.IP) (Addr, bool) {
+	var a Addr
+	switch len(ip) {
+	case net.IPv4len:
+		copy(a[:], v4InV6Prefix[:])
+		copy(a[12:], ip)
+	case net.IPv6len:
+		copy(a[:], ip)
+	default:
+		return a, false
+	}
+	return a, true
+}
+
+// Is4 reports whether a is an IPv4 address.
+func (a Addr) Is4() bool {
+	for i, b := range v4InV6Prefix {
+		if a[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// IP returns a as a net.IP.
+func (a Addr) IP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, a[:])
+	return ip
+}
+
+func (a Addr) String() string {
+	return a.IP().String()
+}
+
+// uint32 returns the IPv4 address of a as an integer.
+func (a Addr) uint32() uint32 {
+	return binary.BigEndian.Uint32(a[12:])
+}
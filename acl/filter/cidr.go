@@ -0,0 +1,187 @@
+package filter
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net"
+)
+
+// Union returns the minimal list of subnets covering the addresses in any of
+// lists.
+func Union(lists ...[]net.IPNet) ([]net.IPNet, error) {
+	var all []net.IPNet
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	return Collapse(all)
+}
+
+// Intersect returns the minimal list of subnets covering the addresses in
+// both a and b.
+func Intersect(a, b []net.IPNet) ([]net.IPNet, error) {
+	return combine(a, b, intersectSpans)
+}
+
+// Difference returns the minimal list of subnets covering the addresses in a
+// but not in b.
+func Difference(a, b []net.IPNet) ([]net.IPNet, error) {
+	return combine(a, b, subtractSpans)
+}
+
+// Collapse returns the minimal list of subnets covering the same addresses
+// as nets, i.e., with duplicate and nested subnets removed, and adjacent ones
+// aggregated. IPv4 subnets come first, and subnets are sorted by address.
+func Collapse(nets []net.IPNet) ([]net.IPNet, error) {
+	v4, v6, err := toSpans(nets)
+	if err != nil {
+		return nil, err
+	}
+	return append(fromSpans(v4, net.IPv4len), fromSpans(v6, net.IPv6len)...), nil
+}
+
+// combine applies op to the spans of a and b in each address family.
+func combine(a, b []net.IPNet, op func(a, b []span) []span) ([]net.IPNet, error) {
+	a4, a6, err := toSpans(a)
+	if err != nil {
+		return nil, err
+	}
+	b4, b6, err := toSpans(b)
+	if err != nil {
+		return nil, err
+	}
+	return append(fromSpans(op(a4, b4), net.IPv4len), fromSpans(op(a6, b6), net.IPv6len)...), nil
+}
+
+// toSpans returns the merged spans of the IPv4 and IPv6 subnets in nets.
+func toSpans(nets []net.IPNet) ([]span, []span, error) {
+	var v4, v6 []span
+	for _, subnet := range nets {
+		ip, ones, err := family(subnet)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(ip) == net.IPv4len {
+			v4 = append(v4, spanOf(ip, ones))
+		} else {
+			v6 = append(v6, spanOf(ip, ones))
+		}
+	}
+	return mergeSpans(v4), mergeSpans(v6), nil
+}
+
+// fromSpans splits merged spans into the minimal list of subnets, whose
+// addresses are of the given size.
+func fromSpans(spans []span, size int) []net.IPNet {
+	var nets []net.IPNet
+	width := 8 * size
+	for _, s := range spans {
+		start := s.start
+		for {
+			// the largest block aligned on start ...
+			host := start.trailingZeros()
+			if host > width {
+				host = width
+			}
+			// ... which does not exceed the end.
+			for s.end.less(start.or(lowBits(host))) {
+				host--
+			}
+			ip := make(net.IP, size)
+			start.putBytes(ip)
+			nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(width-host, width)})
+			last := start.or(lowBits(host))
+			if last == s.end {
+				break
+			}
+			start = last.add1()
+		}
+	}
+	return nets
+}
+
+// intersectSpans returns the spans covered by both a and b, which are
+// merged.
+func intersectSpans(a, b []span) []span {
+	var spans []span
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := a[i].start, a[i].end
+		if start.less(b[j].start) {
+			start = b[j].start
+		}
+		if b[j].end.less(end) {
+			end = b[j].end
+		}
+		if !end.less(start) {
+			spans = append(spans, span{start, end})
+		}
+		// advance the span ending first.
+		if a[i].end.less(b[j].end) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return spans
+}
+
+// subtractSpans returns the spans covered by a but not by b, which are
+// merged.
+func subtractSpans(a, b []span) []span {
+	var spans []span
+	j := 0
+	for _, s := range a {
+		// skip spans of b ending before s.
+		for j < len(b) && b[j].end.less(s.start) {
+			j++
+		}
+		start := s.start
+		covered := false
+		for k := j; k < len(b) && !s.end.less(b[k].start); k++ {
+			if start.less(b[k].start) {
+				spans = append(spans, span{start, b[k].start.sub1()})
+			}
+			if !b[k].end.less(s.end) {
+				covered = true
+				break
+			}
+			start = b[k].end.add1()
+		}
+		if !covered {
+			spans = append(spans, span{start, s.end})
+		}
+	}
+	return spans
+}
+
+// sub1 returns u-1, which wraps around to the maximum.
+func (u uint128) sub1() uint128 {
+	if u.lo == 0 {
+		u.hi--
+	}
+	u.lo--
+	return u
+}
+
+func (u uint128) or(v uint128) uint128 {
+	return uint128{u.hi | v.hi, u.lo | v.lo}
+}
+
+// trailingZeros returns the number of trailing zero bits of u, i.e., 128 for
+// 0.
+func (u uint128) trailingZeros() int {
+	if u.lo != 0 {
+		return bits.TrailingZeros64(u.lo)
+	}
+	return 64 + bits.TrailingZeros64(u.hi)
+}
+
+// putBytes writes u into ip, which is 4 bytes for IPv4 and 16 bytes for
+// IPv6.
+func (u uint128) putBytes(ip []byte) {
+	if len(ip) == net.IPv4len {
+		binary.BigEndian.PutUint32(ip, uint32(u.lo))
+		return
+	}
+	binary.BigEndian.PutUint64(ip, u.hi)
+	binary.BigEndian.PutUint64(ip[8:], u.lo)
+}
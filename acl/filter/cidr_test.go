@@ -0,0 +1,156 @@
+package filter
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustParseCIDRs(t *testing.T, rawNets []string) []net.IPNet {
+	var nets []net.IPNet
+	for _, rawNet := range rawNets {
+		nets = append(nets, mustParseCIDR(t, rawNet))
+	}
+	return nets
+}
+
+func cidrStrings(nets []net.IPNet) []string {
+	var s []string
+	for _, n := range nets {
+		s = append(s, n.String())
+	}
+	return s
+}
+
+func TestCollapse(t *testing.T) {
+	tests := []struct {
+		name string
+		nets []string
+		want []string
+	}{
+		{"Empty", nil, nil},
+		{"Duplicate", []string{"10.0.0.0/8", "10.0.0.0/8"}, []string{"10.0.0.0/8"}},
+		{"Nested", []string{"10.1.0.0/16", "10.0.0.0/8"}, []string{"10.0.0.0/8"}},
+		{"Adjacent", []string{"10.0.0.0/9", "10.128.0.0/9"}, []string{"10.0.0.0/8"}},
+		{"Adjacent unaligned", []string{"10.0.0.1/32", "10.0.0.2/31"}, []string{"10.0.0.1/32", "10.0.0.2/31"}},
+		{"Adjacent aligned", []string{"10.0.0.0/32", "10.0.0.1/32", "10.0.0.2/31"}, []string{"10.0.0.0/30"}},
+		{"Sorted", []string{"192.168.0.0/16", "2001:db8::/32", "10.0.0.0/8"}, []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}},
+		{"Whole space", []string{"0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"}, []string{"0.0.0.0/0", "::/0"}},
+		{"IPv4 with 16-byte mask", []string{"::ffff:10.0.0.0/104"}, []string{"10.0.0.0/8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Collapse(mustParseCIDRs(t, tt.nets))
+			if err != nil {
+				t.Fatalf("Collapse() error = %v", err)
+			}
+			if s := cidrStrings(got); !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("Collapse() = %v, want %v", s, tt.want)
+			}
+		})
+	}
+
+	if _, err := Collapse([]net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 16)}}); err == nil {
+		t.Errorf("Collapse() accepts an illegal mask")
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	tests := []struct {
+		name          string
+		a, b          []string
+		union         []string
+		intersect     []string
+		difference    []string
+		differenceRev []string
+	}{
+		{
+			"Disjoint",
+			[]string{"10.0.0.0/8"}, []string{"192.168.0.0/16"},
+			[]string{"10.0.0.0/8", "192.168.0.0/16"}, nil,
+			[]string{"10.0.0.0/8"}, []string{"192.168.0.0/16"},
+		},
+		{
+			"Nested",
+			[]string{"10.0.0.0/8"}, []string{"10.1.0.0/16"},
+			[]string{"10.0.0.0/8"}, []string{"10.1.0.0/16"},
+			[]string{"10.0.0.0/16", "10.2.0.0/15", "10.4.0.0/14", "10.8.0.0/13", "10.16.0.0/12", "10.32.0.0/11", "10.64.0.0/10", "10.128.0.0/9"}, nil,
+		},
+		{
+			"Several holes",
+			[]string{"192.168.0.0/24"}, []string{"192.168.0.0/26", "192.168.0.128/26", "10.0.0.0/8"},
+			[]string{"10.0.0.0/8", "192.168.0.0/24"}, []string{"192.168.0.0/26", "192.168.0.128/26"},
+			[]string{"192.168.0.64/26", "192.168.0.192/26"}, []string{"10.0.0.0/8"},
+		},
+		{
+			"Families apart",
+			[]string{"0.0.0.0/0", "2001:db8::/32"}, []string{"2001:db8::/33"},
+			[]string{"0.0.0.0/0", "2001:db8::/32"}, []string{"2001:db8::/33"},
+			[]string{"0.0.0.0/0", "2001:db8:8000::/33"}, nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := mustParseCIDRs(t, tt.a), mustParseCIDRs(t, tt.b)
+			check := func(op string, got []net.IPNet, err error, want []string) {
+				if err != nil {
+					t.Fatalf("%s() error = %v", op, err)
+				}
+				if s := cidrStrings(got); !reflect.DeepEqual(s, want) {
+					t.Errorf("%s() = %v, want %v", op, s, want)
+				}
+			}
+			got, err := Union(a, b)
+			check("Union", got, err, tt.union)
+			got, err = Intersect(a, b)
+			check("Intersect", got, err, tt.intersect)
+			got, err = Difference(a, b)
+			check("Difference", got, err, tt.difference)
+			got, err = Difference(b, a)
+			check("Difference", got, err, tt.differenceRev)
+		})
+	}
+}
+
+func TestSetAlgebra_random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randNets := func(n int) []net.IPNet {
+		nets := make([]net.IPNet, n)
+		for i := range nets {
+			ip := net.IPv4(10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256))).To4()
+			mask := net.CIDRMask(14+r.Intn(19), 32)
+			nets[i] = net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		}
+		return nets
+	}
+	a, b := randNets(100), randNets(100)
+	inA, _ := New("naive", a)
+	inB, _ := New("naive", b)
+
+	union, _ := Union(a, b)
+	intersect, _ := Intersect(a, b)
+	difference, _ := Difference(a, b)
+	ops := []struct {
+		name string
+		nets []net.IPNet
+		want func(ip net.IP) bool
+	}{
+		{"Union", union, func(ip net.IP) bool { return inA.Contains(ip) || inB.Contains(ip) }},
+		{"Intersect", intersect, func(ip net.IP) bool { return inA.Contains(ip) && inB.Contains(ip) }},
+		{"Difference", difference, func(ip net.IP) bool { return inA.Contains(ip) && !inB.Contains(ip) }},
+	}
+	for _, op := range ops {
+		got, _ := New("naive", op.nets)
+		// the result is minimal, i.e., collapsing it changes nothing.
+		if collapsed, _ := Collapse(op.nets); !reflect.DeepEqual(cidrStrings(collapsed), cidrStrings(op.nets)) {
+			t.Errorf("%s() is not collapsed", op.name)
+		}
+		for i := 0; i < 20000; i++ {
+			ip := net.IPv4(10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256)))
+			if got.Contains(ip) != op.want(ip) {
+				t.Fatalf("%s() contains %s = %v, want %v", op.name, ip, got.Contains(ip), op.want(ip))
+			}
+		}
+	}
+}
@@ -41,6 +41,10 @@ func (cf *cuckooFilter) Contains(ip net.IP) bool {
 	return false
 }
 
+func (cf *cuckooFilter) ContainsAddr(a Addr) bool {
+	return cf.Contains(a[:])
+}
+
 func newCuckooFilter(subnets []net.IPNet) (*cuckooFilter, error) {
 	netsCount := len(subnets)
 	filterSize := netsCount + netsCount/2
@@ -10,6 +10,9 @@ import (
 type Filter interface {
 	Add(net.IPNet) error
 	Contains(net.IP) bool
+	// ContainsAddr is like Contains, but takes an Addr, which involves no
+	// allocations.
+	ContainsAddr(Addr) bool
 }
 
 // New creates a Filter.
@@ -21,6 +24,8 @@ func New(filterType string, subnets []net.IPNet) (Filter, error) {
 		return newCuckooFilter(subnets)
 	case "trie":
 		return newTrieFilter(subnets)
+	case "ranges":
+		return newRangesFilter(subnets)
 	default:
 		return nil, fmt.Errorf("unrecognized filter type: %s", filterType)
 	}
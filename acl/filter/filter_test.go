@@ -0,0 +1,197 @@
+package filter
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// conformanceBackends are the filter types checked against the same cases.
+// ipv6 tells whether the type supports IPv6 networks.
+var conformanceBackends = []struct {
+	filterType string
+	ipv6       bool
+}{
+	{"naive", true},
+	{"trie", false},
+	{"ranges", true},
+}
+
+func TestNew_conformance(t *testing.T) {
+	nets := []string{
+		"10.0.0.0/8", "10.1.0.0/16", "172.16.0.0/12", "192.168.1.0/31", "192.168.1.2/31",
+		"203.0.113.7/32", "2001:db8::/32", "2001:db8:1::/48", "fe80::1/128",
+	}
+	tests := []struct {
+		addr string
+		want bool
+		ipv6 bool
+	}{
+		{"10.0.0.0", true, false},
+		{"10.255.255.255", true, false},
+		{"9.255.255.255", false, false},
+		{"11.0.0.0", false, false},
+		{"172.31.255.255", true, false},
+		{"172.32.0.0", false, false},
+		{"192.168.1.0", true, false},
+		{"192.168.1.3", true, false},
+		{"192.168.1.4", false, false},
+		{"203.0.113.7", true, false},
+		{"203.0.113.8", false, false},
+		{"0.0.0.0", false, false},
+		{"255.255.255.255", false, false},
+		{"::ffff:10.1.2.3", true, false},
+		{"2001:db8::1", true, true},
+		{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true, true},
+		{"2001:db9::", false, true},
+		{"fe80::1", true, true},
+		{"fe80::2", false, true},
+		{"::", false, true},
+	}
+
+	for _, backend := range conformanceBackends {
+		t.Run(backend.filterType, func(t *testing.T) {
+			var subnets []net.IPNet
+			for _, n := range nets {
+				subnets = append(subnets, mustParseCIDR(t, n))
+			}
+			f, err := New(backend.filterType, subnets)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			for _, tt := range tests {
+				if tt.ipv6 && !backend.ipv6 {
+					continue
+				}
+				ip := net.ParseIP(tt.addr)
+				if got := f.Contains(ip); got != tt.want {
+					t.Errorf("Contains(%s) = %v, want %v", tt.addr, got, tt.want)
+				}
+				if got := f.ContainsAddr(mustAddr(t, tt.addr)); got != tt.want {
+					t.Errorf("ContainsAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+				}
+			}
+
+			// networks added after the filter is built.
+			if err := f.Add(mustParseCIDR(t, "198.51.100.0/24")); err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+			if !f.Contains(net.ParseIP("198.51.100.1")) || f.Contains(net.ParseIP("198.51.101.1")) {
+				t.Errorf("Contains() mismatches the network added")
+			}
+			if !f.Contains(net.ParseIP("10.1.2.3")) {
+				t.Errorf("Contains() loses networks once another is added")
+			}
+		})
+	}
+}
+
+func TestNew_conformanceRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randIP := func(size int) net.IP {
+		ip := make(net.IP, size)
+		r.Read(ip)
+		if size == net.IPv6len {
+			// keep addresses close so that networks overlap.
+			ip[0], ip[1] = 0x20, 0x01
+		}
+		return ip
+	}
+
+	var subnets []net.IPNet
+	for i := 0; i < 300; i++ {
+		ones := 8 + r.Intn(25)
+		ip := randIP(net.IPv4len)
+		ip[0] = byte(r.Intn(4))
+		mask := net.CIDRMask(ones, 32)
+		subnets = append(subnets, net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+	for i := 0; i < 100; i++ {
+		mask := net.CIDRMask(16+r.Intn(113), 128)
+		subnets = append(subnets, net.IPNet{IP: randIP(net.IPv6len).Mask(mask), Mask: mask})
+	}
+	want, err := New("naive", subnets)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	for _, backend := range conformanceBackends {
+		t.Run(backend.filterType, func(t *testing.T) {
+			f, err := New(backend.filterType, subnets)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			for i := 0; i < 20000; i++ {
+				ip := randIP(net.IPv4len)
+				ip[0] = byte(r.Intn(4))
+				if i%2 == 1 {
+					if !backend.ipv6 {
+						continue
+					}
+					ip = randIP(net.IPv6len)
+				}
+				if got := f.Contains(ip); got != want.Contains(ip) {
+					t.Fatalf("Contains(%s) = %v, want %v", ip, got, !got)
+				}
+			}
+		})
+	}
+}
+
+func Test_rangesFilter_merge(t *testing.T) {
+	var subnets []net.IPNet
+	for _, n := range []string{"10.0.0.0/9", "10.128.0.0/9", "10.1.0.0/16", "11.0.0.0/8", "13.0.0.0/8", "0.0.0.0/32", "255.255.255.255/32", "::/1", "8000::/1"} {
+		subnets = append(subnets, mustParseCIDR(t, n))
+	}
+	rf, err := newRangesFilter(subnets)
+	if err != nil {
+		t.Fatalf("newRangesFilter() error = %v", err)
+	}
+	want4 := []range4{{0, 0}, {0x0a000000, 0x0bffffff}, {0x0d000000, 0x0dffffff}, {0xffffffff, 0xffffffff}}
+	if len(rf.v4) != len(want4) {
+		t.Fatalf("rangesFilter.v4 = %v, want %v", rf.v4, want4)
+	}
+	for i := range want4 {
+		if rf.v4[i] != want4[i] {
+			t.Errorf("rangesFilter.v4[%d] = %v, want %v", i, rf.v4[i], want4[i])
+		}
+	}
+	if len(rf.v6) != 1 || rf.v6[0] != (span{uint128{}, lowBits(128)}) {
+		t.Errorf("rangesFilter.v6 = %v, want the whole address space", rf.v6)
+	}
+
+	if _, err := newRangesFilter([]net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 16)}}); err == nil {
+		t.Errorf("newRangesFilter() accepts an illegal mask")
+	}
+}
+
+func BenchmarkContainsAddr(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	subnets := make([]net.IPNet, 10000)
+	for i := range subnets {
+		ip := make(net.IP, net.IPv4len)
+		r.Read(ip)
+		mask := net.CIDRMask(16+r.Intn(17), 32)
+		subnets[i] = net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	addrs := make([]Addr, 1024)
+	for i := range addrs {
+		ip := make(net.IP, net.IPv4len)
+		r.Read(ip)
+		addrs[i], _ = AddrFromIP(ip)
+	}
+
+	for _, backend := range []string{"trie", "ranges"} {
+		b.Run(backend, func(b *testing.B) {
+			f, err := New(backend, subnets)
+			if err != nil {
+				b.Fatalf("New() error = %v", err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.ContainsAddr(addrs[i%len(addrs)])
+			}
+		})
+	}
+}
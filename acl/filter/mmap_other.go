@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package filter
+
+import "io/ioutil"
+
+// OpenSnapshot reads a snapshot file into memory and loads it.
+func OpenSnapshot(name string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return LoadSnapshot(data)
+}
@@ -0,0 +1,37 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package filter
+
+import (
+	"os"
+	"syscall"
+)
+
+// OpenSnapshot maps a snapshot file into memory and loads it. The snapshot
+// should be closed once it is no longer used.
+func OpenSnapshot(name string) (*Snapshot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 || int64(int(info.Size())) != info.Size() {
+		return LoadSnapshot(nil)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	s, err := LoadSnapshot(data)
+	if err != nil {
+		syscall.Munmap(data)
+		return nil, err
+	}
+	s.release = func() error { return syscall.Munmap(data) }
+	return s, nil
+}
@@ -22,6 +22,10 @@ func (nf *naiveFilter) Contains(ip net.IP) bool {
 	return false
 }
 
+func (nf *naiveFilter) ContainsAddr(a Addr) bool {
+	return nf.Contains(a[:])
+}
+
 func newNaiveFilter(subnets []net.IPNet) (*naiveFilter, error) {
 	return &naiveFilter{
 		subnets: subnets,
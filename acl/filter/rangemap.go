@@ -0,0 +1,132 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// RangeMap maps ranges of IPv4 and IPv6 addresses to uint32 values, e.g.,
+// the ASNs of routed networks. Like the ranges filter, it holds sorted,
+// non-overlapping ranges which are looked up by binary search, so that
+// tables of millions of ranges take little memory.
+//
+// Ranges are inserted first, and Sort must be called before any lookup.
+type RangeMap struct {
+	v4 []valueRange4
+	v6 []valueSpan
+}
+
+type valueRange4 struct {
+	start, end uint32
+	value      uint32
+}
+
+type valueSpan struct {
+	span
+	value uint32
+}
+
+// NewRangeMap creates an empty RangeMap.
+func NewRangeMap() *RangeMap {
+	return &RangeMap{}
+}
+
+// Insert maps the addresses from start to end, both included, to value.
+func (m *RangeMap) Insert(start, end net.IP, value uint32) error {
+	if start4, end4 := start.To4(), end.To4(); start4 != nil && end4 != nil {
+		s, e := uint128FromBytes(start4), uint128FromBytes(end4)
+		if e.less(s) {
+			return fmt.Errorf("illegal range %s-%s; start is after end", start, end)
+		}
+		m.v4 = append(m.v4, valueRange4{uint32(s.lo), uint32(e.lo), value})
+		return nil
+	} else if start4 != nil || end4 != nil || len(start) != net.IPv6len || len(end) != net.IPv6len {
+		return fmt.Errorf("illegal range %s-%s", start, end)
+	}
+	s := span{uint128FromBytes(start), uint128FromBytes(end)}
+	if s.end.less(s.start) {
+		return fmt.Errorf("illegal range %s-%s; start is after end", start, end)
+	}
+	m.v6 = append(m.v6, valueSpan{s, value})
+	return nil
+}
+
+// InsertNet maps the addresses of subnet to value.
+func (m *RangeMap) InsertNet(subnet net.IPNet, value uint32) error {
+	ip, ones, err := family(subnet)
+	if err != nil {
+		return err
+	}
+	s := spanOf(ip, ones)
+	if len(ip) == net.IPv4len {
+		m.v4 = append(m.v4, valueRange4{uint32(s.start.lo), uint32(s.end.lo), value})
+		return nil
+	}
+	m.v6 = append(m.v6, valueSpan{s, value})
+	return nil
+}
+
+// Sort sorts the ranges for lookups. Ranges overlapping those starting
+// before them are dropped.
+func (m *RangeMap) Sort() {
+	sort.Slice(m.v4, func(i, j int) bool { return m.v4[i].start < m.v4[j].start })
+	v4 := m.v4[:0]
+	for i, r := range m.v4 {
+		if i > 0 && r.start <= v4[len(v4)-1].end {
+			continue
+		}
+		v4 = append(v4, r)
+	}
+	m.v4 = v4
+
+	sort.Slice(m.v6, func(i, j int) bool { return m.v6[i].start.less(m.v6[j].start) })
+	v6 := m.v6[:0]
+	for i, r := range m.v6 {
+		if i > 0 && !v6[len(v6)-1].end.less(r.start) {
+			continue
+		}
+		v6 = append(v6, r)
+	}
+	m.v6 = v6
+}
+
+// Len returns the number of ranges.
+func (m *RangeMap) Len() int {
+	return len(m.v4) + len(m.v6)
+}
+
+// Get returns the value of the range containing a.
+func (m *RangeMap) Get(a Addr) (uint32, bool) {
+	if a.Is4() {
+		x := a.uint32()
+		// the first range ending at or after x.
+		lo, hi := 0, len(m.v4)
+		for lo < hi {
+			mid := int(uint(lo+hi) >> 1)
+			if m.v4[mid].end < x {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if lo < len(m.v4) && m.v4[lo].start <= x {
+			return m.v4[lo].value, true
+		}
+		return 0, false
+	}
+	x := uint128FromBytes(a[:])
+	lo, hi := 0, len(m.v6)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if m.v6[mid].end.less(x) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo < len(m.v6) && !x.less(m.v6[lo].start) {
+		return m.v6[lo].value, true
+	}
+	return 0, false
+}
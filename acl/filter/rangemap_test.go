@@ -0,0 +1,78 @@
+package filter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRangeMap(t *testing.T) {
+	m := NewRangeMap()
+	ranges := []struct {
+		start, end string
+		value      uint32
+	}{
+		{"10.0.0.5", "10.0.0.77", 64500},
+		{"1.0.0.0", "1.0.0.255", 13335},
+		{"10.0.0.78", "10.0.1.0", 64501},
+		// overlaps the first range, and is dropped.
+		{"10.0.0.70", "10.0.0.80", 64502},
+		{"2001:db8::", "2001:db8::ffff", 64510},
+	}
+	for _, r := range ranges {
+		if err := m.Insert(net.ParseIP(r.start), net.ParseIP(r.end), r.value); err != nil {
+			t.Fatalf("RangeMap.Insert() error = %v", err)
+		}
+	}
+	if err := m.InsertNet(mustParseCIDR(t, "192.168.0.0/16"), 64520); err != nil {
+		t.Fatalf("RangeMap.InsertNet() error = %v", err)
+	}
+	if err := m.InsertNet(mustParseCIDR(t, "2001:db9::/32"), 64521); err != nil {
+		t.Fatalf("RangeMap.InsertNet() error = %v", err)
+	}
+	m.Sort()
+	if m.Len() != 6 {
+		t.Errorf("RangeMap.Len() = %d, want 6", m.Len())
+	}
+
+	tests := []struct {
+		addr  string
+		want  uint32
+		found bool
+	}{
+		{"10.0.0.4", 0, false},
+		{"10.0.0.5", 64500, true},
+		{"10.0.0.77", 64500, true},
+		{"10.0.0.78", 64501, true},
+		{"10.0.1.0", 64501, true},
+		{"10.0.1.1", 0, false},
+		{"1.0.0.128", 13335, true},
+		{"192.168.255.255", 64520, true},
+		{"::ffff:192.168.0.1", 64520, true},
+		{"2001:db8::ff", 64510, true},
+		{"2001:db8::1:0", 0, false},
+		{"2001:db9:1::", 64521, true},
+		{"::", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, found := m.Get(mustAddr(t, tt.addr))
+			if got != tt.want || found != tt.found {
+				t.Errorf("RangeMap.Get() = %v, %v, want %v, %v", got, found, tt.want, tt.found)
+			}
+		})
+	}
+
+	illegal := [][2]string{
+		{"10.0.0.2", "10.0.0.1"},
+		{"10.0.0.1", "2001:db8::"},
+		{"2001:db8::1", "2001:db8::"},
+	}
+	for _, r := range illegal {
+		if err := m.Insert(net.ParseIP(r[0]), net.ParseIP(r[1]), 1); err == nil {
+			t.Errorf("RangeMap.Insert() accepts an illegal range %s-%s", r[0], r[1])
+		}
+	}
+	if _, found := NewRangeMap().Get(mustAddr(t, "10.0.0.1")); found {
+		t.Errorf("RangeMap.Get() finds a value in an empty map")
+	}
+}
@@ -0,0 +1,176 @@
+package filter
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+)
+
+// rangesFilter holds the networks as sorted, non-overlapping ranges of
+// addresses, which are looked up by binary search. Overlapping or adjacent
+// networks are merged at build time, so that dense and static feeds take
+// little memory.
+type rangesFilter struct {
+	v4 []range4
+	v6 []span
+}
+
+type range4 struct {
+	start, end uint32
+}
+
+var _ Filter = &rangesFilter{}
+
+func newRangesFilter(subnets []net.IPNet) (*rangesFilter, error) {
+	var v4, v6 []span
+	for _, subnet := range subnets {
+		ip, ones, err := family(subnet)
+		if err != nil {
+			return nil, err
+		}
+		if len(ip) == net.IPv4len {
+			v4 = append(v4, spanOf(ip, ones))
+		} else {
+			v6 = append(v6, spanOf(ip, ones))
+		}
+	}
+	rf := &rangesFilter{v6: mergeSpans(v6)}
+	rf.setV4(mergeSpans(v4))
+	return rf, nil
+}
+
+// setV4 packs spans of IPv4 addresses into ranges of 32-bit integers.
+func (rf *rangesFilter) setV4(spans []span) {
+	rf.v4 = make([]range4, len(spans))
+	for i, s := range spans {
+		rf.v4[i] = range4{uint32(s.start.lo), uint32(s.end.lo)}
+	}
+}
+
+// Add merges subnet into the ranges, which takes linear time. Filters of
+// this type are meant to be built at once.
+func (rf *rangesFilter) Add(subnet net.IPNet) error {
+	ip, ones, err := family(subnet)
+	if err != nil {
+		return err
+	}
+	if len(ip) == net.IPv6len {
+		rf.v6 = mergeSpans(append(rf.v6, spanOf(ip, ones)))
+		return nil
+	}
+	spans := make([]span, 0, len(rf.v4)+1)
+	for _, r := range rf.v4 {
+		spans = append(spans, span{uint128{lo: uint64(r.start)}, uint128{lo: uint64(r.end)}})
+	}
+	rf.setV4(mergeSpans(append(spans, spanOf(ip, ones))))
+	return nil
+}
+
+func (rf *rangesFilter) Contains(ip net.IP) bool {
+	a, ok := AddrFromIP(ip)
+	return ok && rf.ContainsAddr(a)
+}
+
+func (rf *rangesFilter) ContainsAddr(a Addr) bool {
+	if a.Is4() {
+		x := a.uint32()
+		// the first range ending at or after x.
+		lo, hi := 0, len(rf.v4)
+		for lo < hi {
+			mid := int(uint(lo+hi) >> 1)
+			if rf.v4[mid].end < x {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		return lo < len(rf.v4) && rf.v4[lo].start <= x
+	}
+	x := uint128FromBytes(a[:])
+	lo, hi := 0, len(rf.v6)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if rf.v6[mid].end.less(x) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo < len(rf.v6) && !x.less(rf.v6[lo].start)
+}
+
+// uint128 is an unsigned 128-bit integer, which holds IPv4 addresses in its
+// low 32 bits, and IPv6 addresses in full.
+type uint128 struct {
+	hi, lo uint64
+}
+
+func uint128FromBytes(ip []byte) uint128 {
+	if len(ip) == net.IPv4len {
+		return uint128{lo: uint64(binary.BigEndian.Uint32(ip))}
+	}
+	return uint128{binary.BigEndian.Uint64(ip), binary.BigEndian.Uint64(ip[8:])}
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || u.hi == v.hi && u.lo < v.lo
+}
+
+// add1 returns u+1, which wraps around to 0.
+func (u uint128) add1() uint128 {
+	u.lo++
+	if u.lo == 0 {
+		u.hi++
+	}
+	return u
+}
+
+// lowBits returns the integer whose n lowest bits are set.
+func lowBits(n int) uint128 {
+	switch {
+	case n <= 0:
+		return uint128{}
+	case n < 64:
+		return uint128{lo: 1<<uint(n) - 1}
+	case n < 128:
+		return uint128{1<<uint(n-64) - 1, ^uint64(0)}
+	default:
+		return uint128{^uint64(0), ^uint64(0)}
+	}
+}
+
+// span is a range of addresses in the same address family, both ends
+// included.
+type span struct {
+	start, end uint128
+}
+
+// spanOf returns the span of the subnet of ip with the prefix length ones.
+func spanOf(ip []byte, ones int) span {
+	host := lowBits(8*len(ip) - ones)
+	start := uint128FromBytes(ip)
+	start.hi &^= host.hi
+	start.lo &^= host.lo
+	return span{start, uint128{start.hi | host.hi, start.lo | host.lo}}
+}
+
+// mergeSpans sorts spans by their start, and merges overlapping or adjacent
+// ones. spans is modified in place.
+func mergeSpans(spans []span) []span {
+	if len(spans) == 0 {
+		return nil
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start.less(spans[j].start) })
+	merged := spans[:1]
+	for _, s := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if !last.end.less(s.start) || last.end.add1() == s.start {
+			if last.end.less(s.end) {
+				last.end = s.end
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
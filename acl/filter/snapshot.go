@@ -0,0 +1,333 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+// Snapshots are compiled filters in a compact binary format, which are
+// loaded without parsing any networks. All integers are little-endian:
+//
+//	offset  size  field
+//	0       4     magic "ACLF"
+//	4       2     version, i.e., 1
+//	6       2     kind of the filter, i.e., 1 for trie or 2 for ranges
+//	8       32    fingerprint of the source of the filter
+//	40      4     number of entries
+//	44      4     number of IPv4 ranges for ranges, or otherwise 0
+//	48      8*N   entries
+//	48+8*N  4     CRC-32C of all preceding bytes
+//
+// Entries of a trie are its nodes in pre-order, with the root first. Each
+// node holds the indexes of its zero and one children, where 0 means none,
+// or leafMark in both for a leaf.
+//
+// Entries of ranges are the IPv4 ranges, each in one entry holding its first
+// and last addresses, followed by the IPv6 ranges, each in four entries
+// holding the high and low halves of its first and then last addresses.
+const (
+	snapshotMagic      = "ACLF"
+	snapshotVersion    = 1
+	snapshotHeaderSize = 48
+	snapshotEntrySize  = 8
+
+	snapshotKindTrie   = 1
+	snapshotKindRanges = 2
+
+	leafMark = 0xffffffff
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrReadOnly is returned when adding networks to a Snapshot.
+var ErrReadOnly = errors.New("snapshot filters are read-only")
+
+// Snapshot is a Filter loaded from a snapshot. It looks up addresses in the
+// snapshot data in place.
+type Snapshot struct {
+	fingerprint [32]byte
+	kind        uint16
+	// nodes are the entries of a trie.
+	nodes []byte
+	// v4 and v6 are the entries of ranges.
+	v4, v6 []byte
+	// release releases the data of the snapshot, e.g., unmaps it.
+	release func() error
+}
+
+var _ Filter = &Snapshot{}
+
+// WriteSnapshot writes the snapshot of f along with the fingerprint of its
+// source. Only filters of type trie and ranges are supported.
+func WriteSnapshot(w io.Writer, f Filter, fingerprint [32]byte) error {
+	var kind uint16
+	var entries []byte
+	var v4Count uint32
+	switch f := f.(type) {
+	case *trieFilter:
+		kind, entries = snapshotKindTrie, encodeTrie(f)
+	case *rangesFilter:
+		kind, entries = snapshotKindRanges, encodeRanges(f)
+		v4Count = uint32(len(f.v4))
+	default:
+		return fmt.Errorf("snapshots of %T are not supported", f)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(snapshotHeaderSize + len(entries) + 4)
+	buf.WriteString(snapshotMagic)
+	header := make([]byte, snapshotHeaderSize-len(snapshotMagic))
+	binary.LittleEndian.PutUint16(header[0:], snapshotVersion)
+	binary.LittleEndian.PutUint16(header[2:], kind)
+	copy(header[4:36], fingerprint[:])
+	binary.LittleEndian.PutUint32(header[36:], uint32(len(entries)/snapshotEntrySize))
+	binary.LittleEndian.PutUint32(header[40:], v4Count)
+	buf.Write(header)
+	buf.Write(entries)
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(buf.Bytes(), crc32c))
+	buf.Write(sum[:])
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// encodeTrie returns the entries of the nodes of tf.
+func encodeTrie(tf *trieFilter) []byte {
+	var nodes []byte
+	var encode func(n *trieNode) uint32
+	encode = func(n *trieNode) uint32 {
+		index := uint32(len(nodes) / snapshotEntrySize)
+		nodes = append(nodes, make([]byte, snapshotEntrySize)...)
+		entry := nodes[index*snapshotEntrySize:]
+		if n.isLeaf {
+			// networks under a leaf are covered by it.
+			binary.LittleEndian.PutUint32(entry, leafMark)
+			binary.LittleEndian.PutUint32(entry[4:], leafMark)
+			return index
+		}
+		var zero, one uint32
+		if n.zero != nil {
+			zero = encode(n.zero)
+		}
+		if n.one != nil {
+			one = encode(n.one)
+		}
+		// nodes may have grown.
+		entry = nodes[index*snapshotEntrySize:]
+		binary.LittleEndian.PutUint32(entry, zero)
+		binary.LittleEndian.PutUint32(entry[4:], one)
+		return index
+	}
+	encode(tf.trie)
+	return nodes
+}
+
+// encodeRanges returns the entries of the IPv4 and then IPv6 ranges of rf.
+func encodeRanges(rf *rangesFilter) []byte {
+	entries := make([]byte, snapshotEntrySize*(len(rf.v4)+4*len(rf.v6)))
+	b := entries
+	for _, r := range rf.v4 {
+		binary.LittleEndian.PutUint32(b, r.start)
+		binary.LittleEndian.PutUint32(b[4:], r.end)
+		b = b[snapshotEntrySize:]
+	}
+	for _, s := range rf.v6 {
+		binary.LittleEndian.PutUint64(b, s.start.hi)
+		binary.LittleEndian.PutUint64(b[8:], s.start.lo)
+		binary.LittleEndian.PutUint64(b[16:], s.end.hi)
+		binary.LittleEndian.PutUint64(b[24:], s.end.lo)
+		b = b[4*snapshotEntrySize:]
+	}
+	return entries
+}
+
+// LoadSnapshot parses a snapshot from data, which is referenced by the
+// returned filter rather than copied.
+func LoadSnapshot(data []byte) (*Snapshot, error) {
+	if len(data) < snapshotHeaderSize+4 || string(data[:4]) != snapshotMagic {
+		return nil, errors.New("not a snapshot")
+	}
+	if v := binary.LittleEndian.Uint16(data[4:]); v != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	kind := binary.LittleEndian.Uint16(data[6:])
+	if kind != snapshotKindTrie && kind != snapshotKindRanges {
+		return nil, fmt.Errorf("unsupported snapshot kind %d", kind)
+	}
+	count := uint64(binary.LittleEndian.Uint32(data[40:]))
+	size := snapshotHeaderSize + count*snapshotEntrySize
+	// a trie has at least its root, while ranges may be empty.
+	if count == 0 && kind == snapshotKindTrie || uint64(len(data)) != size+4 {
+		return nil, errors.New("truncated snapshot")
+	}
+	if sum := binary.LittleEndian.Uint32(data[size:]); sum != crc32.Checksum(data[:size], crc32c) {
+		return nil, errors.New("snapshot checksum mismatch")
+	}
+
+	s := &Snapshot{kind: kind}
+	copy(s.fingerprint[:], data[8:40])
+	entries := data[snapshotHeaderSize:size]
+	if kind == snapshotKindRanges {
+		if err := s.loadRanges(entries, uint64(binary.LittleEndian.Uint32(data[44:])), count); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	s.nodes = entries
+	// children always follow their parents, so that lookups never loop or
+	// go out of range.
+	for i := uint32(0); i < uint32(count); i++ {
+		zero, one := s.node(i)
+		if zero == leafMark && one == leafMark {
+			continue
+		}
+		for _, child := range []uint32{zero, one} {
+			if child != 0 && (child <= i || uint64(child) >= count) {
+				return nil, fmt.Errorf("illegal node %d in snapshot", i)
+			}
+		}
+	}
+	return s, nil
+}
+
+// loadRanges splits the entries of ranges into the IPv4 and IPv6 ranges, and
+// checks that the ranges are sorted and disjoint, which binary search relies
+// on.
+func (s *Snapshot) loadRanges(entries []byte, v4Count, count uint64) error {
+	if v4Count > count || (count-v4Count)%4 != 0 {
+		return errors.New("illegal number of ranges in snapshot")
+	}
+	s.v4, s.v6 = entries[:v4Count*snapshotEntrySize], entries[v4Count*snapshotEntrySize:]
+	var prev uint32
+	for i := 0; i < s.v4Len(); i++ {
+		start, end := s.range4(i)
+		if end < start || i > 0 && start <= prev {
+			return fmt.Errorf("illegal IPv4 range %d in snapshot", i)
+		}
+		prev = end
+	}
+	for i := 0; i < s.v6Len(); i++ {
+		r := s.range6(i)
+		if r.end.less(r.start) || i > 0 && !s.range6(i-1).end.less(r.start) {
+			return fmt.Errorf("illegal IPv6 range %d in snapshot", i)
+		}
+	}
+	return nil
+}
+
+// Fingerprint returns the fingerprint of the source of the snapshot.
+func (s *Snapshot) Fingerprint() [32]byte {
+	return s.fingerprint
+}
+
+// Close releases the data of the snapshot. The snapshot must not be used
+// afterwards.
+func (s *Snapshot) Close() error {
+	if s.release == nil {
+		return nil
+	}
+	err := s.release()
+	s.release, s.nodes, s.v4, s.v6 = nil, nil, nil, nil
+	return err
+}
+
+func (s *Snapshot) node(i uint32) (uint32, uint32) {
+	entry := s.nodes[i*snapshotEntrySize:]
+	return binary.LittleEndian.Uint32(entry), binary.LittleEndian.Uint32(entry[4:])
+}
+
+func (s *Snapshot) v4Len() int {
+	return len(s.v4) / snapshotEntrySize
+}
+
+func (s *Snapshot) range4(i int) (uint32, uint32) {
+	entry := s.v4[i*snapshotEntrySize:]
+	return binary.LittleEndian.Uint32(entry), binary.LittleEndian.Uint32(entry[4:])
+}
+
+func (s *Snapshot) v6Len() int {
+	return len(s.v6) / (4 * snapshotEntrySize)
+}
+
+func (s *Snapshot) range6(i int) span {
+	entry := s.v6[i*4*snapshotEntrySize:]
+	return span{
+		uint128{binary.LittleEndian.Uint64(entry), binary.LittleEndian.Uint64(entry[8:])},
+		uint128{binary.LittleEndian.Uint64(entry[16:]), binary.LittleEndian.Uint64(entry[24:])},
+	}
+}
+
+func (s *Snapshot) Add(net.IPNet) error {
+	return ErrReadOnly
+}
+
+func (s *Snapshot) Contains(ip net.IP) bool {
+	a, ok := AddrFromIP(ip)
+	return ok && s.ContainsAddr(a)
+}
+
+func (s *Snapshot) ContainsAddr(a Addr) bool {
+	if s.kind == snapshotKindRanges {
+		return s.rangesContain(a)
+	}
+	// skip IPv6 as trie does.
+	if !a.Is4() {
+		return false
+	}
+	ipNum := a.uint32()
+	var i uint32
+	for {
+		zero, one := s.node(i)
+		if zero == leafMark && one == leafMark {
+			return true
+		}
+		if ipNum&0x80000000 != 0 {
+			i = one
+		} else {
+			i = zero
+		}
+		if i == 0 {
+			return false
+		}
+		ipNum <<= 1
+	}
+}
+
+// rangesContain looks up a in the ranges by binary search, as rangesFilter
+// does.
+func (s *Snapshot) rangesContain(a Addr) bool {
+	if a.Is4() {
+		x := a.uint32()
+		lo, hi := 0, s.v4Len()
+		for lo < hi {
+			mid := int(uint(lo+hi) >> 1)
+			if _, end := s.range4(mid); end < x {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if lo == s.v4Len() {
+			return false
+		}
+		start, _ := s.range4(lo)
+		return start <= x
+	}
+	x := uint128FromBytes(a[:])
+	lo, hi := 0, s.v6Len()
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if s.range6(mid).end.less(x) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo < s.v6Len() && !x.less(s.range6(lo).start)
+}
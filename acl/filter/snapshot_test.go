@@ -0,0 +1,180 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func snapshotOf(t *testing.T, nets []string) []byte {
+	return snapshotOfKind(t, "trie", nets)
+}
+
+func snapshotOfKind(t *testing.T, kind string, nets []string) []byte {
+	var subnets []net.IPNet
+	for _, n := range nets {
+		subnets = append(subnets, mustParseCIDR(t, n))
+	}
+	f, err := New(kind, subnets)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, f, [32]byte{1, 2, 3}); err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshot(t *testing.T) {
+	nets := []string{"10.0.0.0/8", "10.1.0.0/16", "172.16.0.0/12", "192.168.1.1/32", "192.168.1.2/31", "203.0.113.0/24"}
+	var subnets []net.IPNet
+	for _, n := range nets {
+		subnets = append(subnets, mustParseCIDR(t, n))
+	}
+	trie, err := New("trie", subnets)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	s, err := LoadSnapshot(snapshotOf(t, nets))
+	if err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+	if got := s.Fingerprint(); got != [32]byte{1, 2, 3} {
+		t.Errorf("Snapshot.Fingerprint() = %v", got)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	addrs := []string{"10.0.0.0", "10.255.255.255", "11.0.0.0", "192.168.1.0", "192.168.1.1", "192.168.1.3", "192.168.1.4", "2001:db8::1"}
+	for i := 0; i < 10000; i++ {
+		addrs = append(addrs, net.IPv4(byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))).String())
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if got, want := s.Contains(ip), trie.Contains(ip); got != want {
+			t.Fatalf("Snapshot.Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	if err := s.Add(mustParseCIDR(t, "10.0.0.0/8")); err != ErrReadOnly {
+		t.Errorf("Snapshot.Add() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err := WriteSnapshot(ioutil.Discard, &naiveFilter{}, [32]byte{}); err == nil {
+		t.Errorf("WriteSnapshot() accepts a naive filter")
+	}
+}
+
+func TestSnapshot_ranges(t *testing.T) {
+	nets := []string{"10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8", "192.168.1.1/32", "2001:db8::/32", "2001:db9::/48", "fc00::/7", "::ffff:0:0/96"}
+	var subnets []net.IPNet
+	for _, n := range nets {
+		subnets = append(subnets, mustParseCIDR(t, n))
+	}
+	ranges, err := New("ranges", subnets)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	s, err := LoadSnapshot(snapshotOfKind(t, "ranges", nets))
+	if err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	addrs := []string{"9.255.255.255", "10.0.0.0", "11.255.255.255", "12.0.0.0", "192.168.1.1", "2001:db8::1", "2001:db9:0:ffff::1", "2001:db9:1::1", "fdff::1", "fe00::"}
+	for i := 0; i < 10000; i++ {
+		ip := make(net.IP, net.IPv6len)
+		r.Read(ip)
+		if i%2 == 0 {
+			ip[0] = 0x20
+		}
+		addrs = append(addrs, ip.String(), net.IPv4(byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))).String())
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if got, want := s.Contains(ip), ranges.Contains(ip); got != want {
+			t.Fatalf("Snapshot.Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	empty, err := LoadSnapshot(snapshotOfKind(t, "ranges", nil))
+	if err != nil {
+		t.Fatalf("LoadSnapshot() of empty ranges error = %v", err)
+	}
+	if empty.Contains(net.ParseIP("10.0.0.1")) || empty.Contains(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Snapshot.Contains() of empty ranges = true")
+	}
+}
+
+func TestLoadSnapshot_illegal(t *testing.T) {
+	data := snapshotOf(t, []string{"10.0.0.0/8", "192.168.0.0/16"})
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), data...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Empty", nil},
+		{"Bad magic", corrupt(func(b []byte) []byte { b[0] = 'X'; return b })},
+		{"Bad version", corrupt(func(b []byte) []byte { binary.LittleEndian.PutUint16(b[4:], 2); return b })},
+		{"Bad kind", corrupt(func(b []byte) []byte { binary.LittleEndian.PutUint16(b[6:], 9); return b })},
+		{"Truncated", corrupt(func(b []byte) []byte { return b[:len(b)-snapshotEntrySize] })},
+		{"Bad checksum", corrupt(func(b []byte) []byte { b[snapshotHeaderSize]++; return b })},
+	}
+	ranges := snapshotOfKind(t, "ranges", []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"})
+	corruptRanges := func(f func(b []byte)) []byte {
+		b := append([]byte(nil), ranges...)
+		f(b)
+		size := len(b) - 4
+		binary.LittleEndian.PutUint32(b[size:], crc32.Checksum(b[:size], crc32c))
+		return b
+	}
+	tests = append(tests, []struct {
+		name string
+		data []byte
+	}{
+		{"Bad number of IPv4 ranges", corruptRanges(func(b []byte) { binary.LittleEndian.PutUint32(b[44:], 3) })},
+		{"Unsorted IPv4 ranges", corruptRanges(func(b []byte) { binary.LittleEndian.PutUint32(b[snapshotHeaderSize+8:], 1) })},
+		{"Reversed IPv6 range", corruptRanges(func(b []byte) { binary.LittleEndian.PutUint64(b[snapshotHeaderSize+16:], 0x3000000000000000) })},
+	}...)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadSnapshot(tt.data); err == nil {
+				t.Errorf("LoadSnapshot() accepts illegal data")
+			}
+		})
+	}
+}
+
+func TestOpenSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "nets.snapshot")
+	if _, err := OpenSnapshot(name); !os.IsNotExist(err) {
+		t.Errorf("OpenSnapshot() error = %v, want not exist", err)
+	}
+	if err := ioutil.WriteFile(name, snapshotOf(t, []string{"10.0.0.0/8"}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSnapshot(name)
+	if err != nil {
+		t.Fatalf("OpenSnapshot() error = %v", err)
+	}
+	if !s.Contains(net.ParseIP("10.1.2.3")) || s.Contains(net.ParseIP("11.1.2.3")) {
+		t.Errorf("Snapshot.Contains() mismatches the networks written")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Snapshot.Close() error = %v", err)
+	}
+}
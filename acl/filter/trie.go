@@ -45,7 +45,14 @@ func insert(root *trieNode, subnet net.IPNet) {
 }
 
 func find(root *trieNode, ip net.IP) bool {
-	ipNum := binary.BigEndian.Uint32(ip.To4())
+	// skip IPv6.
+	if len(ip.To4()) == 0 {
+		return false
+	}
+	return findUint32(root, binary.BigEndian.Uint32(ip.To4()))
+}
+
+func findUint32(root *trieNode, ipNum uint32) bool {
 	curr := root
 	for curr != nil {
 		if curr.isLeaf {
@@ -72,6 +79,14 @@ func (tf *trieFilter) Contains(ip net.IP) bool {
 	return find(tf.trie, ip)
 }
 
+func (tf *trieFilter) ContainsAddr(a Addr) bool {
+	// skip IPv6.
+	if !a.Is4() {
+		return false
+	}
+	return findUint32(tf.trie, a.uint32())
+}
+
 func newTrieFilter(subnets []net.IPNet) (*trieFilter, error) {
 	trie := &trieNode{}
 	for _, subnet := range subnets {
@@ -0,0 +1,144 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+)
+
+// ValueTrie maps IPv4 and IPv6 prefixes to values. Unlike Filter, which only
+// tells whether an address is contained, it finds the values of the prefixes
+// containing an address, e.g., for longest prefix matching.
+type ValueTrie struct {
+	v4 valueNode
+	v6 valueNode
+}
+
+type valueNode struct {
+	children [2]*valueNode
+	value    interface{}
+	set      bool
+}
+
+// NewValueTrie creates an empty ValueTrie.
+func NewValueTrie() *ValueTrie {
+	return &ValueTrie{}
+}
+
+// Insert associates value with subnet, replacing the value associated with
+// it before, if any.
+func (t *ValueTrie) Insert(subnet net.IPNet, value interface{}) error {
+	root, ip, ones, err := t.prefix(subnet)
+	if err != nil {
+		return err
+	}
+	curr := root
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if curr.children[b] == nil {
+			curr.children[b] = &valueNode{}
+		}
+		curr = curr.children[b]
+	}
+	curr.value, curr.set = value, true
+	return nil
+}
+
+// Get returns the value associated with exactly subnet.
+func (t *ValueTrie) Get(subnet net.IPNet) (interface{}, bool) {
+	root, ip, ones, err := t.prefix(subnet)
+	if err != nil {
+		return nil, false
+	}
+	curr := root
+	for i := 0; i < ones && curr != nil; i++ {
+		curr = curr.children[bit(ip, i)]
+	}
+	if curr == nil || !curr.set {
+		return nil, false
+	}
+	return curr.value, true
+}
+
+// Longest returns the value of the longest prefix containing a.
+func (t *ValueTrie) Longest(a Addr) (interface{}, bool) {
+	var value interface{}
+	found := false
+	root, ip := t.root(a)
+	curr := root
+	for i := 0; curr != nil; i++ {
+		if curr.set {
+			value, found = curr.value, true
+		}
+		if i == 8*len(ip) {
+			break
+		}
+		curr = curr.children[bit(ip, i)]
+	}
+	return value, found
+}
+
+// Matches appends the values of all prefixes containing a to values, from
+// the longest prefix to the shortest, and returns the extended slice.
+func (t *ValueTrie) Matches(a Addr, values []interface{}) []interface{} {
+	start := len(values)
+	root, ip := t.root(a)
+	curr := root
+	for i := 0; curr != nil; i++ {
+		if curr.set {
+			values = append(values, curr.value)
+		}
+		if i == 8*len(ip) {
+			break
+		}
+		curr = curr.children[bit(ip, i)]
+	}
+	for i, j := start, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+	return values
+}
+
+// root returns the root of the address family of a, along with the bytes of
+// a in the family.
+func (t *ValueTrie) root(a Addr) (*valueNode, []byte) {
+	if a.Is4() {
+		return &t.v4, a[12:]
+	}
+	return &t.v6, a[:]
+}
+
+// prefix returns the root of the address family of subnet, along with the
+// bytes of the subnet in the family and its prefix length.
+func (t *ValueTrie) prefix(subnet net.IPNet) (*valueNode, []byte, int, error) {
+	ip, ones, err := family(subnet)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if len(ip) == net.IPv4len {
+		return &t.v4, ip, ones, nil
+	}
+	return &t.v6, ip, ones, nil
+}
+
+// family returns the bytes of subnet in its address family, i.e., 4 bytes
+// for IPv4 and 16 bytes for IPv6, along with its prefix length.
+func family(subnet net.IPNet) (net.IP, int, error) {
+	ones, bits := subnet.Mask.Size()
+	if ip := subnet.IP.To4(); ip != nil {
+		switch {
+		case bits == 8*net.IPv4len:
+			return ip, ones, nil
+		case bits == 8*net.IPv6len && ones >= 96:
+			// an IPv4 subnet with a 16-byte mask.
+			return ip, ones - 96, nil
+		}
+	} else if ip := subnet.IP.To16(); ip != nil && bits == 8*net.IPv6len {
+		return ip, ones, nil
+	}
+	return nil, 0, fmt.Errorf("illegal subnet: %v", subnet)
+}
+
+// bit returns the i-th bit of ip, from the most significant one.
+func bit(ip []byte, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,78 @@
+package filter
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+func mustAddr(t *testing.T, s string) Addr {
+	a, ok := AddrFromIP(net.ParseIP(s))
+	if !ok {
+		t.Fatalf("illegal address %s", s)
+	}
+	return a
+}
+
+func TestValueTrie(t *testing.T) {
+	trie := NewValueTrie()
+	for _, prefix := range []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.3/32", "2001:db8::/32", "::/0"} {
+		if err := trie.Insert(mustParseCIDR(t, prefix), prefix); err != nil {
+			t.Fatalf("ValueTrie.Insert() error = %v", err)
+		}
+	}
+	// replaces the value.
+	if err := trie.Insert(mustParseCIDR(t, "10.1.0.0/16"), "10.1/16"); err != nil {
+		t.Fatalf("ValueTrie.Insert() error = %v", err)
+	}
+
+	tests := []struct {
+		addr        string
+		wantLongest interface{}
+		wantMatches []interface{}
+	}{
+		{"10.1.2.3", "10.1.2.3/32", []interface{}{"10.1.2.3/32", "10.1/16", "10.0.0.0/8", "0.0.0.0/0"}},
+		{"10.1.2.4", "10.1/16", []interface{}{"10.1/16", "10.0.0.0/8", "0.0.0.0/0"}},
+		{"10.2.0.1", "10.0.0.0/8", []interface{}{"10.0.0.0/8", "0.0.0.0/0"}},
+		{"192.168.0.1", "0.0.0.0/0", []interface{}{"0.0.0.0/0"}},
+		{"2001:db8::1", "2001:db8::/32", []interface{}{"2001:db8::/32", "::/0"}},
+		{"2001:db9::1", "::/0", []interface{}{"::/0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			a := mustAddr(t, tt.addr)
+			if got, ok := trie.Longest(a); !ok || got != tt.wantLongest {
+				t.Errorf("ValueTrie.Longest() = %v, %v, want %v", got, ok, tt.wantLongest)
+			}
+			if got := trie.Matches(a, nil); !reflect.DeepEqual(got, tt.wantMatches) {
+				t.Errorf("ValueTrie.Matches() = %v, want %v", got, tt.wantMatches)
+			}
+		})
+	}
+
+	if got, ok := trie.Get(mustParseCIDR(t, "10.1.0.0/16")); !ok || got != "10.1/16" {
+		t.Errorf("ValueTrie.Get() = %v, %v, want 10.1/16", got, ok)
+	}
+	if _, ok := trie.Get(mustParseCIDR(t, "10.1.0.0/24")); ok {
+		t.Errorf("ValueTrie.Get() found a prefix never inserted")
+	}
+	if err := trie.Insert(net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 16)}, nil); err == nil {
+		t.Errorf("ValueTrie.Insert() accepts an illegal mask")
+	}
+
+	empty := NewValueTrie()
+	if _, ok := empty.Longest(mustAddr(t, "10.0.0.1")); ok {
+		t.Errorf("ValueTrie.Longest() finds a value in an empty trie")
+	}
+	if got := empty.Matches(mustAddr(t, "10.0.0.1"), nil); len(got) != 0 {
+		t.Errorf("ValueTrie.Matches() = %v, want none", got)
+	}
+}
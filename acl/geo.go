@@ -0,0 +1,181 @@
+package acl
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy"
+	"github.com/ihac/acl/acl/filter"
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	// defaultGeoCacheSize is the default number of client prefixes whose
+	// countries are cached.
+	defaultGeoCacheSize = 10000
+	// geoV4Prefix and geoV6Prefix are the lengths of the client prefixes
+	// which lookups are cached by.
+	geoV4Prefix = 24
+	geoV6Prefix = 48
+)
+
+// geoDB looks up the countries of clients in a local MaxMind database, e.g.,
+// GeoLite2-Country. Lookups are cached by client prefix in an LRU list, and
+// the database is reopened once the file changes.
+type geoDB struct {
+	name string
+	size int
+
+	mu     sync.Mutex
+	reader *maxminddb.Reader
+	cache  map[filter.Addr]*list.Element
+	lru    *list.List
+}
+
+type geoEntry struct {
+	key     filter.Addr
+	country string
+}
+
+// geoRecord is the part of a record of the database which is decoded.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	// RegisteredCountry is taken if the country is unknown, e.g., for
+	// anycast networks.
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+func newGeoDB(name string) (*geoDB, error) {
+	db := &geoDB{name: name, size: defaultGeoCacheSize}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// load (re)opens the database, and drops the cached lookups.
+func (db *geoDB) load() error {
+	reader, err := maxminddb.Open(db.name)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	old := db.reader
+	db.reader = reader
+	db.cache = make(map[filter.Addr]*list.Element)
+	db.lru = list.New()
+	db.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// close closes the database. All countries are unknown afterwards.
+func (db *geoDB) close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.reader == nil {
+		return nil
+	}
+	err := db.reader.Close()
+	db.reader = nil
+	return err
+}
+
+// country returns the ISO code of the country of a, or "" if unknown.
+func (db *geoDB) country(a filter.Addr) string {
+	key := geoKey(a)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if e, ok := db.cache[key]; ok {
+		db.lru.MoveToFront(e)
+		return e.Value.(*geoEntry).country
+	}
+
+	var record geoRecord
+	country := ""
+	// lookup errors, e.g., of corrupt databases, leave the country unknown.
+	if db.reader == nil {
+		return ""
+	}
+	if err := db.reader.Lookup(a.IP(), &record); err == nil {
+		country = record.Country.ISOCode
+		if country == "" {
+			country = record.RegisteredCountry.ISOCode
+		}
+	}
+	if db.lru.Len() >= db.size {
+		oldest := db.lru.Back()
+		db.lru.Remove(oldest)
+		delete(db.cache, oldest.Value.(*geoEntry).key)
+	}
+	db.cache[key] = db.lru.PushFront(&geoEntry{key: key, country: country})
+	return country
+}
+
+// geoKey masks a with the length of the client prefixes.
+func geoKey(a filter.Addr) filter.Addr {
+	ones := geoV6Prefix
+	if a.Is4() {
+		ones = 96 + geoV4Prefix
+	}
+	for i := ones / 8; i < len(a); i++ {
+		a[i] = 0
+	}
+	return a
+}
+
+// geoMatcher matches clients by their countries.
+type geoMatcher struct {
+	// db is the database of the rule, which is set once the rule is parsed.
+	db        *geoDB
+	countries []string
+	// negate matches clients outside of the countries, including those
+	// whose countries are unknown.
+	negate bool
+}
+
+// parseGeo parses the countries of a 'geo' clause, i.e., ISO 3166-1 alpha-2
+// codes separated by commas or spaces, which are negated by a leading '!'.
+func parseGeo(c *caddy.Controller, values []string) (*geoMatcher, error) {
+	g := &geoMatcher{}
+	raw := strings.Join(values, ",")
+	if strings.HasPrefix(raw, "!") {
+		g.negate = true
+		raw = raw[1:]
+	}
+	for _, code := range strings.Split(raw, ",") {
+		if code == "" {
+			continue
+		}
+		if len(code) != 2 || !isLetters(code) {
+			return nil, c.Errf("Illegal country code '%s'", code)
+		}
+		g.countries = append(g.countries, strings.ToUpper(code))
+	}
+	if len(g.countries) == 0 {
+		return nil, c.ArgErr()
+	}
+	return g, nil
+}
+
+func isLetters(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// matches reports whether the client of the query is matched.
+func (g *geoMatcher) matches(q *query) bool {
+	return containsString(g.countries, g.db.country(q.ip)) != g.negate
+}
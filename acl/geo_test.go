@@ -0,0 +1,253 @@
+package acl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// mmdbNode is a node of the search tree of a test MaxMind database. Each
+// record holds either a child or the offset of a data record.
+type mmdbNode struct {
+	children [2]*mmdbNode
+	data     [2]int
+	index    int
+}
+
+// writeTestMMDB writes an IPv6 MaxMind database with 24-bit records, which
+// maps the networks to records of their values written by encode. Networks
+// must not nest, and IPv4 networks are inserted into ::/96 as MaxMind does.
+func writeTestMMDB(t *testing.T, name string, values map[string]string, encode func(buf *bytes.Buffer, value string)) {
+	root := &mmdbNode{data: [2]int{-1, -1}}
+	var data bytes.Buffer
+	offsets := map[string]int{}
+	for cidr, value := range values {
+		ip, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, bits := n.Mask.Size()
+		ip = ip.To16()
+		if bits == 32 {
+			ip, ones = append(make(net.IP, 12), n.IP.To4()...), ones+96
+		}
+		if _, ok := offsets[value]; !ok {
+			offsets[value] = data.Len()
+			encode(&data, value)
+		}
+		curr := root
+		for i := 0; i < ones-1; i++ {
+			b := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if curr.children[b] == nil {
+				curr.children[b] = &mmdbNode{data: [2]int{-1, -1}}
+			}
+			curr = curr.children[b]
+		}
+		curr.data[int(ip[(ones-1)/8]>>(7-uint((ones-1)%8)))&1] = offsets[value]
+	}
+
+	var nodes []*mmdbNode
+	var number func(n *mmdbNode)
+	number = func(n *mmdbNode) {
+		n.index = len(nodes)
+		nodes = append(nodes, n)
+		for _, child := range n.children {
+			if child != nil {
+				number(child)
+			}
+		}
+	}
+	number(root)
+
+	var db bytes.Buffer
+	count := len(nodes)
+	for _, n := range nodes {
+		for b := 0; b < 2; b++ {
+			record := count // empty.
+			if n.children[b] != nil {
+				record = n.children[b].index
+			} else if n.data[b] >= 0 {
+				record = count + 16 + n.data[b]
+			}
+			db.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.WriteString("\xAB\xCD\xEFMaxMind.com")
+	mmdbMap(&db, 6)
+	mmdbString(&db, "node_count")
+	mmdbUint(&db, 6, uint64(count))
+	mmdbString(&db, "record_size")
+	mmdbUint(&db, 5, 24)
+	mmdbString(&db, "ip_version")
+	mmdbUint(&db, 5, 6)
+	mmdbString(&db, "database_type")
+	mmdbString(&db, "Test")
+	mmdbString(&db, "binary_format_major_version")
+	mmdbUint(&db, 5, 2)
+	mmdbString(&db, "binary_format_minor_version")
+	mmdbUint(&db, 5, 0)
+
+	if err := ioutil.WriteFile(name, db.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mmdbCountry writes a record of a country database.
+func mmdbCountry(buf *bytes.Buffer, country string) {
+	mmdbMap(buf, 1)
+	mmdbString(buf, "country")
+	mmdbMap(buf, 1)
+	mmdbString(buf, "iso_code")
+	mmdbString(buf, country)
+}
+
+func mmdbMap(buf *bytes.Buffer, size int) {
+	buf.WriteByte(7<<5 | byte(size))
+}
+
+func mmdbString(buf *bytes.Buffer, s string) {
+	buf.WriteByte(2<<5 | byte(len(s)))
+	buf.WriteString(s)
+}
+
+// mmdbUint writes v of a type, i.e., 5 for uint16 and 6 for uint32.
+func mmdbUint(buf *bytes.Buffer, typ byte, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	i := 0
+	for i < len(b) && b[i] == 0 {
+		i++
+	}
+	buf.WriteByte(typ<<5 | byte(len(b)-i))
+	buf.Write(b[i:])
+}
+
+var geoTestCountries = map[string]string{
+	"1.0.0.0/8":     "US",
+	"2.0.0.0/8":     "CA",
+	"3.0.0.0/8":     "DE",
+	"2001:db8::/32": "US",
+}
+
+func Test_acl_ServeDNS_geo(t *testing.T) {
+	writeTestMMDB(t, "acl-test-geo.mmdb", geoTestCountries, mmdbCountry)
+	defer os.Remove("acl-test-geo.mmdb")
+
+	a, err := parseACL(caddy.NewTestController("dns", `acl example.org {
+		geoip acl-test-geo.mmdb
+		allow type ANY net 3.1.0.0/16
+		block type MX geo de net 3.2.0.0/16
+		block type ANY geo !US,CA
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	tests := []struct {
+		name      string
+		source    string
+		qtype     uint16
+		wantRcode int
+	}{
+		{"Listed country", "1.2.3.4", dns.TypeA, dns.RcodeSuccess},
+		{"Other listed country", "2.2.3.4", dns.TypeA, dns.RcodeSuccess},
+		{"IPv6 listed country", "2001:db8::1", dns.TypeA, dns.RcodeSuccess},
+		{"Country not listed", "3.3.3.4", dns.TypeA, dns.RcodeRefused},
+		{"Unknown country", "4.3.2.1", dns.TypeA, dns.RcodeRefused},
+		{"Unknown IPv6 country", "2001:db9::1", dns.TypeA, dns.RcodeRefused},
+		{"Allowed before", "3.1.2.3", dns.TypeA, dns.RcodeSuccess},
+		{"Country and network", "3.2.0.1", dns.TypeMX, dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testResponseWriter{}
+			w.setRemoteIP(tt.source)
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.org.", tt.qtype)
+			if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_geoDB(t *testing.T) {
+	writeTestMMDB(t, "acl-test-geo.mmdb", geoTestCountries, mmdbCountry)
+	defer os.Remove("acl-test-geo.mmdb")
+
+	db, err := newGeoDB("acl-test-geo.mmdb")
+	if err != nil {
+		t.Fatalf("newGeoDB() error = %v", err)
+	}
+	db.size = 2
+
+	if got := db.country(testAddr("1.2.3.4")); got != "US" {
+		t.Errorf("geoDB.country() = %v, want US", got)
+	}
+	// cached by the client prefix.
+	if _, ok := db.cache[geoKey(testAddr("1.2.3.200"))]; !ok {
+		t.Errorf("geoDB.country() is not cached by the client prefix")
+	}
+	db.country(testAddr("2.2.3.4"))
+	db.country(testAddr("2001:db8::1"))
+	if len(db.cache) != 2 {
+		t.Errorf("geoDB caches %d lookups, want 2", len(db.cache))
+	}
+	if _, ok := db.cache[geoKey(testAddr("1.2.3.4"))]; ok {
+		t.Errorf("geoDB keeps the least recently used lookup")
+	}
+
+	// the database is reloaded with its lookups.
+	writeTestMMDB(t, "acl-test-geo.mmdb", map[string]string{"1.0.0.0/8": "FR"}, mmdbCountry)
+	if err := db.load(); err != nil {
+		t.Fatalf("geoDB.load() error = %v", err)
+	}
+	if got := db.country(testAddr("1.2.3.4")); got != "FR" {
+		t.Errorf("geoDB.country() after reload = %v, want FR", got)
+	}
+	if got := db.country(testAddr("2.2.3.4")); got != "" {
+		t.Errorf("geoDB.country() after reload = %v, want none", got)
+	}
+}
+
+func Test_setup_geo(t *testing.T) {
+	writeTestMMDB(t, "acl-test-geo.mmdb", geoTestCountries, mmdbCountry)
+	defer os.Remove("acl-test-geo.mmdb")
+
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"Countries", "geoip acl-test-geo.mmdb\nblock type ANY geo US CA", false},
+		{"Negated countries", "geoip acl-test-geo.mmdb\nblock type ANY geo !us,ca net 10.0.0.0/8", false},
+		{"Database after policies", "block type ANY geo US\ngeoip acl-test-geo.mmdb", false},
+		{"No database", "block type ANY geo US", true},
+		{"Missing database", "geoip acl-test-missing.mmdb", true},
+		{"Database twice", "geoip acl-test-geo.mmdb\ngeoip acl-test-geo.mmdb", true},
+		{"Illegal country", "geoip acl-test-geo.mmdb\nblock type ANY geo USA", true},
+		{"No country", "geoip acl-test-geo.mmdb\nblock type ANY geo !", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseACL(caddy.NewTestController("dns", "acl {\n"+tt.config+"\n}"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseACL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package acl
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/ihac/acl/acl/filter"
+)
+
+const (
+	// lintOff disables lint.
+	lintOff = "off"
+	// lintWarn logs lint warnings.
+	lintWarn = "warn"
+	// lintFatal fails the setup on lint warnings.
+	lintFatal = "fatal"
+
+	// maxSourceWarnings is the maximum number of warnings reported for the
+	// networks of a source, which may be loaded from large files.
+	maxSourceWarnings = 10
+)
+
+// anyNets stands for the networks of a policy matching any source, which
+// 'net ANY' expands to.
+var anyNets = []net.IPNet{
+	{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+	{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+}
+
+// lint checks the policies of a rule for likely mistakes, i.e., policies
+// shadowed by earlier ones, duplicate or nested networks, non-canonical
+// CIDRs and empty network files. It returns the warnings found.
+func lint(rule Rule) []string {
+	var warnings []string
+
+	// policies from policy files are checked as if they were in place.
+	var policies []Policy
+	for _, p := range rule.Policies {
+		if p.file != nil {
+			policies = append(policies, p.file.Policies()...)
+			continue
+		}
+		policies = append(policies, p)
+	}
+
+	nets := make([][]net.IPNet, len(policies))
+	linted := make(map[*source]bool)
+	for i, p := range policies {
+		if p.src == nil {
+			nets[i] = anyNets
+			continue
+		}
+		var ws []string
+		nets[i], ws = lintSource(p.src)
+		// policies of multiple qtypes from policy files share a source.
+		if linted[p.src] {
+			continue
+		}
+		linted[p.src] = true
+		for _, w := range ws {
+			warnings = append(warnings, fmt.Sprintf("policy '%s': %s", p.text, w))
+		}
+	}
+
+	if rule.prefixes != nil {
+		// policies are not evaluated in order.
+		return warnings
+	}
+	sets := make([]map[string]bool, len(policies))
+	for i, p := range policies {
+		if p.src != nil && p.src.cached() {
+			// networks of cached files are not loaded by lint.
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if !overrides(policies[j], p) {
+				continue
+			}
+			if sets[j] == nil {
+				sets[j] = netSet(nets[j])
+			}
+			if coversAll(sets[j], nets[i]) {
+				warnings = append(warnings, fmt.Sprintf("policy '%s' is shadowed by '%s'", p.text, policies[j].text))
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+// overrides reports whether policy a decides all queries matched by policy b,
+// regardless of their sources.
+func overrides(a, b Policy) bool {
+	// truncate and ratelimit let some queries go on to the next policy.
+	if a.action != ALLOW && a.action != BLOCK {
+		return false
+	}
+	if a.qtype != QtypeAll && a.qtype != b.qtype {
+		return false
+	}
+	if a.domains != nil || a.ecs != nil || a.local != nil || a.schedule != nil || a.exception != nil || a.geo != nil || a.asn != nil || a.tunnel != nil || a.flags != nil || a.edns != nil {
+		return false
+	}
+	if len(a.protos) > 0 {
+		if len(b.protos) == 0 {
+			return false
+		}
+		for _, proto := range b.protos {
+			if !containsString(a.protos, proto) {
+				return false
+			}
+		}
+	}
+	if len(a.opcodes) > 0 {
+		if len(b.opcodes) == 0 {
+			return false
+		}
+		for _, opcode := range b.opcodes {
+			if !containsInt(a.opcodes, opcode) {
+				return false
+			}
+		}
+	}
+	if len(a.classes) > 0 {
+		if len(b.classes) == 0 {
+			return false
+		}
+		for _, class := range b.classes {
+			if !containsUint16(a.classes, class) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lintSource loads the networks of a source, and checks them for empty
+// network files, non-canonical CIDRs, and duplicate or nested networks.
+func lintSource(src *source) ([]net.IPNet, []string) {
+	var warnings []string
+	// networks expanded from keywords, e.g., addresses of local interfaces,
+	// are not expected to be canonical.
+	literals := make(map[string]bool, len(src.literals))
+	for _, rawNet := range src.literals {
+		literals[rawNet] = true
+	}
+	rawNets := append([]string(nil), src.nets...)
+	for _, nf := range src.files {
+		if nf.cache {
+			// reading cached files is what their snapshots avoid.
+			continue
+		}
+		files, err := nf.expand()
+		if err != nil {
+			// reported by the setup.
+			continue
+		}
+		if len(files) == 0 {
+			warnings = append(warnings, fmt.Sprintf("no network file in '%s'", nf.pattern))
+		}
+		for _, file := range files {
+			entries, _, err := readNetworkFile(file)
+			if err != nil {
+				continue
+			}
+			if len(entries) == 0 {
+				warnings = append(warnings, fmt.Sprintf("network file '%s' is empty", file))
+			}
+			for _, entry := range entries {
+				literals[entry] = true
+			}
+			rawNets = append(rawNets, entries...)
+		}
+	}
+
+	var nets []net.IPNet
+	var sourceWarnings []string
+	for _, rawNet := range rawNets {
+		ip, n, err := net.ParseCIDR(normalize(rawNet))
+		if err != nil {
+			continue
+		}
+		if literals[rawNet] && !ip.Equal(n.IP) {
+			sourceWarnings = append(sourceWarnings, fmt.Sprintf("non-canonical CIDR '%s'; did you mean '%s'?", rawNet, n))
+		}
+		nets = append(nets, *n)
+	}
+	sourceWarnings = append(sourceWarnings, lintNested(nets)...)
+	if len(sourceWarnings) > maxSourceWarnings {
+		more := len(sourceWarnings) - maxSourceWarnings
+		sourceWarnings = append(sourceWarnings[:maxSourceWarnings], fmt.Sprintf("%d more warnings on networks", more))
+	}
+	if src.exclude != nil {
+		// policies are shadowed by the networks left.
+		if excluded, err := src.exclude.networks(); err == nil {
+			nets, _ = filter.Difference(nets, excluded)
+		}
+	}
+	return nets, append(warnings, sourceWarnings...)
+}
+
+// lintNested checks networks for duplicate or nested ones.
+func lintNested(nets []net.IPNet) []string {
+	sorted := make([]net.IPNet, len(nets))
+	copy(sorted, nets)
+	// networks covering others come first.
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if len(a.IP) != len(b.IP) {
+			return len(a.IP) < len(b.IP)
+		}
+		if c := bytes.Compare(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+		aOnes, _ := a.Mask.Size()
+		bOnes, _ := b.Mask.Size()
+		return aOnes < bOnes
+	})
+
+	var warnings []string
+	var cover *net.IPNet
+	for i := range sorted {
+		n := &sorted[i]
+		// networks are either nested or disjoint.
+		if cover != nil && len(cover.IP) == len(n.IP) && cover.Contains(n.IP) {
+			if cover.String() == n.String() {
+				warnings = append(warnings, fmt.Sprintf("duplicate network '%s'", n))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("network '%s' is covered by '%s'", n, cover))
+			}
+			continue
+		}
+		cover = n
+	}
+	return warnings
+}
+
+// netSet indexes networks by their CIDR notation.
+func netSet(nets []net.IPNet) map[string]bool {
+	set := make(map[string]bool, len(nets))
+	for _, n := range nets {
+		set[n.String()] = true
+	}
+	return set
+}
+
+// coversAll reports whether each of nets is covered by a network in set.
+func coversAll(set map[string]bool, nets []net.IPNet) bool {
+	for _, n := range nets {
+		ones, bits := n.Mask.Size()
+		covered := false
+		for l := ones; l >= 0 && !covered; l-- {
+			mask := net.CIDRMask(l, bits)
+			covered = set[(&net.IPNet{IP: n.IP.Mask(mask), Mask: mask}).String()]
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+package acl
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+)
+
+var lintTestFiles = map[string]string{
+	"acl-test-lint-empty.txt": "# no networks yet\n",
+	"acl-test-lint-nets.txt": `10.0.0.0/8
+10.1.0.0/16
+192.168.0.1/24
+`,
+	"acl-test-lint-policy.yaml": `policies:
+  - {name: block-all, action: block, networks: [ANY]}
+`,
+}
+
+func Test_lint(t *testing.T) {
+	envSetup(lintTestFiles)
+	defer envCleanup(lintTestFiles)
+
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			"Clean",
+			`acl {
+				allow type A net 10.0.0.0/8 proto tcp
+				block type ANY net 10.0.0.0/8
+				truncate type ANY net ANY
+				allow type ANY net 192.168.0.0/16
+				block type ANY domains acl-test-domains.txt
+				block type ANY net LOCAL
+			}`,
+			nil,
+		},
+		{
+			"Shadowed",
+			`acl {
+				block type ANY net ANY
+				allow type A net 10.0.0.0/8
+			}`,
+			[]string{"policy 'allow type A net 10.0.0.0/8' is shadowed by 'block type ANY net ANY'"},
+		},
+		{
+			"Shadowed by subnets",
+			`acl {
+				allow type A net 10.0.0.0/9 10.128.0.0/9
+				block type A net 10.1.0.0/16 10.200.0.0/16 proto udp
+			}`,
+			[]string{"policy 'block type A net 10.1.0.0/16 10.200.0.0/16 proto udp' is shadowed by 'allow type A net 10.0.0.0/9 10.128.0.0/9'"},
+		},
+		{
+			"Shadowed by protocols",
+			`acl {
+				block type ANY net ANY proto udp tcp
+				allow type ANY net 10.0.0.0/8 proto tcp
+				allow type ANY net 10.0.0.0/8
+			}`,
+			[]string{"policy 'allow type ANY net 10.0.0.0/8 proto tcp' is shadowed by 'block type ANY net ANY proto udp tcp'"},
+		},
+		{
+			"Shadowed by opcodes and classes",
+			`acl {
+				block type ANY opcode NOTIFY UPDATE
+				allow type ANY net 192.0.2.1 opcode NOTIFY
+				block type ANY class CH
+				allow type ANY net 10.0.0.0/8 class CH
+				allow type ANY net 10.0.0.0/8
+			}`,
+			[]string{
+				"policy 'allow type ANY net 192.0.2.1 opcode NOTIFY' is shadowed by 'block type ANY opcode NOTIFY UPDATE'",
+				"policy 'allow type ANY net 10.0.0.0/8 class CH' is shadowed by 'block type ANY class CH'",
+			},
+		},
+		{
+			"Shadowed by policy file",
+			`acl {
+				policy_file acl-test-lint-policy.yaml
+				allow type ANY net 10.0.0.0/8
+			}`,
+			[]string{"policy 'allow type ANY net 10.0.0.0/8' is shadowed by 'acl-test-lint-policy.yaml: block-all'"},
+		},
+		{
+			"Not shadowed",
+			`acl {
+				block type A net 10.0.0.0/8
+				allow type AAAA net 10.0.0.0/8
+				block type ANY net 10.0.0.0/8 domains acl-test-domains.txt
+				allow type ANY net 10.1.0.0/16
+				ratelimit 10/s type ANY net ANY
+				allow type ANY net 192.168.0.0/16
+				block type ANY net ANY schedule days sat-sun
+				allow type ANY net 172.16.0.0/12
+				block type ANY net ANY except name corp.
+				allow type ANY net 198.51.100.0/24
+			}`,
+			nil,
+		},
+		{
+			"Domains are not shadowed by IPv4 networks",
+			`acl {
+				block type ANY net 0.0.0.0/0
+				allow type ANY domains acl-test-domains.txt
+			}`,
+			nil,
+		},
+		{
+			"Domains shadowed by any network",
+			`acl {
+				block type ANY net ANY
+				allow type ANY domains acl-test-domains.txt
+			}`,
+			[]string{"policy 'allow type ANY domains acl-test-domains.txt' is shadowed by 'block type ANY net ANY'"},
+		},
+		{
+			"Not shadowed in longest-prefix mode",
+			`acl {
+				match longest-prefix
+				block type ANY net ANY
+				allow type A net 10.0.0.0/8
+			}`,
+			nil,
+		},
+		{
+			"Networks",
+			`acl {
+				block type ANY net 10.0.0.0/8 10.0.0.0/8 10.1.0.0/16 43.105.127.35/18
+			}`,
+			[]string{
+				"policy 'block type ANY net 10.0.0.0/8 10.0.0.0/8 10.1.0.0/16 43.105.127.35/18': non-canonical CIDR '43.105.127.35/18'; did you mean '43.105.64.0/18'?",
+				"policy 'block type ANY net 10.0.0.0/8 10.0.0.0/8 10.1.0.0/16 43.105.127.35/18': duplicate network '10.0.0.0/8'",
+				"policy 'block type ANY net 10.0.0.0/8 10.0.0.0/8 10.1.0.0/16 43.105.127.35/18': network '10.1.0.0/16' is covered by '10.0.0.0/8'",
+			},
+		},
+		{
+			"Network files",
+			`acl {
+				block type ANY file acl-test-lint-nets.txt file acl-test-lint-empty.txt
+			}`,
+			[]string{
+				"policy 'block type ANY file acl-test-lint-nets.txt file acl-test-lint-empty.txt': network file 'acl-test-lint-empty.txt' is empty",
+				"policy 'block type ANY file acl-test-lint-nets.txt file acl-test-lint-empty.txt': non-canonical CIDR '192.168.0.1/24'; did you mean '192.168.0.0/24'?",
+				"policy 'block type ANY file acl-test-lint-nets.txt file acl-test-lint-empty.txt': network '10.1.0.0/16' is covered by '10.0.0.0/8'",
+			},
+		},
+	}
+	envSetup(domainsTestFiles)
+	defer envCleanup(domainsTestFiles)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseACL(caddy.NewTestController("dns", strings.Replace(tt.config, "acl {", "acl {\n lint off", 1)))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			if got := lint(a.Rules[0]); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_lint_manyWarnings(t *testing.T) {
+	var rawNets []string
+	for i := 0; i < 2*maxSourceWarnings; i++ {
+		rawNets = append(rawNets, "10.0.0.1/8")
+	}
+	_, warnings := lintSource(&source{nets: rawNets, literals: rawNets})
+	if len(warnings) != maxSourceWarnings+1 {
+		t.Fatalf("lintSource() returns %d warnings, want %d", len(warnings), maxSourceWarnings+1)
+	}
+	if want := "29 more warnings on networks"; warnings[maxSourceWarnings] != want {
+		t.Errorf("lintSource() = %q, want %q", warnings[maxSourceWarnings], want)
+	}
+}
+
+func Test_coversAll(t *testing.T) {
+	parse := func(rawNets ...string) []net.IPNet {
+		nets, err := parseCIDRs(rawNets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nets
+	}
+
+	tests := []struct {
+		name string
+		set  []net.IPNet
+		nets []net.IPNet
+		want bool
+	}{
+		{"Same", parse("10.0.0.0/8"), parse("10.0.0.0/8"), true},
+		{"Subnet", parse("10.0.0.0/8"), parse("10.1.2.0/24", "10.3.0.0/16"), true},
+		{"Partially", parse("10.0.0.0/8"), parse("10.1.2.0/24", "11.0.0.0/16"), false},
+		{"Supernet", parse("10.0.0.0/9"), parse("10.0.0.0/8"), false},
+		{"Any", parse("0.0.0.0/0"), parse("10.0.0.0/8"), true},
+		{"IPv6", parse("0.0.0.0/0"), anyNets, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coversAll(netSet(tt.set), tt.nets); got != tt.want {
+				t.Errorf("coversAll() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
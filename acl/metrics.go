@@ -20,4 +20,32 @@ var (
 		Name:      "request_allow_count_total",
 		Help:      "Counter of DNS requests being allowed.",
 	}, []string{"server"})
+	// RequestDropCount is the number of DNS requests being dropped.
+	RequestDropCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "dns",
+		Name:      "request_drop_count_total",
+		Help:      "Counter of DNS requests being dropped.",
+	}, []string{"server", "zone"})
+	// RequestTruncateCount is the number of DNS requests being answered with truncated responses.
+	RequestTruncateCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "dns",
+		Name:      "request_truncate_count_total",
+		Help:      "Counter of DNS requests being answered with truncated responses.",
+	}, []string{"server", "zone"})
+	// ResponseBlockCount is the number of records in DNS responses being blocked.
+	ResponseBlockCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "dns",
+		Name:      "response_block_count_total",
+		Help:      "Counter of records in DNS responses being blocked.",
+	}, []string{"server", "zone"})
+	// RPZHitCount is the number of DNS requests or responses matched by Response Policy Zones.
+	RPZHitCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "dns",
+		Name:      "rpz_hit_count_total",
+		Help:      "Counter of DNS requests or responses matched by Response Policy Zones.",
+	}, []string{"server", "zone", "action"})
 )
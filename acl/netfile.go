@@ -0,0 +1,265 @@
+package acl
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// networkFile is a local file, directory or glob pattern which networks are
+// loaded from.
+type networkFile struct {
+	pattern string
+	// skipBadLines skips illegal lines with a warning instead of failing.
+	skipBadLines bool
+	// cache loads the networks from a snapshot next to the file, which is
+	// written once the file changes.
+	cache bool
+	// readOnly never writes the snapshot, e.g., for offline checks.
+	readOnly bool
+}
+
+// expand returns the files matched by the pattern. All regular files in a
+// directory are matched, in lexical order.
+func (nf networkFile) expand() ([]string, error) {
+	if info, err := os.Stat(nf.pattern); err == nil && info.IsDir() {
+		infos, err := ioutil.ReadDir(nf.pattern)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				files = append(files, filepath.Join(nf.pattern, info.Name()))
+			}
+		}
+		return files, nil
+	}
+	if !hasMeta(nf.pattern) {
+		return []string{nf.pattern}, nil
+	}
+	files, err := filepath.Glob(nf.pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no file matches '%s'", nf.pattern)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// watched returns the paths whose changes should trigger a reload, i.e.,
+// the matched files and, for directories and globs, the directory itself so
+// that added or removed files are picked up.
+func (nf networkFile) watched() []string {
+	files, _ := nf.expand()
+	if info, err := os.Stat(nf.pattern); err == nil && info.IsDir() {
+		return append(files, nf.pattern)
+	}
+	if hasMeta(nf.pattern) {
+		return append(files, filepath.Dir(nf.pattern))
+	}
+	return files
+}
+
+// load loads networks from all files matched by the pattern.
+func (nf networkFile) load() ([]string, error) {
+	files, err := nf.expand()
+	if err != nil {
+		return nil, err
+	}
+	var nets []string
+	for _, file := range files {
+		n, err := loadNetworksFromLocalFile(file, nf.skipBadLines)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n...)
+	}
+	return nets, nil
+}
+
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// loadNetworksFromLocalFile loads networks in CIDR notation from a local
+// file, which may be gzip-compressed. Each line holds one of:
+//   - an IP address or a subnet in CIDR notation, e.g., '10.0.0.0/8'.
+//   - an IP range, e.g., '10.0.0.5-10.0.0.77'.
+//   - an ipset 'add' command, e.g., 'add blacklist 10.0.0.0/8 timeout 0'.
+//
+// Comments start with '#' or ';' (as in Spamhaus DROP lists). Illegal lines
+// are reported as 'file:line' and fail the loading, unless skipBadLines is
+// set.
+func loadNetworksFromLocalFile(fileName string, skipBadLines bool) ([]string, error) {
+	nets, badLines, err := readNetworkFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	for _, badLine := range badLines {
+		if !skipBadLines {
+			return nil, badLine
+		}
+		log.Warningf("Skip illegal line %v", badLine)
+	}
+	return nets, nil
+}
+
+// readNetworkFile reads networks from a local file, along with the errors
+// of illegal lines.
+func readNetworkFile(fileName string) ([]string, []error, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	r, err := decompress(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	defer r.Close()
+
+	var nets []string
+	var badLines []error
+	lineNum := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, ';'); idx >= 0 {
+			line = line[:idx]
+		}
+		line = stripComment(line)
+		// skip empty line.
+		if line == "" {
+			continue
+		}
+		n, err := parseNetworkLine(line)
+		if err != nil {
+			badLines = append(badLines, fmt.Errorf("%s:%d: %v", fileName, lineNum, err))
+			continue
+		}
+		nets = append(nets, n...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return nets, badLines, nil
+}
+
+// decompress returns a reader of the decompressed content if r is
+// gzip-compressed, or of r itself otherwise. The reader must be closed, which
+// leaves r open.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		// too short to be compressed, or not compressed.
+		return ioutil.NopCloser(br), nil
+	}
+	return gzip.NewReader(br)
+}
+
+// parseNetworkLine parses a line of a network file.
+func parseNetworkLine(line string) ([]string, error) {
+	fields := strings.Fields(line)
+	if fields[0] == "add" || fields[0] == "create" {
+		// ipset commands: 'create SETNAME TYPE ...' and 'add SETNAME ENTRY ...'.
+		if fields[0] == "create" {
+			return nil, nil
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Illegal ipset entry '%s'", line)
+		}
+		fields = fields[2:3]
+	}
+	if len(fields) != 1 {
+		return nil, fmt.Errorf("Unexpected tokens '%s'", line)
+	}
+	entry := fields[0]
+
+	if idx := strings.IndexByte(entry, '-'); idx >= 0 {
+		start, end := net.ParseIP(entry[:idx]), net.ParseIP(entry[idx+1:])
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("Illegal IP range '%s'", entry)
+		}
+		nets, err := rangeToCIDRs(start, end)
+		if err != nil {
+			return nil, err
+		}
+		rawNets := make([]string, 0, len(nets))
+		for _, n := range nets {
+			rawNets = append(rawNets, n.String())
+		}
+		return rawNets, nil
+	}
+
+	if strings.IndexByte(entry, '/') >= 0 {
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return nil, fmt.Errorf("Illegal CIDR notation '%s'", entry)
+		}
+		return []string{entry}, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("Illegal IP address '%s'", entry)
+	}
+	if ip.To4() != nil {
+		return []string{entry + "/32"}, nil
+	}
+	return []string{entry + "/128"}, nil
+}
+
+// rangeToCIDRs splits the IP range [start, end] into the minimal list of
+// subnets covering it.
+func rangeToCIDRs(start, end net.IP) ([]net.IPNet, error) {
+	bits := 8 * net.IPv6len
+	if start4, end4 := start.To4(), end.To4(); start4 != nil && end4 != nil {
+		start, end, bits = start4, end4, 8*net.IPv4len
+	} else if start4 != nil || end4 != nil {
+		return nil, fmt.Errorf("Illegal IP range '%s-%s'; mixed IPv4 and IPv6", start, end)
+	} else {
+		start, end = start.To16(), end.To16()
+	}
+
+	lo, hi := new(big.Int).SetBytes(start), new(big.Int).SetBytes(end)
+	if lo.Cmp(hi) > 0 {
+		return nil, fmt.Errorf("Illegal IP range '%s-%s'; start is after end", start, end)
+	}
+
+	var nets []net.IPNet
+	one := big.NewInt(1)
+	for lo.Cmp(hi) <= 0 {
+		// the largest block aligned on lo ...
+		size := 0
+		for size < bits && lo.Bit(size) == 0 {
+			size++
+		}
+		// ... which does not exceed hi.
+		remaining := new(big.Int).Sub(hi, lo)
+		remaining.Add(remaining, one)
+		if limit := remaining.BitLen() - 1; size > limit {
+			size = limit
+		}
+
+		ip := make(net.IP, len(start))
+		b := lo.Bytes()
+		copy(ip[len(ip)-len(b):], b)
+		nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(bits-size, bits)})
+		lo.Add(lo, new(big.Int).Lsh(one, uint(size)))
+	}
+	return nets, nil
+}
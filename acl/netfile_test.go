@@ -0,0 +1,186 @@
+package acl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_rangeToCIDRs(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   string
+		end     string
+		want    []string
+		wantErr bool
+	}{
+		{"Single address", "10.0.0.1", "10.0.0.1", []string{"10.0.0.1/32"}, false},
+		{"Aligned subnet", "10.0.0.0", "10.0.0.255", []string{"10.0.0.0/24"}, false},
+		{"Unaligned range", "10.0.0.5", "10.0.0.77", []string{
+			"10.0.0.5/32", "10.0.0.6/31", "10.0.0.8/29", "10.0.0.16/28",
+			"10.0.0.32/27", "10.0.0.64/29", "10.0.0.72/30", "10.0.0.76/31",
+		}, false},
+		{"Whole IPv4", "0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}, false},
+		{"IPv6 range", "2001:db8::", "2001:db8::1:ffff", []string{"2001:db8::/111"}, false},
+		{"IPv6 unaligned", "2001:db8::1", "2001:db8::2", []string{"2001:db8::1/128", "2001:db8::2/128"}, false},
+		{"Reversed range", "10.0.0.2", "10.0.0.1", nil, true},
+		{"Mixed families", "10.0.0.1", "2001:db8::1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := rangeToCIDRs(net.ParseIP(tt.start), net.ParseIP(tt.end))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rangeToCIDRs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rangeToCIDRs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseNetworkLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{"CIDR", "10.0.0.0/8", []string{"10.0.0.0/8"}, false},
+		{"IPv4 address", "10.0.0.1", []string{"10.0.0.1/32"}, false},
+		{"IPv6 address", "2001:db8::1", []string{"2001:db8::1/128"}, false},
+		{"IP range", "10.0.0.0-10.0.1.255", []string{"10.0.0.0/23"}, false},
+		{"ipset add", "add blacklist 192.168.0.0/16 timeout 0", []string{"192.168.0.0/16"}, false},
+		{"ipset add range", "add blacklist 10.0.0.0-10.0.0.3", []string{"10.0.0.0/30"}, false},
+		{"ipset create", "create blacklist hash:net family inet", nil, false},
+		{"ipset missing entry", "add blacklist", nil, true},
+		{"Illegal CIDR", "10.0.0.0/33", nil, true},
+		{"Illegal address", "10.0.0", nil, true},
+		{"Illegal range", "10.0.0.1-10.0.0", nil, true},
+		{"Extra tokens", "10.0.0.1 10.0.0.2", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNetworkLine(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNetworkLine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNetworkLine() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_loadNetworksFromLocalFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl-netfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	drop := `; Spamhaus DROP List
+1.10.16.0/20 ; SBL256894
+1.19.0.0/16 ; SBL434604
+`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(drop))
+	zw.Close()
+
+	files := map[string][]byte{
+		"drop.txt":    []byte(drop),
+		"drop.txt.gz": gz.Bytes(),
+		"bad.txt":     []byte("10.0.0.0/8\n\n# comment\n10.0.0\n192.168.0.0/16\n"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		file         string
+		skipBadLines bool
+		want         []string
+		wantErr      string
+	}{
+		{"Spamhaus DROP", "drop.txt", false, []string{"1.10.16.0/20", "1.19.0.0/16"}, ""},
+		{"Gzip", "drop.txt.gz", false, []string{"1.10.16.0/20", "1.19.0.0/16"}, ""},
+		{"Bad line", "bad.txt", false, nil, "bad.txt:4: "},
+		{"Skip bad lines", "bad.txt", true, []string{"10.0.0.0/8", "192.168.0.0/16"}, ""},
+		{"Missing file", "missing.txt", false, nil, "missing.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadNetworksFromLocalFile(filepath.Join(dir, tt.file), tt.skipBadLines)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("loadNetworksFromLocalFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadNetworksFromLocalFile() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadNetworksFromLocalFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_networkFile_expand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl-netfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"b.txt", "a.txt", "c.list"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+		wantErr bool
+	}{
+		{"File", "a.txt", []string{"a.txt"}, false},
+		{"Directory", "", []string{"a.txt", "b.txt", "c.list"}, false},
+		{"Glob", "*.txt", []string{"a.txt", "b.txt"}, false},
+		{"Glob without match", "*.gz", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := networkFile{pattern: filepath.Join(dir, tt.pattern)}.expand()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("networkFile.expand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var want []string
+			for _, name := range tt.want {
+				want = append(want, filepath.Join(dir, name))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("networkFile.expand() = %v, want %v", got, want)
+			}
+		})
+	}
+}
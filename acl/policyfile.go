@@ -0,0 +1,331 @@
+package acl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ihac/acl/acl/filter"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// policyDocument is the structure of a policy file in YAML or JSON, e.g.,
+//
+//	policies:
+//	  - name: block-ads
+//	    action: block
+//	    qtypes: [A, AAAA]
+//	    networks: [PRIVATE]
+//	    names: [ads.example.com]
+type policyDocument struct {
+	Policies []policySpec `yaml:"policies" json:"policies"`
+}
+
+// policySpec is a named policy in a policy file.
+type policySpec struct {
+	Name      string         `yaml:"name" json:"name"`
+	Action    string         `yaml:"action" json:"action"`
+	Qtypes    []string       `yaml:"qtypes" json:"qtypes"`
+	Networks  []string       `yaml:"networks" json:"networks"`
+	Names     []string       `yaml:"names" json:"names"`
+	Proto     []string       `yaml:"proto" json:"proto"`
+	Opcodes   []string       `yaml:"opcodes" json:"opcodes"`
+	Classes   []string       `yaml:"classes" json:"classes"`
+	Listen    []string       `yaml:"listen" json:"listen"`
+	Response  string         `yaml:"response" json:"response"`
+	RateLimit *rateLimitSpec `yaml:"ratelimit" json:"ratelimit"`
+	Schedule  *scheduleSpec  `yaml:"schedule" json:"schedule"`
+}
+
+// rateLimitSpec holds the options of a ratelimit policy in a policy file.
+// Zero values stand for the defaults.
+type rateLimitSpec struct {
+	Rate     string `yaml:"rate" json:"rate"`
+	Burst    int    `yaml:"burst" json:"burst"`
+	Prefix   int    `yaml:"prefix" json:"prefix"`
+	Prefix6  int    `yaml:"prefix6" json:"prefix6"`
+	Size     int    `yaml:"size" json:"size"`
+	Response string `yaml:"response" json:"response"`
+}
+
+// scheduleSpec holds the options of the schedule of a policy in a policy
+// file, in the same forms as the 'schedule' clause.
+type scheduleSpec struct {
+	Days  []string `yaml:"days" json:"days"`
+	Time  []string `yaml:"time" json:"time"`
+	TZ    string   `yaml:"tz" json:"tz"`
+	From  string   `yaml:"from" json:"from"`
+	Until string   `yaml:"until" json:"until"`
+}
+
+// policyFile holds the policies loaded from a policy file. It is reloaded
+// once the file changes.
+type policyFile struct {
+	name string
+
+	mu       sync.RWMutex
+	policies []Policy
+}
+
+func newPolicyFile(name string) (*policyFile, error) {
+	pf := &policyFile{name: name}
+	if err := pf.load(); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+// load (re)loads the policies from the file. The previous policies are kept
+// if the file is invalid.
+func (pf *policyFile) load() error {
+	policies, err := loadPolicyFile(pf.name)
+	if err != nil {
+		return err
+	}
+	pf.mu.Lock()
+	pf.policies = policies
+	pf.mu.Unlock()
+	return nil
+}
+
+// Policies returns the policies currently loaded.
+func (pf *policyFile) Policies() []Policy {
+	pf.mu.RLock()
+	defer pf.mu.RUnlock()
+	return pf.policies
+}
+
+// loadPolicyFile parses a policy file. Files with the '.json' extension are
+// parsed as JSON, and others as YAML. Unknown fields are rejected.
+func loadPolicyFile(fileName string) ([]Policy, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc policyDocument
+	if strings.ToLower(filepath.Ext(fileName)) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(content))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&doc)
+	} else {
+		err = yaml.UnmarshalStrict(content, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	var policies []Policy
+	names := make(map[string]bool)
+	for i, spec := range doc.Policies {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("%s: policies[%d]: no 'name' is specified", fileName, i)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("%s: policy '%s': duplicate name", fileName, spec.Name)
+		}
+		names[spec.Name] = true
+
+		ps, err := spec.policies()
+		if err != nil {
+			return nil, fmt.Errorf("%s: policy '%s': %v", fileName, spec.Name, err)
+		}
+		for i := range ps {
+			ps[i].text = fmt.Sprintf("%s: %s", fileName, spec.Name)
+		}
+		policies = append(policies, ps...)
+	}
+	return policies, nil
+}
+
+// policies converts the spec into policies, one per query type.
+func (spec policySpec) policies() ([]Policy, error) {
+	p := Policy{name: spec.Name, action: strings.ToLower(spec.Action)}
+	if !isPolicyAction(p.action) {
+		return nil, fmt.Errorf("Illegal action '%s'; expect '%s', '%s', '%s' or '%s'", spec.Action, ALLOW, BLOCK, TRUNCATE, RATELIMIT)
+	}
+
+	var err error
+	if p.action == RATELIMIT {
+		if spec.RateLimit == nil {
+			return nil, fmt.Errorf("no 'ratelimit' is specified")
+		}
+		p.limiter, err = spec.RateLimit.limiter()
+		if err != nil {
+			return nil, err
+		}
+	} else if spec.RateLimit != nil {
+		return nil, fmt.Errorf("'ratelimit' requires action '%s'", RATELIMIT)
+	}
+
+	if spec.Response != "" {
+		if p.action != BLOCK {
+			return nil, fmt.Errorf("'response' requires action '%s'", BLOCK)
+		}
+		p.response, err = parseBlockResponse(spec.Response)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(spec.Networks) == 0 && len(spec.Names) == 0 {
+		return nil, fmt.Errorf("no 'networks' or 'names' is specified")
+	}
+	if len(spec.Networks) > 0 {
+		p.src = &source{specified: true}
+		for _, v := range spec.Networks {
+			p.src.nets = append(p.src.nets, preprocessNetworks([]string{v})...)
+			if !isNetworkKeyword(v) {
+				p.src.literals = append(p.src.literals, v)
+			}
+		}
+		nets, err := parseCIDRs(p.src.nets)
+		if err != nil {
+			return nil, err
+		}
+		p.filter, err = filter.New("ranges", nets)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to initialize filter: %v", err)
+		}
+	}
+	if len(spec.Names) > 0 {
+		for _, name := range spec.Names {
+			if _, ok := dns.IsDomainName(name); !ok {
+				return nil, fmt.Errorf("Illegal domain name '%s'", name)
+			}
+		}
+		p.domains = &domainSet{names: spec.Names}
+		if err := p.domains.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range spec.Proto {
+		proto := strings.ToLower(v)
+		if !isProto(proto) {
+			return nil, fmt.Errorf("Illegal protocol '%s'; expect 'udp', 'tcp', 'tls', 'https' or 'grpc'", v)
+		}
+		p.protos = append(p.protos, proto)
+	}
+	for _, v := range spec.Opcodes {
+		opcode, err := parseOpcode(v)
+		if err != nil {
+			return nil, err
+		}
+		p.opcodes = append(p.opcodes, opcode)
+	}
+	for _, v := range spec.Classes {
+		class, err := parseClass(v)
+		if err != nil {
+			return nil, err
+		}
+		p.classes = append(p.classes, class)
+	}
+	if len(spec.Listen) > 0 {
+		locals, err := parseCIDRs(spec.Listen)
+		if err != nil {
+			return nil, err
+		}
+		p.local, err = filter.New("ranges", locals)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to initialize filter: %v", err)
+		}
+	}
+
+	if spec.Schedule != nil {
+		p.schedule, err = spec.Schedule.schedule()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	qtypes := spec.Qtypes
+	if len(qtypes) == 0 {
+		qtypes = []string{"ANY"}
+	}
+	policies := make([]Policy, 0, len(qtypes))
+	for _, raw := range qtypes {
+		p.qtype, err = parseQype(strings.ToUpper(raw))
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// limiter creates the rate limiter of the spec.
+func (spec rateLimitSpec) limiter() (*rateLimiter, error) {
+	rate, err := parseRate(spec.Rate)
+	if err != nil {
+		return nil, err
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	rl := newRateLimiter(rate, burst)
+	if spec.Burst < 0 || spec.Size < 0 {
+		return nil, fmt.Errorf("'burst' and 'size' must be positive")
+	}
+	if spec.Burst > 0 {
+		rl.burst = float64(spec.Burst)
+	}
+	if spec.Size > 0 {
+		rl.size = spec.Size
+	}
+	if spec.Prefix < 0 || spec.Prefix > 32 {
+		return nil, fmt.Errorf("Illegal IPv4 prefix length '%d'", spec.Prefix)
+	}
+	if spec.Prefix > 0 {
+		rl.v4Mask = net.CIDRMask(spec.Prefix, 32)
+	}
+	if spec.Prefix6 < 0 || spec.Prefix6 > 128 {
+		return nil, fmt.Errorf("Illegal IPv6 prefix length '%d'", spec.Prefix6)
+	}
+	if spec.Prefix6 > 0 {
+		rl.v6Mask = net.CIDRMask(spec.Prefix6, 128)
+	}
+	switch strings.ToLower(spec.Response) {
+	case "", "refuse":
+		rl.response = BLOCK
+	case "drop":
+		rl.response = DROP
+	case "slip":
+		rl.response = TRUNCATE
+	default:
+		return nil, fmt.Errorf("Illegal response '%s'; expect 'refuse', 'drop' or 'slip'", spec.Response)
+	}
+	return rl, nil
+}
+
+// schedule creates the schedule of the spec.
+func (spec scheduleSpec) schedule() (*schedule, error) {
+	var values []string
+	if len(spec.Days) > 0 {
+		values = append(append(values, "days"), spec.Days...)
+	}
+	if len(spec.Time) > 0 {
+		values = append(append(values, "time"), spec.Time...)
+	}
+	for _, option := range []struct{ name, value string }{
+		{"tz", spec.TZ},
+		{"from", spec.From},
+		{"until", spec.Until},
+	} {
+		if option.value != "" {
+			values = append(values, option.name, option.value)
+		}
+	}
+	s, err := parseSchedule(values)
+	if err != nil {
+		return nil, fmt.Errorf("Illegal schedule: %v", err)
+	}
+	return s, nil
+}
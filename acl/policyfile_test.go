@@ -0,0 +1,213 @@
+package acl
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+var policyFileTestFiles = map[string]string{
+	"acl-test-policy.yaml": `policies:
+  - name: allow-corp
+    action: allow
+    networks: [10.0.0.0/8]
+  - name: block-ads
+    action: block
+    qtypes: [a, AAAA]
+    names: [ads.example.com]
+  - name: block-lab
+    action: block
+    networks: [192.168.1.0/24]
+    proto: [udp]
+  - name: nxdomain-tracker
+    action: block
+    networks: [172.16.0.0/12]
+    names: [tracker.example.com]
+    response: nxdomain
+  - name: limit-all
+    action: ratelimit
+    networks: [ANY]
+    ratelimit:
+      rate: 1/s
+      burst: 1
+      response: drop
+`,
+	"acl-test-policy.json": `{
+	"policies": [
+		{"name": "block-mx", "action": "block", "qtypes": ["MX"], "networks": ["192.168.0.0/16"]},
+		{"name": "block-v6-txt", "action": "block", "qtypes": ["TXT"], "networks": ["ANY"], "listen": ["fd00::/64"]}
+	]
+}`,
+}
+
+func Test_loadPolicyFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    int
+		wantErr string
+	}{
+		{"YAML", "acl-test-policy.yaml", policyFileTestFiles["acl-test-policy.yaml"], 6, ""},
+		{"JSON", "acl-test-policy.json", policyFileTestFiles["acl-test-policy.json"], 2, ""},
+		{"Empty", "acl-test-policy.yaml", "", 0, ""},
+		{"Unknown field", "acl-test-policy.yaml", "policies:\n  - name: p\n    action: block\n    nets: [ANY]\n", 0, "field nets not found"},
+		{"Unknown JSON field", "acl-test-policy.json", `{"policies": [{"name": "p", "nets": ["ANY"]}]}`, 0, `unknown field "nets"`},
+		{"Missing name", "acl-test-policy.yaml", "policies:\n  - action: block\n    networks: [ANY]\n", 0, "policies[0]: no 'name'"},
+		{"Duplicate name", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [ANY]}\n  - {name: p, action: allow, networks: [ANY]}\n", 0, "policy 'p': duplicate name"},
+		{"Illegal action", "acl-test-policy.yaml", "policies:\n  - {name: p, action: deny, networks: [ANY]}\n", 0, "policy 'p': Illegal action 'deny'"},
+		{"Missing source", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block}\n", 0, "no 'networks' or 'names'"},
+		{"Illegal network", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [10.0.0.0/33]}\n", 0, "Illegal CIDR notation"},
+		{"Illegal qtype", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, qtypes: [XYZ], networks: [ANY]}\n", 0, "legal QTYPE"},
+		{"Illegal proto", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [ANY], proto: [quic]}\n", 0, "Illegal protocol 'quic'"},
+		{"Opcodes and classes", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [ANY], opcodes: [notify, UPDATE], classes: [CH]}\n", 1, ""},
+		{"Illegal opcode", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [ANY], opcodes: [STATUS]}\n", 0, "Illegal opcode 'STATUS'"},
+		{"Illegal class", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [ANY], classes: [CS]}\n", 0, "Illegal class 'CS'"},
+		{"Response", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [ANY], response: NXDOMAIN}\n", 1, ""},
+		{"Illegal block response", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [ANY], response: slip}\n", 0, "Illegal response 'slip'"},
+		{"Response without block", "acl-test-policy.yaml", "policies:\n  - {name: p, action: allow, networks: [ANY], response: drop}\n", 0, "'response' requires action 'block'"},
+		{"Missing ratelimit", "acl-test-policy.yaml", "policies:\n  - {name: p, action: ratelimit, networks: [ANY]}\n", 0, "no 'ratelimit'"},
+		{"Ratelimit without action", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [ANY], ratelimit: {rate: 1/s}}\n", 0, "requires action 'ratelimit'"},
+		{"Illegal rate", "acl-test-policy.yaml", "policies:\n  - {name: p, action: ratelimit, networks: [ANY], ratelimit: {rate: fast}}\n", 0, "Illegal rate 'fast'"},
+		{"Illegal response", "acl-test-policy.yaml", "policies:\n  - {name: p, action: ratelimit, networks: [ANY], ratelimit: {rate: 1/s, response: nxdomain}}\n", 0, "Illegal response 'nxdomain'"},
+		{"Schedule", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [ANY], schedule: {days: [mon-fri], time: ['22:00-06:00'], tz: UTC, until: '2026-11-01'}}\n", 1, ""},
+		{"Illegal schedule", "acl-test-policy.yaml", "policies:\n  - {name: p, action: block, networks: [ANY], schedule: {time: ['22:00']}}\n", 0, "Illegal schedule: Illegal time range '22:00'"},
+		{"Illegal document", "acl-test-policy.yaml", "policies: {", 0, "acl-test-policy.yaml: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{tt.file: tt.content}
+			envSetup(files)
+			defer envCleanup(files)
+
+			got, err := loadPolicyFile(tt.file)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("loadPolicyFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadPolicyFile() error = %v", err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("loadPolicyFile() returns %d policies, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_policyFile(t *testing.T) {
+	envSetup(policyFileTestFiles)
+	defer envCleanup(policyFileTestFiles)
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		sourceIP  string
+		localIP   string
+		wantRcode int
+	}{
+		{"Allowed network", "ads.example.com.", dns.TypeA, "10.0.0.1", "", dns.RcodeSuccess},
+		{"Blocked name", "www.ads.example.com.", dns.TypeAAAA, "172.16.0.1", "", dns.RcodeRefused},
+		{"Blocked name other qtype", "ads.example.com.", dns.TypeTXT, "172.16.0.1", "", dns.RcodeSuccess},
+		{"Blocked network", "example.com.", dns.TypeA, "192.168.1.1", "", dns.RcodeRefused},
+		{"NXDOMAIN response", "tracker.example.com.", dns.TypeA, "172.16.0.1", "", dns.RcodeNameError},
+		{"Second policy file", "example.com.", dns.TypeMX, "192.168.0.1", "", dns.RcodeRefused},
+		{"IPv6 listen address", "example.com.", dns.TypeTXT, "172.16.0.1", "fd00::53", dns.RcodeRefused},
+		{"Other IPv6 listen address", "example.com.", dns.TypeTXT, "172.16.0.1", "fd01::53", dns.RcodeSuccess},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseACL(caddy.NewTestController("dns", `
+			acl . {
+				policy_file acl-test-policy.yaml
+				policy_file acl-test-policy.json
+			}`))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+			w := &testResponseWriter{}
+			w.setRemoteIP(tt.sourceIP)
+			if tt.localIP != "" {
+				w.localAddr = &net.UDPAddr{IP: net.ParseIP(tt.localIP), Port: 53}
+			}
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, tt.qtype)
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_policyFile_response(t *testing.T) {
+	files := map[string]string{"acl-test-policy.yaml": ""}
+	defer envCleanup(files)
+
+	for _, response := range []string{"refuse", "nxdomain", "drop"} {
+		t.Run(response, func(t *testing.T) {
+			files["acl-test-policy.yaml"] = "policies:\n  - {name: p, action: block, qtypes: [A], networks: [10.0.0.0/8], response: " + response + "}\n"
+			envSetup(files)
+			fromFile, err := loadPolicyFile("acl-test-policy.yaml")
+			if err != nil {
+				t.Fatalf("loadPolicyFile() error = %v", err)
+			}
+			a, err := parseACL(caddy.NewTestController("dns", "acl {\n block type A net 10.0.0.0/8 response "+response+"\n}"))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			got, want := a.Rules[0].Policies[0], fromFile[0]
+			if got.action != want.action || got.qtype != want.qtype || got.response != want.response {
+				t.Errorf("Corefile policy = (%s, %d, %q), policy file = (%s, %d, %q)", got.action, got.qtype, got.response, want.action, want.qtype, want.response)
+			}
+		})
+	}
+}
+
+func Test_policyFile_reload(t *testing.T) {
+	envSetup(policyFileTestFiles)
+	defer envCleanup(policyFileTestFiles)
+
+	pf, err := newPolicyFile("acl-test-policy.json")
+	if err != nil {
+		t.Fatalf("cannot load policy file: %v", err)
+	}
+	rl := newReloader()
+	rl.Watch(pf.name, pf.load)
+
+	content := `{"policies": [
+		{"name": "block-mx", "action": "block", "qtypes": ["MX"], "networks": ["192.168.0.0/16"]},
+		{"name": "block-txt", "action": "block", "qtypes": ["TXT"], "networks": ["192.168.0.0/16"]}
+	]}`
+	if err := ioutil.WriteFile(pf.name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rl.check()
+	if got := len(pf.Policies()); got != 2 {
+		t.Fatalf("policyFile.Policies() returns %d policies after reload, want 2", got)
+	}
+
+	// an invalid file keeps the previous policies.
+	if err := ioutil.WriteFile(pf.name, []byte(`{"policies": [{"name": "p"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rl.check()
+	if got := len(pf.Policies()); got != 2 {
+		t.Errorf("policyFile.Policies() returns %d policies after failed reload, want 2", got)
+	}
+}
@@ -0,0 +1,82 @@
+package acl
+
+import (
+	"sync"
+
+	"github.com/ihac/acl/acl/filter"
+)
+
+const (
+	// matchFirst evaluates the policies of a rule in order, and the first
+	// one matching a query decides.
+	matchFirst = "first"
+	// matchLongestPrefix evaluates the policies of a rule by the networks
+	// containing the client, from the most specific one.
+	matchLongestPrefix = "longest-prefix"
+)
+
+// prefixIndex indexes the policies of a rule by the prefixes of their
+// networks, for rules in longest-prefix mode. It is rebuilt once the network
+// files of the policies change.
+type prefixIndex struct {
+	policies []*Policy
+
+	mu   sync.RWMutex
+	trie *filter.ValueTrie
+}
+
+func newPrefixIndex(policies []Policy) (*prefixIndex, error) {
+	pi := &prefixIndex{}
+	for i := range policies {
+		pi.policies = append(pi.policies, &policies[i])
+	}
+	if err := pi.load(); err != nil {
+		return nil, err
+	}
+	return pi, nil
+}
+
+// load (re)builds the trie mapping each prefix to its policies, in order.
+// Policies without networks match any source.
+func (pi *prefixIndex) load() error {
+	trie := filter.NewValueTrie()
+	for _, p := range pi.policies {
+		nets := anyNets
+		if p.src != nil {
+			var err error
+			if nets, err = p.src.networks(); err != nil {
+				return err
+			}
+		}
+		for _, n := range nets {
+			value, _ := trie.Get(n)
+			policies, _ := value.([]*Policy)
+			if err := trie.Insert(n, append(policies, p)); err != nil {
+				return err
+			}
+		}
+	}
+	pi.mu.Lock()
+	pi.trie = trie
+	pi.mu.Unlock()
+	return nil
+}
+
+// match evaluates the policies of the longest prefix containing the client
+// first, then those of shorter prefixes, and returns the first policy
+// deciding the query along with its action. It returns a nil policy if none
+// decides.
+func (pi *prefixIndex) match(q *query) (string, *Policy) {
+	var buf [8]interface{}
+	pi.mu.RLock()
+	matches := pi.trie.Matches(q.ip, buf[:0])
+	pi.mu.RUnlock()
+	for _, value := range matches {
+		for _, p := range value.([]*Policy) {
+			if action, matched := matchPolicy(p, q); matched != nil {
+				return action, matched
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,110 @@
+package acl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func Test_acl_ServeDNS_longestPrefix(t *testing.T) {
+	config := `acl example.org {
+		match longest-prefix
+		block type ANY net 10.0.0.0/8
+		allow type ANY net 10.1.0.0/16
+		block type ANY net 10.1.2.0/24 proto tcp
+		block type MX net 10.1.3.0/24
+		allow type MX net 10.1.3.0/24
+		block type TXT domains acl-test-domains.txt
+	}`
+	envSetup(domainsTestFiles)
+	defer envCleanup(domainsTestFiles)
+
+	tests := []struct {
+		name      string
+		source    string
+		tcp       bool
+		qname     string
+		qtype     uint16
+		wantRcode int
+	}{
+		{"Less specific", "10.2.0.1", false, "www.example.org.", dns.TypeA, dns.RcodeRefused},
+		{"More specific", "10.1.0.1", false, "www.example.org.", dns.TypeA, dns.RcodeSuccess},
+		{"Most specific not matched", "10.1.2.1", false, "www.example.org.", dns.TypeA, dns.RcodeSuccess},
+		{"Most specific matched", "10.1.2.1", true, "www.example.org.", dns.TypeA, dns.RcodeRefused},
+		{"Most specific of other qtype", "10.1.3.1", false, "www.example.org.", dns.TypeA, dns.RcodeSuccess},
+		{"Same prefix in order", "10.1.3.1", false, "www.example.org.", dns.TypeMX, dns.RcodeRefused},
+		{"Any source", "192.168.0.1", false, "x.wildcard.example.org.", dns.TypeTXT, dns.RcodeRefused},
+		{"Any source less specific", "10.1.0.1", false, "x.wildcard.example.org.", dns.TypeTXT, dns.RcodeSuccess},
+		{"Not matched", "192.168.0.1", false, "www.example.org.", dns.TypeA, dns.RcodeSuccess},
+	}
+
+	a, err := parseACL(caddy.NewTestController("dns", config))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testResponseWriter{}
+			if tt.tcp {
+				w.setRemoteTCPIP(tt.source)
+			} else {
+				w.setRemoteIP(tt.source)
+			}
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, tt.qtype)
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_prefixIndex_reload(t *testing.T) {
+	files := map[string]string{"acl-test-prefix.txt": "10.1.0.0/16\n"}
+	envSetup(files)
+	defer envCleanup(files)
+
+	a, err := parseACL(caddy.NewTestController("dns", `acl example.org {
+		match longest-prefix
+		block type ANY net 10.0.0.0/8
+		allow type ANY file acl-test-prefix.txt
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+	serve := func() int {
+		w := &testResponseWriter{}
+		w.setRemoteIP("10.1.0.1")
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.", dns.TypeA)
+		if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+			t.Fatalf("acl.ServeDNS() error = %v", err)
+		}
+		return w.Rcode
+	}
+
+	if rcode := serve(); rcode != dns.RcodeSuccess {
+		t.Fatalf("acl.ServeDNS() Rcode = %v, want %v", rcode, dns.RcodeSuccess)
+	}
+	envSetup(map[string]string{"acl-test-prefix.txt": "10.2.0.0/16\n"})
+	for _, rule := range a.Rules {
+		if err := rule.prefixes.load(); err != nil {
+			t.Fatalf("prefixIndex.load() error = %v", err)
+		}
+		if err := rule.Policies[1].filter.(*reloadableFilter).load(); err != nil {
+			t.Fatalf("reloadableFilter.load() error = %v", err)
+		}
+	}
+	if rcode := serve(); rcode != dns.RcodeRefused {
+		t.Errorf("acl.ServeDNS() Rcode after reload = %v, want %v", rcode, dns.RcodeRefused)
+	}
+}
@@ -0,0 +1,234 @@
+package acl
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+const (
+	// defaultLimiterSize is the default number of clients tracked by a rate limiter.
+	defaultLimiterSize = 10000
+)
+
+// rateLimiter implements per-client token buckets. Clients are identified
+// by their source address masked with a configurable prefix length, and the
+// number of buckets kept in memory is bounded by an LRU list.
+type rateLimiter struct {
+	// rate is the number of tokens refilled per second.
+	rate float64
+	// burst is the maximum number of tokens a bucket can hold.
+	burst float64
+	// response is the action taken towards queries over the limit,
+	// i.e., BLOCK, DROP or TRUNCATE.
+	response string
+
+	v4Mask net.IPMask
+	v6Mask net.IPMask
+
+	size int
+	now  func() time.Time
+
+	mu      sync.Mutex
+	buckets map[[net.IPv6len]byte]*list.Element
+	lru     *list.List
+}
+
+type bucket struct {
+	key    [net.IPv6len]byte
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:     rate,
+		burst:    burst,
+		response: BLOCK,
+		v4Mask:   net.CIDRMask(32, 32),
+		v6Mask:   net.CIDRMask(128, 128),
+		size:     defaultLimiterSize,
+		now:      time.Now,
+		buckets:  make(map[[net.IPv6len]byte]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Allow reports whether a query from ip is within the rate limit, and
+// consumes a token if so.
+func (rl *rateLimiter) Allow(ip net.IP) bool {
+	key := rl.key(ip)
+	now := rl.now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var b *bucket
+	if e, ok := rl.buckets[key]; ok {
+		rl.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens += now.Sub(b.last).Seconds() * rl.rate
+		if b.tokens > rl.burst {
+			b.tokens = rl.burst
+		}
+		b.last = now
+	} else {
+		if rl.lru.Len() >= rl.size {
+			oldest := rl.lru.Back()
+			rl.lru.Remove(oldest)
+			delete(rl.buckets, oldest.Value.(*bucket).key)
+		}
+		b = &bucket{key: key, tokens: rl.burst, last: now}
+		rl.buckets[key] = rl.lru.PushFront(b)
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Peek reports whether a query from ip would be within the rate limit,
+// without consuming a token.
+func (rl *rateLimiter) Peek(ip net.IP) bool {
+	key := rl.key(ip)
+	now := rl.now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	e, ok := rl.buckets[key]
+	if !ok {
+		return rl.burst >= 1
+	}
+	b := e.Value.(*bucket)
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rl.rate
+	return tokens >= 1
+}
+
+// key masks ip with the configured prefix length.
+func (rl *rateLimiter) key(ip net.IP) [net.IPv6len]byte {
+	var key [net.IPv6len]byte
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(key[:], ip4.Mask(rl.v4Mask))
+	} else {
+		copy(key[:], ip.To16().Mask(rl.v6Mask))
+	}
+	return key
+}
+
+// parseRateLimiter parses the arguments of a ratelimit policy, stopping at
+// the 'type' token.
+func parseRateLimiter(c *caddy.Controller) (*rateLimiter, error) {
+	/*
+	 * ratelimit RATE [burst N] [prefix LEN] [prefix6 LEN] [size N] [response refuse|drop|slip] type ...
+	 *
+	 * RATE: N/s | N/m | N/h
+	 */
+	rate, err := parseRate(c.Val())
+	if err != nil {
+		return nil, c.Errf("%v", err)
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	rl := newRateLimiter(rate, burst)
+
+	for c.NextArg() {
+		switch strings.ToLower(c.Val()) {
+		case "type":
+			return rl, nil
+		case "burst":
+			n, err := nextPositiveInt(c)
+			if err != nil {
+				return nil, err
+			}
+			rl.burst = float64(n)
+		case "size":
+			n, err := nextPositiveInt(c)
+			if err != nil {
+				return nil, err
+			}
+			rl.size = n
+		case "prefix":
+			n, err := nextPositiveInt(c)
+			if err != nil {
+				return nil, err
+			}
+			if n > 32 {
+				return nil, c.Errf("Illegal IPv4 prefix length '%d'", n)
+			}
+			rl.v4Mask = net.CIDRMask(n, 32)
+		case "prefix6":
+			n, err := nextPositiveInt(c)
+			if err != nil {
+				return nil, err
+			}
+			if n > 128 {
+				return nil, c.Errf("Illegal IPv6 prefix length '%d'", n)
+			}
+			rl.v6Mask = net.CIDRMask(n, 128)
+		case "response":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			switch strings.ToLower(c.Val()) {
+			case "refuse":
+				rl.response = BLOCK
+			case "drop":
+				rl.response = DROP
+			case "slip":
+				rl.response = TRUNCATE
+			default:
+				return nil, c.Errf("Unexpected token '%s'; expect 'refuse', 'drop' or 'slip'", c.Val())
+			}
+		default:
+			return nil, c.Errf("Unexpected token '%s'; expect 'type'", c.Val())
+		}
+	}
+	return nil, c.ArgErr()
+}
+
+// parseRate parses a rate in the form of 'N/s', 'N/m' or 'N/h' and returns
+// the number of queries per second.
+func parseRate(raw string) (float64, error) {
+	idx := strings.Index(raw, "/")
+	if idx < 0 {
+		return 0, fmt.Errorf("Illegal rate '%s'; expect N/s, N/m or N/h", raw)
+	}
+	n, err := strconv.ParseFloat(raw[:idx], 64)
+	// NaN and infinite rates would let all queries pass.
+	if err != nil || !(n > 0) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("Illegal rate '%s'; expect N/s, N/m or N/h", raw)
+	}
+	switch raw[idx+1:] {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	default:
+		return 0, fmt.Errorf("Illegal rate '%s'; expect N/s, N/m or N/h", raw)
+	}
+}
+
+func nextPositiveInt(c *caddy.Controller) (int, error) {
+	if !c.NextArg() {
+		return 0, c.ArgErr()
+	}
+	n, err := strconv.Atoi(c.Val())
+	if err != nil || n <= 0 {
+		return 0, c.Errf("Unexpected token '%s'; expect a positive integer", c.Val())
+	}
+	return n, nil
+}
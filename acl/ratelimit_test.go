@@ -0,0 +1,181 @@
+package acl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (f *fakeClock) Now() time.Time { return f.t }
+
+func (f *fakeClock) Advance(d time.Duration) { f.t = f.t.Add(d) }
+
+func Test_rateLimiter_Allow(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	rl := newRateLimiter(1, 2)
+	rl.now = clock.Now
+
+	ip := net.ParseIP("10.0.0.1")
+	for i, want := range []bool{true, true, false} {
+		if got := rl.Allow(ip); got != want {
+			t.Errorf("query %d: rateLimiter.Allow() = %v, want %v", i, got, want)
+		}
+	}
+	// other clients have their own buckets.
+	if !rl.Allow(net.ParseIP("10.0.0.2")) {
+		t.Errorf("rateLimiter.Allow() = false for a new client, want true")
+	}
+	// one token is refilled per second.
+	clock.Advance(time.Second)
+	if !rl.Allow(ip) {
+		t.Errorf("rateLimiter.Allow() = false after refill, want true")
+	}
+	if rl.Allow(ip) {
+		t.Errorf("rateLimiter.Allow() = true after refill is consumed, want false")
+	}
+}
+
+func Test_rateLimiter_Prefix(t *testing.T) {
+	rl := newRateLimiter(1, 1)
+	rl.now = (&fakeClock{t: time.Unix(0, 0)}).Now
+	rl.v4Mask = net.CIDRMask(24, 32)
+
+	if !rl.Allow(net.ParseIP("10.0.0.1")) {
+		t.Errorf("rateLimiter.Allow() = false, want true")
+	}
+	if rl.Allow(net.ParseIP("10.0.0.2")) {
+		t.Errorf("rateLimiter.Allow() = true for a client in the same prefix, want false")
+	}
+	if !rl.Allow(net.ParseIP("10.0.1.1")) {
+		t.Errorf("rateLimiter.Allow() = false for a client in another prefix, want true")
+	}
+}
+
+func Test_rateLimiter_LRU(t *testing.T) {
+	rl := newRateLimiter(1, 1)
+	rl.now = (&fakeClock{t: time.Unix(0, 0)}).Now
+	rl.size = 2
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		rl.Allow(net.ParseIP(ip))
+	}
+	if rl.lru.Len() != 2 || len(rl.buckets) != 2 {
+		t.Fatalf("rateLimiter tracks %d clients, want 2", rl.lru.Len())
+	}
+	// 10.0.0.1 has been evicted and starts with a full bucket.
+	if !rl.Allow(net.ParseIP("10.0.0.1")) {
+		t.Errorf("rateLimiter.Allow() = false for an evicted client, want true")
+	}
+}
+
+func Test_parseRate(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    float64
+		wantErr bool
+	}{
+		{"Per second", "50/s", 50, false},
+		{"Per minute", "120/m", 2, false},
+		{"Per hour", "7200/h", 2, false},
+		{"Missing unit", "50", 0, true},
+		{"Illegal unit", "50/d", 0, true},
+		{"Illegal number", "abc/s", 0, true},
+		{"Zero", "0/s", 0, true},
+		{"NaN", "NaN/s", 0, true},
+		{"Infinity", "Inf/s", 0, true},
+		{"Negative infinity", "-Inf/m", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRate(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseRate() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseRate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_ratelimit(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        string
+		wantRcodes    []int
+		wantTruncated bool
+	}{
+		{
+			"Ratelimit refuse",
+			`acl example.org {
+				ratelimit 1/h burst 2 type A net ANY
+			}`,
+			[]int{dns.RcodeSuccess, dns.RcodeSuccess, dns.RcodeRefused},
+			false,
+		},
+		{
+			"Ratelimit other qtype",
+			`acl example.org {
+				ratelimit 1/h burst 1 type AAAA net ANY
+			}`,
+			[]int{dns.RcodeSuccess, dns.RcodeSuccess, dns.RcodeSuccess},
+			false,
+		},
+		{
+			"Ratelimit slip",
+			`acl example.org {
+				ratelimit 1/h burst 1 response slip type ANY net ANY
+			}`,
+			[]int{dns.RcodeSuccess, dns.RcodeSuccess},
+			true,
+		},
+		{
+			"Ratelimit then block",
+			`acl example.org {
+				ratelimit 10/s type ANY net ANY
+				block type A net 192.168.0.0/16
+			}`,
+			[]int{dns.RcodeRefused},
+			false,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseACL(caddy.NewTestController("dns", tt.config))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+			var w *testResponseWriter
+			for i, wantRcode := range tt.wantRcodes {
+				w = &testResponseWriter{}
+				w.setRemoteIP("192.168.0.2")
+				m := new(dns.Msg)
+				m.SetQuestion("www.example.org.", dns.TypeA)
+				if _, err := a.ServeDNS(ctx, w, m); err != nil {
+					t.Fatalf("acl.ServeDNS() error = %v", err)
+				}
+				if w.Rcode != wantRcode {
+					t.Errorf("query %d: acl.ServeDNS() Rcode = %v, want %v", i, w.Rcode, wantRcode)
+				}
+			}
+			if truncated := w.Msg != nil && w.Msg.Truncated; truncated != tt.wantTruncated {
+				t.Errorf("acl.ServeDNS() Truncated = %v, want %v", truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
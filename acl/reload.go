@@ -0,0 +1,165 @@
+package acl
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/ihac/acl/acl/filter"
+)
+
+const (
+	// defaultReloadInterval is the default interval of checking local files for changes.
+	defaultReloadInterval = 30 * time.Second
+)
+
+// reloader periodically checks local files and reloads those which have been
+// changed since they were loaded.
+type reloader struct {
+	interval time.Duration
+	files    []*watchedFile
+
+	once sync.Once
+	stop chan struct{}
+}
+
+// watchedFile is a local file and the function to reload it.
+type watchedFile struct {
+	name    string
+	load    func() error
+	modTime time.Time
+	size    int64
+}
+
+func newReloader() *reloader {
+	return &reloader{
+		interval: defaultReloadInterval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Watch records the current state of a file which has been loaded, and
+// reloads it with load once it is changed.
+func (rl *reloader) Watch(name string, load func() error) {
+	f := &watchedFile{name: name, load: load}
+	if info, err := os.Stat(name); err == nil {
+		f.modTime, f.size = info.ModTime(), info.Size()
+	}
+	rl.files = append(rl.files, f)
+}
+
+// Start starts checking files in background.
+func (rl *reloader) Start() error {
+	if rl.interval == 0 || len(rl.files) == 0 {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(rl.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rl.stop:
+				return
+			case <-ticker.C:
+				rl.check()
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops checking files.
+func (rl *reloader) Stop() error {
+	rl.once.Do(func() { close(rl.stop) })
+	return nil
+}
+
+// check reloads all files which have been changed. A file failing to be
+// reloaded keeps its previous content.
+func (rl *reloader) check() {
+	for _, f := range rl.files {
+		info, err := os.Stat(f.name)
+		if err != nil {
+			log.Warningf("Failed to check file '%s' for changes: %v", f.name, err)
+			continue
+		}
+		if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+			continue
+		}
+		f.modTime, f.size = info.ModTime(), info.Size()
+		if err := f.load(); err != nil {
+			log.Errorf("Failed to reload file '%s': %v", f.name, err)
+			continue
+		}
+		log.Infof("Reloaded file '%s'", f.name)
+	}
+}
+
+// reloadableFilter is a filter.Filter which is rebuilt once the local files
+// it is built from change.
+type reloadableFilter struct {
+	build func() (filter.Filter, error)
+
+	mu     sync.RWMutex
+	filter filter.Filter
+}
+
+var _ filter.Filter = &reloadableFilter{}
+
+func newReloadableFilter(build func() (filter.Filter, error)) (*reloadableFilter, error) {
+	rf := &reloadableFilter{build: build}
+	if err := rf.load(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// load rebuilds the filter.
+func (rf *reloadableFilter) load() error {
+	f, err := rf.build()
+	if err != nil {
+		return err
+	}
+	rf.mu.Lock()
+	old := rf.filter
+	rf.filter = f
+	rf.mu.Unlock()
+	// lookups hold the lock, so that none is using the old filter.
+	closeFilter(old)
+	return nil
+}
+
+// Close closes the filter, e.g., unmaps its snapshots. It matches nothing
+// afterwards.
+func (rf *reloadableFilter) Close() error {
+	empty, err := filter.New("ranges", nil)
+	if err != nil {
+		return err
+	}
+	rf.mu.Lock()
+	old := rf.filter
+	rf.filter = empty
+	rf.mu.Unlock()
+	closeFilter(old)
+	return nil
+}
+
+func (rf *reloadableFilter) Add(subnet net.IPNet) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.filter.Add(subnet)
+}
+
+func (rf *reloadableFilter) Contains(ip net.IP) bool {
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	return rf.filter.Contains(ip)
+}
+
+func (rf *reloadableFilter) ContainsAddr(a filter.Addr) bool {
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	return rf.filter.ContainsAddr(a)
+}
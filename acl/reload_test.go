@@ -0,0 +1,115 @@
+package acl
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func Test_reloader_check(t *testing.T) {
+	file, err := ioutil.TempFile("", "acl-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+
+	loads := 0
+	rl := newReloader()
+	rl.Watch(file.Name(), func() error {
+		loads++
+		return nil
+	})
+
+	rl.check()
+	if loads != 0 {
+		t.Errorf("reloader reloads unchanged file %d times, want 0", loads)
+	}
+
+	if err := ioutil.WriteFile(file.Name(), []byte("10.0.0.0/8"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rl.check()
+	if loads != 1 {
+		t.Errorf("reloader reloads changed file %d times, want 1", loads)
+	}
+
+	rl.check()
+	if loads != 1 {
+		t.Errorf("reloader reloads unchanged file %d times, want 1", loads)
+	}
+}
+
+func Test_rpzZone_reload(t *testing.T) {
+	envSetup(rpzTestFiles)
+	defer envCleanup(rpzTestFiles)
+
+	z, err := newRPZZone("acl-test-rpz.db")
+	if err != nil {
+		t.Fatalf("cannot load RPZ: %v", err)
+	}
+	rl := newReloader()
+	rl.Watch(z.file, z.load)
+	if act := z.queryAction(nil, "new.example.com."); act != nil {
+		t.Fatalf("rpzZone.queryAction() = %v before reload, want nil", act.kind)
+	}
+
+	content := rpzTestFiles["acl-test-rpz.db"] + "new.example.com CNAME .\n"
+	if err := ioutil.WriteFile("acl-test-rpz.db", []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time changes on file systems with coarse timestamps.
+	later := time.Now().Add(time.Second)
+	os.Chtimes("acl-test-rpz.db", later, later)
+
+	rl.check()
+	act := z.queryAction(nil, "new.example.com.")
+	if act == nil || act.kind != rpzNXDomain {
+		t.Errorf("rpzZone.queryAction() after reload = %v, want %s", act, rpzNXDomain)
+	}
+}
+
+func Test_acl_ServeDNS_reloadNetworks(t *testing.T) {
+	files := map[string]string{
+		"acl-test-reload-nets.txt": "192.168.0.0/24\n",
+	}
+	envSetup(files)
+	defer envCleanup(files)
+
+	a, err := parseACL(caddy.NewTestController("dns", `
+	acl . {
+		block type ANY file acl-test-reload-nets.txt
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	query := func() int {
+		w := &testResponseWriter{}
+		w.setRemoteIP("10.0.0.1")
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+			t.Fatalf("acl.ServeDNS() error = %v", err)
+		}
+		return w.Rcode
+	}
+
+	if rcode := query(); rcode != dns.RcodeSuccess {
+		t.Fatalf("acl.ServeDNS() Rcode = %v before reload, want %v", rcode, dns.RcodeSuccess)
+	}
+	if err := ioutil.WriteFile("acl-test-reload-nets.txt", []byte("192.168.0.0/24\n10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a.reloader.check()
+	if rcode := query(); rcode != dns.RcodeRefused {
+		t.Errorf("acl.ServeDNS() Rcode = %v after reload, want %v", rcode, dns.RcodeRefused)
+	}
+}
@@ -0,0 +1,382 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Actions of Response Policy Zones.
+const (
+	rpzNXDomain = "nxdomain"
+	rpzNoData   = "nodata"
+	rpzPassthru = "passthru"
+	rpzDrop     = "drop"
+	rpzTCPOnly  = "tcp-only"
+	rpzLocal    = "local"
+)
+
+// Suffixes of special triggers in Response Policy Zones.
+const (
+	rpzClientIPSuffix = ".rpz-client-ip"
+	rpzIPSuffix       = ".rpz-ip"
+	rpzNSDNameSuffix  = ".rpz-nsdname"
+	rpzNSIPSuffix     = ".rpz-nsip"
+)
+
+// rpzAction is the action of a trigger in a Response Policy Zone.
+type rpzAction struct {
+	kind string
+	// data holds the records of local data, only used by rpzLocal.
+	data []dns.RR
+}
+
+// rpzIPTrigger is a client-ip or response-ip trigger.
+type rpzIPTrigger struct {
+	subnet net.IPNet
+	action *rpzAction
+}
+
+// rpzPolicy holds all triggers loaded from a Response Policy Zone.
+type rpzPolicy struct {
+	qnames       map[string]*rpzAction
+	wildcards    map[string]*rpzAction
+	nsdnames     map[string]*rpzAction
+	nsdWildcards map[string]*rpzAction
+	// IP triggers are sorted by prefix length in descending order, so the
+	// longest matching prefix is found first.
+	clientIPs   []rpzIPTrigger
+	responseIPs []rpzIPTrigger
+}
+
+// rpzZone is a Response Policy Zone loaded from a local file in master-file
+// format, which can be reloaded when the file changes.
+type rpzZone struct {
+	file string
+
+	mu     sync.RWMutex
+	policy *rpzPolicy
+}
+
+func newRPZZone(file string) (*rpzZone, error) {
+	z := &rpzZone{file: file}
+	if err := z.load(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// load (re)loads the zone from its file.
+func (z *rpzZone) load() error {
+	policy, err := loadRPZ(z.file)
+	if err != nil {
+		return err
+	}
+	z.mu.Lock()
+	z.policy = policy
+	z.mu.Unlock()
+	return nil
+}
+
+func (z *rpzZone) current() *rpzPolicy {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.policy
+}
+
+// queryAction returns the action of the client-ip or QNAME trigger matching
+// the query, or nil if none matches. Client-ip triggers take precedence.
+func (z *rpzZone) queryAction(ip net.IP, qname string) *rpzAction {
+	p := z.current()
+	if act := matchIP(p.clientIPs, ip); act != nil {
+		return act
+	}
+	return matchName(p.qnames, p.wildcards, qname)
+}
+
+// responseAction returns the action of the response-ip or NSDNAME trigger
+// matching the response, or nil if none matches. Response-ip triggers take
+// precedence. NSDNAME triggers are matched against the NS records in the
+// authority section of the response.
+func (z *rpzZone) responseAction(res *dns.Msg) *rpzAction {
+	p := z.current()
+	for _, rr := range res.Answer {
+		var ip net.IP
+		switch r := rr.(type) {
+		case *dns.A:
+			ip = r.A
+		case *dns.AAAA:
+			ip = r.AAAA
+		default:
+			continue
+		}
+		if act := matchIP(p.responseIPs, ip); act != nil {
+			return act
+		}
+	}
+	for _, rr := range res.Ns {
+		if ns, ok := rr.(*dns.NS); ok {
+			if act := matchName(p.nsdnames, p.nsdWildcards, ns.Ns); act != nil {
+				return act
+			}
+		}
+	}
+	return nil
+}
+
+// rpzQueryAction returns the action of the first trigger in the rule's zones
+// matching the query, or nil if none matches.
+func rpzQueryAction(rule Rule, state request.Request) (*rpzAction, error) {
+	ip, _, err := clientIP(rule, state)
+	if err != nil {
+		return nil, err
+	}
+	for _, z := range rule.rpzZones {
+		if act := z.queryAction(ip, state.Name()); act != nil {
+			return act, nil
+		}
+	}
+	return nil, nil
+}
+
+func matchIP(triggers []rpzIPTrigger, ip net.IP) *rpzAction {
+	for _, t := range triggers {
+		if t.subnet.Contains(ip) {
+			return t.action
+		}
+	}
+	return nil
+}
+
+// matchName matches name against exact triggers first, and then against
+// wildcard triggers from the closest ancestor.
+func matchName(exact, wildcards map[string]*rpzAction, name string) *rpzAction {
+	name = strings.ToLower(dns.Fqdn(name))
+	if act, ok := exact[name]; ok {
+		return act
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if act, ok := wildcards[name[off:]]; ok {
+			return act
+		}
+	}
+	return nil
+}
+
+// reply creates the response to r according to the action. A nil response
+// means the query should be dropped. rpzPassthru and rpzTCPOnly are left to
+// the caller.
+func (act *rpzAction) reply(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	switch act.kind {
+	case rpzDrop:
+		return nil
+	case rpzNXDomain:
+		m.SetRcode(r, dns.RcodeNameError)
+	case rpzNoData:
+		m.SetReply(r)
+	case rpzLocal:
+		m.SetReply(r)
+		if len(r.Question) == 0 {
+			break
+		}
+		q := r.Question[0]
+		for _, rr := range act.data {
+			if rr.Header().Rrtype != q.Qtype && rr.Header().Rrtype != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			// a wildcard CNAME target is expanded with the query name.
+			if cname, ok := rr.(*dns.CNAME); ok && strings.HasPrefix(cname.Target, "*.") {
+				cname.Target = q.Name + cname.Target[2:]
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	m.RecursionAvailable = r.RecursionAvailable
+	return m
+}
+
+// loadRPZ loads a Response Policy Zone from a local file in master-file format.
+func loadRPZ(fileName string) (*rpzPolicy, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	p := &rpzPolicy{
+		qnames:       make(map[string]*rpzAction),
+		wildcards:    make(map[string]*rpzAction),
+		nsdnames:     make(map[string]*rpzAction),
+		nsdWildcards: make(map[string]*rpzAction),
+	}
+	origin := ""
+	zp := dns.NewZoneParser(file, "", fileName)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if hdr.Rrtype == dns.TypeSOA {
+			if origin == "" {
+				origin = name
+			}
+			continue
+		}
+		if origin == "" {
+			return nil, fmt.Errorf("%s: missing SOA record before '%s'", fileName, hdr.Name)
+		}
+		// the NS records of the zone apex are not triggers.
+		if name == origin {
+			continue
+		}
+		if !dns.IsSubDomain(origin, name) {
+			log.Warningf("Skip RPZ record '%s' out of zone '%s' in %s", hdr.Name, origin, fileName)
+			continue
+		}
+		trigger := strings.TrimSuffix(name, "."+origin)
+		if err := p.add(trigger, rr); err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if origin == "" {
+		return nil, fmt.Errorf("%s: missing SOA record", fileName)
+	}
+
+	byPrefixLen := func(triggers []rpzIPTrigger) func(i, j int) bool {
+		return func(i, j int) bool {
+			ones1, _ := triggers[i].subnet.Mask.Size()
+			ones2, _ := triggers[j].subnet.Mask.Size()
+			return ones1 > ones2
+		}
+	}
+	sort.SliceStable(p.clientIPs, byPrefixLen(p.clientIPs))
+	sort.SliceStable(p.responseIPs, byPrefixLen(p.responseIPs))
+	return p, nil
+}
+
+// add adds a record of trigger to the policy.
+func (p *rpzPolicy) add(trigger string, rr dns.RR) error {
+	switch {
+	case strings.HasSuffix(trigger, rpzClientIPSuffix):
+		subnet, err := parseRPZIP(strings.TrimSuffix(trigger, rpzClientIPSuffix))
+		if err != nil {
+			return err
+		}
+		p.clientIPs = addIPTrigger(p.clientIPs, subnet, rr)
+	case strings.HasSuffix(trigger, rpzIPSuffix):
+		subnet, err := parseRPZIP(strings.TrimSuffix(trigger, rpzIPSuffix))
+		if err != nil {
+			return err
+		}
+		p.responseIPs = addIPTrigger(p.responseIPs, subnet, rr)
+	case strings.HasSuffix(trigger, rpzNSDNameSuffix):
+		addNameTrigger(p.nsdnames, p.nsdWildcards, strings.TrimSuffix(trigger, rpzNSDNameSuffix), rr)
+	case strings.HasSuffix(trigger, rpzNSIPSuffix):
+		log.Warningf("Skip unsupported RPZ trigger '%s'", trigger)
+	default:
+		addNameTrigger(p.qnames, p.wildcards, trigger, rr)
+	}
+	return nil
+}
+
+func addIPTrigger(triggers []rpzIPTrigger, subnet net.IPNet, rr dns.RR) []rpzIPTrigger {
+	for _, t := range triggers {
+		if t.subnet.String() == subnet.String() {
+			t.action.merge(rr)
+			return triggers
+		}
+	}
+	return append(triggers, rpzIPTrigger{subnet: subnet, action: newRPZAction(rr)})
+}
+
+func addNameTrigger(exact, wildcards map[string]*rpzAction, name string, rr dns.RR) {
+	m := exact
+	if strings.HasPrefix(name, "*.") {
+		m = wildcards
+		name = name[2:]
+	}
+	name = dns.Fqdn(name)
+	if act, ok := m[name]; ok {
+		act.merge(rr)
+		return
+	}
+	m[name] = newRPZAction(rr)
+}
+
+func newRPZAction(rr dns.RR) *rpzAction {
+	if cname, ok := rr.(*dns.CNAME); ok {
+		switch strings.ToLower(cname.Target) {
+		case ".":
+			return &rpzAction{kind: rpzNXDomain}
+		case "*.":
+			return &rpzAction{kind: rpzNoData}
+		case "rpz-passthru.":
+			return &rpzAction{kind: rpzPassthru}
+		case "rpz-drop.":
+			return &rpzAction{kind: rpzDrop}
+		case "rpz-tcp-only.":
+			return &rpzAction{kind: rpzTCPOnly}
+		}
+	}
+	return &rpzAction{kind: rpzLocal, data: []dns.RR{rr}}
+}
+
+// merge adds rr to the local data of the action. Other actions of the same
+// trigger are ignored.
+func (act *rpzAction) merge(rr dns.RR) {
+	if act.kind != rpzLocal {
+		return
+	}
+	if other := newRPZAction(rr); other.kind == rpzLocal {
+		act.data = append(act.data, rr)
+	}
+}
+
+// parseRPZIP parses the IP address and prefix length encoded in the labels
+// of a client-ip or response-ip trigger, e.g., '24.0.2.0.192' stands for
+// 192.0.2.0/24 and '48.zz.db8.2001' stands for 2001:db8::/48.
+func parseRPZIP(s string) (net.IPNet, error) {
+	labels := strings.Split(s, ".")
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil || len(labels) < 2 {
+		return net.IPNet{}, fmt.Errorf("Illegal RPZ IP trigger '%s'", s)
+	}
+	parts := labels[1:]
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+
+	var raw string
+	if len(parts) == 4 && !strings.Contains(s, "zz") {
+		raw = strings.Join(parts, ".")
+	} else {
+		for i, part := range parts {
+			if part != "zz" {
+				continue
+			}
+			parts[i] = ""
+			if i == 0 || i == len(parts)-1 {
+				parts = append(parts[:i], append([]string{""}, parts[i:]...)...)
+			}
+			break
+		}
+		raw = strings.Join(parts, ":")
+	}
+	_, subnet, err := net.ParseCIDR(raw + "/" + strconv.Itoa(prefix))
+	if err != nil {
+		return net.IPNet{}, fmt.Errorf("Illegal RPZ IP trigger '%s'", s)
+	}
+	return *subnet, nil
+}
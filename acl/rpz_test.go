@@ -0,0 +1,164 @@
+package acl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+var rpzTestFiles = map[string]string{
+	"acl-test-rpz.db": `$TTL 300
+$ORIGIN rpz.example.
+@                               SOA  localhost. admin.localhost. 1 3600 600 86400 300
+                                NS   localhost.
+nxdomain.example.com            CNAME .
+*.nxdomain.example.com          CNAME .
+nodata.example.com              CNAME *.
+passthru.nxdomain.example.com   CNAME rpz-passthru.
+drop.example.com                CNAME rpz-drop.
+tcp.example.com                 CNAME rpz-tcp-only.
+local.example.com               A    10.0.0.1
+local.example.com               A    10.0.0.2
+local.example.com               TXT  "blocked"
+*.garden.example.com            CNAME *.walled.example.net.
+32.2.2.0.192.rpz-client-ip      CNAME .
+24.0.2.0.192.rpz-client-ip      CNAME rpz-passthru.
+24.0.113.0.203.rpz-ip           CNAME .
+ns.bad.example.rpz-nsdname      CNAME *.
+`,
+}
+
+func Test_parseRPZIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"IPv4 host", "32.1.2.0.192", "192.0.2.1/32", false},
+		{"IPv4 subnet", "24.0.2.0.192", "192.0.2.0/24", false},
+		{"IPv6 host", "128.1.zz.db8.2001", "2001:db8::1/128", false},
+		{"IPv6 subnet", "48.zz.db8.2001", "2001:db8::/48", false},
+		{"IPv6 full", "64.0.0.0.0.0.0.db8.2001", "2001:db8::/64", false},
+		{"IPv6 leading zz", "128.1.zz", "::1/128", false},
+		{"Missing prefix", "1.2.0.192", "", true},
+		{"Illegal prefix", "33.1.2.0.192", "", true},
+		{"Missing address", "32", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRPZIP(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseRPZIP() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("parseRPZIP() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_rpz(t *testing.T) {
+	envSetup(rpzTestFiles)
+	defer envCleanup(rpzTestFiles)
+
+	tests := []struct {
+		name        string
+		qname       string
+		qtype       uint16
+		sourceIP    string
+		tcp         bool
+		answers     []string
+		ns          []string
+		wantWritten bool
+		wantRcode   int
+		wantAnswers []string
+		wantTC      bool
+	}{
+		{"QNAME NXDOMAIN", "nxdomain.example.com.", dns.TypeA, "10.1.0.2", false, nil, nil, true, dns.RcodeNameError, nil, false},
+		{"QNAME wildcard NXDOMAIN", "a.b.nxdomain.example.com.", dns.TypeA, "10.1.0.2", false, nil, nil, true, dns.RcodeNameError, nil, false},
+		{"QNAME NODATA", "nodata.example.com.", dns.TypeA, "10.1.0.2", false, nil, nil, true, dns.RcodeSuccess, nil, false},
+		{"QNAME PASSTHRU", "passthru.nxdomain.example.com.", dns.TypeA, "10.1.0.2", false, []string{"passthru.nxdomain.example.com. 300 IN A 1.2.3.4"}, nil, true, dns.RcodeSuccess, []string{"1.2.3.4"}, false},
+		{"QNAME DROP", "drop.example.com.", dns.TypeA, "10.1.0.2", false, nil, nil, false, 0, nil, false},
+		{"QNAME TCP-only over UDP", "tcp.example.com.", dns.TypeA, "10.1.0.2", false, nil, nil, true, dns.RcodeSuccess, nil, true},
+		{"QNAME TCP-only over TCP", "tcp.example.com.", dns.TypeA, "10.1.0.2", true, []string{"tcp.example.com. 300 IN A 1.2.3.4"}, nil, true, dns.RcodeSuccess, []string{"1.2.3.4"}, false},
+		{"QNAME local data", "local.example.com.", dns.TypeA, "10.1.0.2", false, nil, nil, true, dns.RcodeSuccess, []string{"10.0.0.1", "10.0.0.2"}, false},
+		{"QNAME local data wildcard CNAME", "www.garden.example.com.", dns.TypeA, "10.1.0.2", false, nil, nil, true, dns.RcodeSuccess, []string{"www.garden.example.com.walled.example.net."}, false},
+		{"Client IP NXDOMAIN", "www.example.org.", dns.TypeA, "192.0.2.2", false, nil, nil, true, dns.RcodeNameError, nil, false},
+		{"Client IP PASSTHRU", "nxdomain.example.com.", dns.TypeA, "192.0.2.3", false, []string{"nxdomain.example.com. 300 IN A 1.2.3.4"}, nil, true, dns.RcodeSuccess, []string{"1.2.3.4"}, false},
+		{"Response IP NXDOMAIN", "www.example.org.", dns.TypeA, "10.1.0.2", false, []string{"www.example.org. 300 IN A 203.0.113.1"}, nil, true, dns.RcodeNameError, nil, false},
+		{"NSDNAME NODATA", "www.example.org.", dns.TypeA, "10.1.0.2", false, []string{"www.example.org. 300 IN A 1.2.3.4"}, []string{"example.org. 300 IN NS ns.bad.example."}, true, dns.RcodeSuccess, nil, false},
+		{"No trigger", "www.example.org.", dns.TypeA, "10.1.0.2", false, []string{"www.example.org. 300 IN A 1.2.3.4"}, []string{"example.org. 300 IN NS ns.example.org."}, true, dns.RcodeSuccess, []string{"1.2.3.4"}, false},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseACL(caddy.NewTestController("dns", `
+			acl . {
+				rpz acl-test-rpz.db
+			}`))
+			if err != nil {
+				t.Fatalf("cannot parse acl from config: %v", err)
+			}
+			a.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				for _, answer := range tt.answers {
+					m.Answer = append(m.Answer, test.A(answer))
+				}
+				for _, ns := range tt.ns {
+					m.Ns = append(m.Ns, test.NS(ns))
+				}
+				w.WriteMsg(m)
+				return dns.RcodeSuccess, nil
+			})
+
+			w := &testResponseWriter{}
+			if tt.tcp {
+				w.setRemoteTCPIP(tt.sourceIP)
+			} else {
+				w.setRemoteIP(tt.sourceIP)
+			}
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, tt.qtype)
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if (w.Msg != nil) != tt.wantWritten {
+				t.Fatalf("acl.ServeDNS() writes response = %v, want %v", w.Msg != nil, tt.wantWritten)
+			}
+			if w.Msg == nil {
+				return
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+			if w.Msg.Truncated != tt.wantTC {
+				t.Errorf("acl.ServeDNS() Truncated = %v, want %v", w.Msg.Truncated, tt.wantTC)
+			}
+			var answers []string
+			for _, rr := range w.Msg.Answer {
+				switch r := rr.(type) {
+				case *dns.A:
+					answers = append(answers, r.A.String())
+				case *dns.CNAME:
+					answers = append(answers, r.Target)
+				}
+			}
+			if len(answers) != len(tt.wantAnswers) {
+				t.Fatalf("acl.ServeDNS() answers = %v, want %v", answers, tt.wantAnswers)
+			}
+			for i := range answers {
+				if answers[i] != tt.wantAnswers[i] {
+					t.Errorf("acl.ServeDNS() answers = %v, want %v", answers, tt.wantAnswers)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package acl
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// schedule restricts a policy to specific days of week and times of day,
+// and optionally to an absolute period so that temporary policies expire on
+// their own.
+type schedule struct {
+	// days is a bitmask of the days of week, indexed by time.Weekday. Zero
+	// means any day.
+	days uint8
+	// ranges are the times of day. Empty means all day.
+	ranges []timeRange
+	loc    *time.Location
+	// from and until bound the period of the schedule, with until
+	// excluded. An until given as a date is the end of that day. Zero means
+	// unbounded.
+	from  time.Time
+	until time.Time
+
+	now func() time.Time
+}
+
+// timeRange is a range of time of day in minutes since midnight, with end
+// excluded. A range whose end is before its start wraps around midnight.
+type timeRange struct {
+	start int
+	end   int
+}
+
+// weekdays maps the names of days of week to time.Weekday.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// active reports whether the schedule is active now.
+func (s *schedule) active() bool {
+	t := s.now().In(s.loc)
+	if !s.from.IsZero() && t.Before(s.from) {
+		return false
+	}
+	if !s.until.IsZero() && !t.Before(s.until) {
+		return false
+	}
+
+	day := t.Weekday()
+	if len(s.ranges) == 0 {
+		return s.onDay(day)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range s.ranges {
+		if r.start < r.end {
+			if minute >= r.start && minute < r.end && s.onDay(day) {
+				return true
+			}
+			continue
+		}
+		// a range wrapping around midnight belongs to the day it starts.
+		if minute >= r.start && s.onDay(day) {
+			return true
+		}
+		if minute < r.end && s.onDay((day+6)%7) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *schedule) onDay(day time.Weekday) bool {
+	return s.days == 0 || s.days&(1<<uint(day)) != 0
+}
+
+// parseSchedule parses the values of a 'schedule' clause:
+//
+//	schedule [days DAYS...] [time HH:MM-HH:MM...] [tz ZONE] [from DATE] [until DATE]
+//
+// DAYS are names of days of week or ranges of them, e.g., 'mon-fri' or
+// 'sat,sun'. DATE is in the form of '2006-01-02' or '2006-01-02T15:04', in
+// the time zone of the schedule, which defaults to the local time zone. The
+// day of an until DATE without time is included.
+func parseSchedule(values []string) (*schedule, error) {
+	s := &schedule{loc: time.Local, now: time.Now}
+	var rawFrom, rawUntil string
+	var option string
+	for _, v := range values {
+		lower := strings.ToLower(v)
+		switch lower {
+		case "days", "time", "tz", "from", "until":
+			option = lower
+			continue
+		}
+		switch option {
+		case "days":
+			for _, raw := range strings.Split(lower, ",") {
+				days, err := parseDays(raw)
+				if err != nil {
+					return nil, err
+				}
+				s.days |= days
+			}
+		case "time":
+			r, err := parseTimeRange(v)
+			if err != nil {
+				return nil, err
+			}
+			s.ranges = append(s.ranges, r)
+		case "tz":
+			loc, err := time.LoadLocation(v)
+			if err != nil {
+				return nil, fmt.Errorf("Illegal time zone '%s'", v)
+			}
+			s.loc = loc
+			option = ""
+		case "from":
+			rawFrom = v
+			option = ""
+		case "until":
+			rawUntil = v
+			option = ""
+		default:
+			return nil, fmt.Errorf("Unexpected token '%s'; expect 'days', 'time', 'tz', 'from' or 'until'", v)
+		}
+	}
+	if s.days == 0 && len(s.ranges) == 0 && rawFrom == "" && rawUntil == "" {
+		return nil, fmt.Errorf("empty schedule")
+	}
+
+	var err error
+	if rawFrom != "" {
+		if s.from, _, err = parseDate(rawFrom, s.loc); err != nil {
+			return nil, err
+		}
+	}
+	if rawUntil != "" {
+		var dateOnly bool
+		if s.until, dateOnly, err = parseDate(rawUntil, s.loc); err != nil {
+			return nil, err
+		}
+		if dateOnly {
+			s.until = s.until.AddDate(0, 0, 1)
+		}
+	}
+	if !s.from.IsZero() && !s.until.IsZero() && !s.from.Before(s.until) {
+		return nil, fmt.Errorf("'from' %s is not before 'until' %s", rawFrom, rawUntil)
+	}
+	return s, nil
+}
+
+// parseDays parses a day of week or a range of them, e.g., 'mon' or
+// 'fri-mon', into a bitmask.
+func parseDays(raw string) (uint8, error) {
+	parts := strings.Split(raw, "-")
+	if len(parts) > 2 {
+		return 0, fmt.Errorf("Illegal days '%s'", raw)
+	}
+	start, ok := weekdays[parts[0]]
+	if !ok {
+		return 0, fmt.Errorf("Illegal day '%s'; expect 'mon', 'tue', 'wed', 'thu', 'fri', 'sat' or 'sun'", parts[0])
+	}
+	end := start
+	if len(parts) == 2 {
+		if end, ok = weekdays[parts[1]]; !ok {
+			return 0, fmt.Errorf("Illegal day '%s'; expect 'mon', 'tue', 'wed', 'thu', 'fri', 'sat' or 'sun'", parts[1])
+		}
+	}
+	var days uint8
+	for d := start; ; d = (d + 1) % 7 {
+		days |= 1 << uint(d)
+		if d == end {
+			return days, nil
+		}
+	}
+}
+
+// parseTimeRange parses a range of time of day, e.g., '22:00-07:00'.
+func parseTimeRange(raw string) (timeRange, error) {
+	parts := strings.Split(raw, "-")
+	if len(parts) != 2 {
+		return timeRange{}, fmt.Errorf("Illegal time range '%s'; expect HH:MM-HH:MM", raw)
+	}
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return timeRange{}, err
+	}
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return timeRange{}, err
+	}
+	if start == end || start == 24*60 {
+		return timeRange{}, fmt.Errorf("Illegal time range '%s'", raw)
+	}
+	return timeRange{start: start, end: end}, nil
+}
+
+// parseTimeOfDay parses a time of day in the form of 'HH:MM' into minutes
+// since midnight. '24:00' stands for the end of a day.
+func parseTimeOfDay(raw string) (int, error) {
+	var hour, minute int
+	if n, err := fmt.Sscanf(raw, "%d:%d", &hour, &minute); err != nil || n != 2 || len(raw) != 5 {
+		return 0, fmt.Errorf("Illegal time '%s'; expect HH:MM", raw)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("Illegal time '%s'; expect HH:MM", raw)
+	}
+	return hour*60 + minute, nil
+}
+
+// parseDate parses a date in the form of '2006-01-02' or '2006-01-02T15:04'
+// in loc, and reports whether it is without time.
+func parseDate(raw string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", raw, loc); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", raw, loc); err == nil {
+		return t, false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("Illegal date '%s'; expect YYYY-MM-DD or YYYY-MM-DDTHH:MM", raw)
+}
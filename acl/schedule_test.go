@@ -0,0 +1,139 @@
+package acl
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func Test_parseSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  string
+		wantErr bool
+	}{
+		{"Days", "days mon-fri sat,sun", false},
+		{"Days wrapping", "days fri-mon", false},
+		{"Time ranges", "time 08:00-12:00 13:00-24:00", false},
+		{"Period", "tz UTC from 2026-01-01 until 2026-01-02T08:30", false},
+		{"Empty", "", true},
+		{"Empty days", "days", true},
+		{"Illegal day", "days mon-fri-sat", true},
+		{"Illegal time", "time 8:00-12:00", true},
+		{"Illegal minute", "time 08:60-12:00", true},
+		{"Empty time range", "time 08:00-08:00", true},
+		{"Illegal time zone", "tz Nowhere", true},
+		{"Illegal date", "from 2026-13-01", true},
+		{"Reversed period", "from 2026-02-01 until 2026-01-01", true},
+		{"Single day period", "from 2026-01-01 until 2026-01-01", false},
+		{"Empty period", "from 2026-01-01T08:00 until 2026-01-01T08:00", true},
+		{"Unexpected token", "mon-fri", true},
+		{"Multiple time zones", "tz UTC Europe/Berlin", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSchedule(strings.Fields(tt.values))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_schedule_active(t *testing.T) {
+	// 2026-10-16 is a Friday.
+	at := func(value string) time.Time {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		name   string
+		values string
+		now    time.Time
+		want   bool
+	}{
+		{"Day", "days fri", at("2026-10-16T12:00:00Z"), true},
+		{"Other day", "days sat-sun", at("2026-10-16T12:00:00Z"), false},
+		{"Time", "time 08:00-17:00", at("2026-10-16T08:00:00Z"), true},
+		{"End of time range", "time 08:00-17:00", at("2026-10-16T17:00:00Z"), false},
+		{"End of day", "time 22:00-24:00", at("2026-10-16T23:59:59Z"), true},
+		{"Wrapping before midnight", "days fri time 22:00-07:00", at("2026-10-16T23:00:00Z"), true},
+		{"Wrapping after midnight", "days fri time 22:00-07:00", at("2026-10-17T06:59:00Z"), true},
+		{"Wrapping from previous day", "days fri time 22:00-07:00", at("2026-10-16T01:00:00Z"), false},
+		{"Time zone", "days fri time 22:00-24:00 tz Europe/Berlin", at("2026-10-16T21:30:00Z"), true},
+		{"Time zone other day", "days thu tz Asia/Tokyo", at("2026-10-15T16:00:00Z"), false},
+		{"Before period", "tz UTC from 2026-10-17", at("2026-10-16T23:59:59Z"), false},
+		{"In period", "tz UTC from 2026-10-01 until 2026-11-01", at("2026-10-16T12:00:00Z"), true},
+		{"Expired", "tz UTC until 2026-10-16T12:00", at("2026-10-16T12:00:00Z"), false},
+		{"Until date", "tz UTC until 2026-10-16", at("2026-10-16T23:59:59Z"), true},
+		{"After until date", "tz UTC until 2026-10-16", at("2026-10-17T00:00:00Z"), false},
+		{"Until date in time zone", "tz Europe/Berlin until 2026-10-16", at("2026-10-16T22:30:00Z"), false},
+		{"Period and time", "tz UTC until 2026-11-01 time 08:00-17:00", at("2026-10-16T18:00:00Z"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseSchedule(strings.Fields(tt.values))
+			if err != nil {
+				t.Fatalf("parseSchedule() error = %v", err)
+			}
+			if s.loc == time.Local {
+				s.loc = time.UTC
+			}
+			s.now = (&fakeClock{t: tt.now}).Now
+			if got := s.active(); got != tt.want {
+				t.Errorf("schedule.active() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_acl_ServeDNS_schedule(t *testing.T) {
+	a, err := parseACL(caddy.NewTestController("dns", `acl example.org {
+		block type ANY net 192.168.0.0/16 schedule days mon-fri time 22:00-06:00 tz UTC
+		allow type ANY net ANY schedule tz UTC until 2026-11-01
+		block type ANY net ANY
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+	clock := &fakeClock{t: time.Date(2026, 10, 16, 21, 0, 0, 0, time.UTC)}
+	for _, p := range a.Rules[0].Policies {
+		if p.schedule != nil {
+			p.schedule.now = clock.Now
+		}
+	}
+
+	ctx := context.Background()
+	for i, tt := range []struct {
+		advance   time.Duration
+		wantRcode int
+	}{
+		{0, dns.RcodeSuccess},
+		{time.Hour, dns.RcodeRefused},
+		{7 * time.Hour, dns.RcodeRefused},
+		{time.Hour, dns.RcodeSuccess},
+		{30 * 24 * time.Hour, dns.RcodeRefused},
+	} {
+		clock.Advance(tt.advance)
+		w := &testResponseWriter{}
+		w.setRemoteIP("192.168.0.2")
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.", dns.TypeA)
+		if _, err := a.ServeDNS(ctx, w, m); err != nil {
+			t.Fatalf("acl.ServeDNS() error = %v", err)
+		}
+		if w.Rcode != tt.wantRcode {
+			t.Errorf("query %d at %v: acl.ServeDNS() Rcode = %v, want %v", i, clock.Now(), w.Rcode, tt.wantRcode)
+		}
+	}
+}
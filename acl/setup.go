@@ -1,11 +1,10 @@
 package acl
 
 import (
-	"bufio"
 	"fmt"
 	"net"
-	"os"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/caddyserver/caddy"
@@ -13,6 +12,7 @@ import (
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/ihac/acl/acl/filter"
 	"github.com/miekg/dns"
 )
@@ -27,6 +27,8 @@ var (
 	// PrivateNets defines all ip addresses reserved for private networks.
 	// i.e., 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16.
 	PrivateNets = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+	// loopbackNets are the admin networks of explain queries by default.
+	loopbackNets = []string{"127.0.0.0/8", "::1/128"}
 )
 
 func init() {
@@ -41,32 +43,52 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return err
 	}
+	a.transport = dnsserver.GetConfig(c).Transport
 
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		a.Next = next
 		return a
 	})
 
+	c.OnStartup(a.reloader.Start)
+	c.OnShutdown(a.reloader.Stop)
+	// shutdown callbacks also run on restarts, once the old servers stop.
+	c.OnShutdown(a.close)
+
 	// Register all metrics.
 	c.OnStartup(func() error {
-		metrics.MustRegister(c, RequestBlockCount, RequestAllowCount)
+		metrics.MustRegister(c, RequestBlockCount, RequestAllowCount, RequestDropCount, RequestTruncateCount, ResponseBlockCount, RPZHitCount)
 		return nil
 	})
 	return nil
 }
 
 func parseACL(c *caddy.Controller) (acl, error) {
-	a := acl{}
+	a := acl{reloader: newReloader()}
+	// network sets are shared by all blocks, and defined before being used.
+	sets := netSets{}
 	/*
 	 * acl [ZONES...] {
-	 *   ACTION type QTYPE net SOURCE
+	 *   ACTION type QTYPE [net SOURCE [except SOURCE...]] [domains FILE... [except domains FILE...]] [except net SOURCE... name NAME...] [geo [!]COUNTRY...] [asn [!]ASN...] [tunnel [SETTING VALUE...]] [opcode OPCODE...] [class CLASS...] [flags [!]FLAG...] [edns SETTING...] [proto PROTO...] [listen ADDR...] [ecs NET...] [schedule SCHEDULE] [response refuse | nxdomain | drop]
+	 *   allow | block answer net SOURCE [except zones ZONES...] [response strip | refuse | nxdomain]
 	 *   ...
+	 *   trusted_proxies NET...
+	 *   client_ip ecs | proxy | header NAME...
+	 *   policy_file FILE
+	 *   rpz FILE
+	 *   reload DURATION
+	 *   match first | longest-prefix
+	 *   explain [NET...]
+	 *   lint off | warn | fatal
 	 * }
 	 *
-	 * ACTION: allow | block
+	 * ACTION: allow | block | truncate | ratelimit RATE [OPTIONS...]
+	 * PROTO: udp | tcp | tls | https | grpc
 	 */
 	for c.Next() {
 		r := Rule{}
+		lintMode := lintWarn
+		matchMode := matchFirst
 		// load <ZONES...>.
 		r.Zones = c.RemainingArgs()
 		if len(r.Zones) == 0 {
@@ -79,84 +101,788 @@ func parseACL(c *caddy.Controller) (acl, error) {
 			r.Zones[i] = plugin.Host(r.Zones[i]).Normalize()
 		}
 
-		var err error
 		// load all tokens in this block.
 		for c.NextBlock() {
-			p := Policy{}
-			// ACTION type QTYPE net SOURCE
-			p.action = strings.ToLower(c.Val())
-			if p.action != ALLOW && p.action != BLOCK {
-				return a, c.Errf("Unexpected token '%s'; expect '%s' or '%s'", c.Val(), ALLOW, BLOCK)
-			}
+			switch strings.ToLower(c.Val()) {
+			case "trusted_proxies":
+				proxies, err := parseNetworks(c, preprocessNetworks(c.RemainingArgs()))
+				if err != nil {
+					return a, err
+				}
+				if len(proxies) == 0 {
+					return a, c.ArgErr()
+				}
+				r.trustedProxies, err = filter.New("ranges", proxies)
+				if err != nil {
+					return a, c.Errf("Unable to initialize filter: %v", err)
+				}
+			case "rpz":
+				if !c.NextArg() {
+					return a, c.ArgErr()
+				}
+				z, err := newRPZZone(c.Val())
+				if err != nil {
+					return a, c.Errf("Unable to load response policy zone: %v", err)
+				}
+				a.reloader.Watch(z.file, z.load)
+				r.rpzZones = append(r.rpzZones, z)
+				if c.NextArg() {
+					return a, c.ArgErr()
+				}
+			case "policy_file":
+				if !c.NextArg() {
+					return a, c.ArgErr()
+				}
+				pf, err := newPolicyFile(c.Val())
+				if err != nil {
+					return a, c.Errf("Unable to load policy file: %v", err)
+				}
+				a.reloader.Watch(pf.name, pf.load)
+				// policies in the file are evaluated in place.
+				r.Policies = append(r.Policies, Policy{text: "policy_file " + pf.name, file: pf})
+				if c.NextArg() {
+					return a, c.ArgErr()
+				}
+			case "lint":
+				if !c.NextArg() {
+					return a, c.ArgErr()
+				}
+				lintMode = strings.ToLower(c.Val())
+				if lintMode != lintOff && lintMode != lintWarn && lintMode != lintFatal {
+					return a, c.Errf("Unexpected token '%s'; expect '%s', '%s' or '%s'", c.Val(), lintOff, lintWarn, lintFatal)
+				}
+				if c.NextArg() {
+					return a, c.ArgErr()
+				}
+			case "explain":
+				if a.explain {
+					return a, c.Errf("'explain' is specified more than once")
+				}
+				a.explain = true
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					// only local admins by default.
+					args = loopbackNets
+				}
+				admins, err := parseNetworks(c, preprocessNetworks(args))
+				if err != nil {
+					return a, err
+				}
+				a.explainAdmins, err = filter.New("ranges", admins)
+				if err != nil {
+					return a, c.Errf("Unable to initialize filter: %v", err)
+				}
+			case "match":
+				if !c.NextArg() {
+					return a, c.ArgErr()
+				}
+				matchMode = strings.ToLower(c.Val())
+				if matchMode != matchFirst && matchMode != matchLongestPrefix {
+					return a, c.Errf("Unexpected token '%s'; expect '%s' or '%s'", c.Val(), matchFirst, matchLongestPrefix)
+				}
+				if c.NextArg() {
+					return a, c.ArgErr()
+				}
+			case "reload":
+				if !c.NextArg() {
+					return a, c.ArgErr()
+				}
+				interval, err := time.ParseDuration(c.Val())
+				if err != nil || interval < 0 {
+					return a, c.Errf("Illegal reload interval '%s'", c.Val())
+				}
+				a.reloader.interval = interval
+				if c.NextArg() {
+					return a, c.ArgErr()
+				}
+			case "geoip":
+				if !c.NextArg() {
+					return a, c.ArgErr()
+				}
+				if r.geo != nil {
+					return a, c.Errf("'geoip' is specified more than once")
+				}
+				db, err := newGeoDB(c.Val())
+				if err != nil {
+					return a, c.Errf("Unable to load GeoIP database: %v", err)
+				}
+				a.reloader.Watch(db.name, db.load)
+				r.geo = db
+				if c.NextArg() {
+					return a, c.ArgErr()
+				}
+			case "asn_db":
+				if !c.NextArg() {
+					return a, c.ArgErr()
+				}
+				if r.asn != nil {
+					return a, c.Errf("'asn_db' is specified more than once")
+				}
+				db, err := newASNDB(c.Val())
+				if err != nil {
+					return a, c.Errf("Unable to load ASN table: %v", err)
+				}
+				a.reloader.Watch(db.name, db.load)
+				r.asn = db
+				if c.NextArg() {
+					return a, c.ArgErr()
+				}
+			case "netset":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return a, c.ArgErr()
+				}
+				name := args[0]
+				if sets[name] != nil {
+					return a, c.Errf("network set '%s' is defined more than once", name)
+				}
+				src := &source{}
+				for args = args[1:]; len(args) > 0; {
+					var values []string
+					clause := strings.ToLower(args[0])
+					values, args = clauseValues(args[1:])
+					if clause != "net" && clause != "file" {
+						return a, c.Errf("Unexpected token '%s'; expect 'net' or 'file'", clause)
+					}
+					if err := src.add(c, clause, values, sets); err != nil {
+						return a, err
+					}
+				}
+				sets[name] = src
+			case "client_ip":
+				r.clientIPFrom = nil
+				args := c.RemainingArgs()
+				for i := 0; i < len(args); i++ {
+					source := clientIPSource{from: strings.ToLower(args[i])}
+					switch source.from {
+					case clientIPFromECS, clientIPFromProxy:
+					case clientIPFromHeader:
+						i++
+						if i == len(args) {
+							return a, c.ArgErr()
+						}
+						source.header = args[i]
+					default:
+						return a, c.Errf("Unexpected token '%s'; expect '%s', '%s' or '%s'", args[i], clientIPFromECS, clientIPFromProxy, clientIPFromHeader)
+					}
+					r.clientIPFrom = append(r.clientIPFrom, source)
+				}
+				if len(r.clientIPFrom) == 0 {
+					return a, c.ArgErr()
+				}
+			default:
+				// peek at the whole line with a copy of the dispenser.
+				peek := c.Dispenser
+				text := strings.Join(append([]string{c.Val()}, peek.RemainingArgs()...), " ")
 
-			if !c.NextArg() {
-				return a, c.ArgErr()
+				action := strings.ToLower(c.Val())
+				if !c.NextArg() {
+					return a, c.ArgErr()
+				}
+				if strings.ToLower(c.Val()) == "answer" {
+					p, err := parseAnswerPolicy(c, action, a.reloader, sets)
+					if err != nil {
+						return a, err
+					}
+					p.text = text
+					r.answerPolicies = append(r.answerPolicies, p)
+					continue
+				}
+				p, err := parsePolicy(c, action, a.reloader, sets)
+				if err != nil {
+					return a, err
+				}
+				p.text = text
+				r.Policies = append(r.Policies, p)
+			}
+		}
+		if r.trustedProxies == nil {
+			if len(r.clientIPFrom) > 0 {
+				return a, c.Errf("'client_ip' requires 'trusted_proxies'")
 			}
-			if strings.ToLower(c.Val()) != "type" {
-				return a, c.Errf("Unexpected token '%s'; expect 'type'", c.Val())
+			for _, p := range r.Policies {
+				if p.ecs != nil {
+					return a, c.Errf("'ecs' requires 'trusted_proxies'")
+				}
 			}
-
-			if !c.NextArg() {
-				return a, c.ArgErr()
+		}
+		for _, p := range r.Policies {
+			if p.geo == nil {
+				continue
+			}
+			if r.geo == nil {
+				return a, c.Errf("'geo' requires 'geoip'")
+			}
+			p.geo.db = r.geo
+		}
+		for _, p := range r.Policies {
+			if p.asn == nil {
+				continue
 			}
-			p.qtype, err = parseQype(c.Val())
+			if r.asn == nil {
+				return a, c.Errf("'asn' requires 'asn_db'")
+			}
+			p.asn.db = r.asn
+		}
+		if matchMode == matchLongestPrefix {
+			for _, p := range r.Policies {
+				if p.file != nil {
+					return a, c.Errf("'policy_file' is not supported with 'match %s'", matchLongestPrefix)
+				}
+			}
+			var err error
+			r.prefixes, err = newPrefixIndex(r.Policies)
 			if err != nil {
-				return a, err
+				return a, c.Errf("%v", err)
 			}
-
-			if !c.NextArg() {
-				return a, c.ArgErr()
+			for _, p := range r.Policies {
+				if p.src == nil {
+					continue
+				}
+				for _, name := range p.src.watched() {
+					a.reloader.Watch(name, r.prefixes.load)
+				}
+			}
+		}
+		if lintMode != lintOff {
+			warnings := lint(r)
+			for _, w := range warnings {
+				log.Warningf("acl %s: %s", strings.Join(r.Zones, " "), w)
+			}
+			if lintMode == lintFatal && len(warnings) > 0 {
+				return a, c.Errf("%s", strings.Join(warnings, "; "))
 			}
+		}
+		r.compile()
+		a.Rules = append(a.Rules, r)
+	}
+	a.zones = newZoneTree(a.Rules)
+	return a, nil
+}
 
-			var rawNetRanges []string
-			sourceType := strings.ToLower(c.Val())
-			if sourceType == "net" {
-				rawNetRanges = preprocessNetworks(c.RemainingArgs())
-			} else if sourceType == "file" {
-				if !c.NextArg() {
-					return a, c.ArgErr()
+// parsePolicy parses a policy following its action. Local files which the
+// policy is loaded from are watched by rl, and network sets are referred to
+// by '@NAME'.
+func parsePolicy(c *caddy.Controller, action string, rl *reloader, sets netSets) (Policy, error) {
+	p := Policy{}
+	var err error
+	// ACTION type QTYPE net SOURCE
+	p.action = action
+	if !isPolicyAction(p.action) {
+		return p, c.Errf("Unexpected token '%s'; expect '%s', '%s', '%s' or '%s'", action, ALLOW, BLOCK, TRUNCATE, RATELIMIT)
+	}
+
+	if p.action == RATELIMIT {
+		p.limiter, err = parseRateLimiter(c)
+		if err != nil {
+			return p, err
+		}
+	}
+	if strings.ToLower(c.Val()) != "type" {
+		return p, c.Errf("Unexpected token '%s'; expect 'type'", c.Val())
+	}
+
+	if !c.NextArg() {
+		return p, c.ArgErr()
+	}
+	p.qtype, err = parseQype(c.Val())
+	if err != nil {
+		return p, err
+	}
+
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return p, c.ArgErr()
+	}
+	src := source{}
+	var domainFiles, exceptDomainFiles []string
+	for len(args) > 0 {
+		var values []string
+		clause := strings.ToLower(args[0])
+		values, args = clauseValues(args[1:])
+		switch clause {
+		case "net", "file":
+			if err := src.add(c, clause, values, sets); err != nil {
+				return p, err
+			}
+		case "domains":
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			domainFiles = append(domainFiles, values...)
+		case "except":
+			if len(values) > 0 {
+				// networks removed from the source.
+				if err := src.except(c, values, sets); err != nil {
+					return p, err
 				}
-				rawNetRanges, err = loadNetworksFromLocalFile(c.Val())
+				continue
+			}
+			// otherwise, 'except' is followed by the clauses it negates.
+			if len(args) > 0 && strings.ToLower(args[0]) != "domains" {
+				if p.exception != nil {
+					return p, c.Errf("'except net' or 'except name' is specified more than once")
+				}
+				p.exception, args, err = parseException(c, args, rl, sets)
 				if err != nil {
-					return a, c.Errf("Unable to load networks from local file: %v", err)
+					return p, err
 				}
-			} else {
-				return a, c.Errf("Unexpected token '%s'; expect 'net'", c.Val())
+				continue
 			}
-
-			if len(rawNetRanges) == 0 {
-				return a, c.Errf("no network is specified")
+			if len(args) == 0 {
+				return p, c.Errf("Unexpected end of line; expect 'except SOURCE...', 'except domains FILE...' or 'except net SOURCE... name NAME...'")
 			}
-			var sources []net.IPNet
-			for _, rawNet := range rawNetRanges {
-				rawNet = normalize(rawNet)
-				_, source, err := net.ParseCIDR(rawNet)
+			values, args = clauseValues(args[1:])
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			exceptDomainFiles = append(exceptDomainFiles, values...)
+		case "proto":
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			for _, v := range values {
+				proto := strings.ToLower(v)
+				if !isProto(proto) {
+					return p, c.Errf("Unexpected token '%s'; expect 'udp', 'tcp', 'tls', 'https' or 'grpc'", v)
+				}
+				p.protos = append(p.protos, proto)
+			}
+		case "opcode":
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			for _, v := range values {
+				opcode, err := parseOpcode(v)
 				if err != nil {
-					return a, c.Errf("Illegal CIDR notation '%s'", rawNet)
+					return p, c.Errf("%v", err)
 				}
-				sources = append(sources, *source)
+				p.opcodes = append(p.opcodes, opcode)
 			}
-
-			// TODO: do not hard code 'trie' here. (@ihac)
-			p.filter, err = filter.New("trie", sources)
+		case "class":
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			for _, v := range values {
+				class, err := parseClass(v)
+				if err != nil {
+					return p, c.Errf("%v", err)
+				}
+				p.classes = append(p.classes, class)
+			}
+		case "flags":
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			p.flags, err = parseFlags(c, values)
+			if err != nil {
+				return p, err
+			}
+		case "edns":
+			p.edns, err = parseEDNS(c, values)
+			if err != nil {
+				return p, err
+			}
+		case "ecs":
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			nets, err := parseNetworks(c, preprocessNetworks(values))
+			if err != nil {
+				return p, err
+			}
+			p.ecs, err = filter.New("ranges", nets)
 			if err != nil {
-				return a, c.Errf("Unable to initialize filter: %v", err)
+				return p, c.Errf("Unable to initialize filter: %v", err)
 			}
-			r.Policies = append(r.Policies, p)
+		case "listen":
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			locals, err := parseNetworks(c, values)
+			if err != nil {
+				return p, err
+			}
+			p.local, err = filter.New("ranges", locals)
+			if err != nil {
+				return p, c.Errf("Unable to initialize filter: %v", err)
+			}
+		case "geo":
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			p.geo, err = parseGeo(c, values)
+			if err != nil {
+				return p, err
+			}
+		case "asn":
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			p.asn, err = parseASNMatcher(c, values)
+			if err != nil {
+				return p, err
+			}
+		case "tunnel":
+			p.tunnel, err = parseTunnel(c, values)
+			if err != nil {
+				return p, err
+			}
+		case "schedule":
+			if len(values) == 0 {
+				return p, c.ArgErr()
+			}
+			p.schedule, err = parseSchedule(values)
+			if err != nil {
+				return p, c.Errf("Illegal schedule: %v", err)
+			}
+		case "response":
+			if len(values) != 1 {
+				return p, c.ArgErr()
+			}
+			if p.action != BLOCK {
+				return p, c.Errf("'response' requires action '%s'", BLOCK)
+			}
+			p.response, err = parseBlockResponse(values[0])
+			if err != nil {
+				return p, c.Errf("%v", err)
+			}
+		default:
+			return p, c.Errf("Unexpected token '%s'; expect 'net', 'file', 'domains', 'except', 'geo', 'asn', 'tunnel', 'opcode', 'class', 'flags', 'edns', 'proto', 'listen', 'ecs', 'schedule' or 'response'", clause)
 		}
-		a.Rules = append(a.Rules, r)
 	}
-	return a, nil
+
+	if len(domainFiles) > 0 {
+		p.domains, err = newDomainSet(domainFiles, exceptDomainFiles)
+		if err != nil {
+			return p, c.Errf("Unable to load domains from local file: %v", err)
+		}
+		for _, file := range append(domainFiles, exceptDomainFiles...) {
+			rl.Watch(file, p.domains.load)
+		}
+	} else if len(exceptDomainFiles) > 0 {
+		return p, c.Errf("'except domains' requires 'domains'")
+	}
+
+	if src.empty() {
+		if p.domains == nil && p.geo == nil && p.asn == nil && p.tunnel == nil && len(p.opcodes) == 0 && len(p.classes) == 0 && p.flags == nil && p.edns == nil {
+			return p, c.Errf("no 'net', 'file', 'domains', 'geo', 'asn', 'tunnel', 'opcode', 'class', 'flags' or 'edns' is specified")
+		}
+		if src.exclude != nil {
+			return p, c.Errf("'except SOURCE' requires 'net' or 'file'")
+		}
+		// match any source.
+		return p, nil
+	}
+	p.src = &src
+	p.filter, err = src.filter(c, rl)
+	return p, err
+}
+
+// source defines the networks of a policy, specified by 'net' and 'file'
+// clauses.
+type source struct {
+	specified bool
+	nets      []string
+	// literals are the networks of 'net' clauses which are not keywords.
+	literals []string
+	files    []networkFile
+	// exclude holds the networks removed from the source, specified by
+	// 'except' clauses.
+	exclude *source
+}
+
+// netSets maps the names of network sets to their networks.
+type netSets map[string]*source
+
+func (s *source) add(c *caddy.Controller, clause string, values []string, sets netSets) error {
+	if clause == "net" {
+		if len(values) == 0 {
+			return c.ArgErr()
+		}
+		s.specified = true
+		for _, v := range values {
+			if !strings.HasPrefix(v, "@") {
+				s.nets = append(s.nets, preprocessNetworks([]string{v})...)
+				if !isNetworkKeyword(v) {
+					s.literals = append(s.literals, v)
+				}
+				continue
+			}
+			set := sets[v[1:]]
+			if set == nil {
+				return c.Errf("Unknown network set '%s'", v)
+			}
+			s.nets = append(s.nets, set.nets...)
+			s.literals = append(s.literals, set.literals...)
+			s.files = append(s.files, set.files...)
+		}
+		return nil
+	}
+	s.specified = true
+	// file LOCAL_FILE [skip_bad_lines] [cache]
+	if len(values) == 0 || len(values) > 3 {
+		return c.ArgErr()
+	}
+	nf := networkFile{pattern: values[0]}
+	for _, option := range values[1:] {
+		switch strings.ToLower(option) {
+		case "skip_bad_lines":
+			nf.skipBadLines = true
+		case "cache":
+			if hasMeta(nf.pattern) {
+				return c.Errf("'cache' is not supported for glob patterns")
+			}
+			nf.cache = true
+			nf.readOnly = isOffline(c)
+		default:
+			return c.Errf("Unexpected token '%s'; expect 'skip_bad_lines' or 'cache'", option)
+		}
+	}
+	s.files = append(s.files, nf)
+	return nil
+}
+
+func (s *source) empty() bool {
+	return !s.specified
+}
+
+// except removes the networks of values, which are specified as in 'net'
+// clauses, from the source.
+func (s *source) except(c *caddy.Controller, values []string, sets netSets) error {
+	if s.exclude == nil {
+		s.exclude = &source{}
+	}
+	return s.exclude.add(c, "net", values, sets)
+}
+
+// watched returns the paths whose changes should trigger a rebuild of the
+// source.
+func (s *source) watched() []string {
+	var names []string
+	for _, file := range s.files {
+		names = append(names, file.watched()...)
+	}
+	if s.exclude != nil {
+		names = append(names, s.exclude.watched()...)
+	}
+	return names
+}
+
+// hasFiles reports whether the source, including its exclusion, loads any
+// network file.
+func (s *source) hasFiles() bool {
+	return len(s.files) > 0 || s.exclude != nil && s.exclude.hasFiles()
+}
+
+// cached reports whether any network file of the source is cached.
+func (s *source) cached() bool {
+	for _, file := range s.files {
+		if file.cache {
+			return true
+		}
+	}
+	return false
 }
 
-// normalize appends '/32' for any single ip address.
+// networks loads all networks of the source.
+func (s *source) networks() ([]net.IPNet, error) {
+	rawNetRanges := append([]string(nil), s.nets...)
+	for _, file := range s.files {
+		nets, err := file.load()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load networks from local file: %v", err)
+		}
+		rawNetRanges = append(rawNetRanges, nets...)
+	}
+	// empty network files are allowed, e.g., feeds which are temporarily
+	// empty, and warned by lint.
+	if len(rawNetRanges) == 0 && len(s.files) == 0 {
+		return nil, fmt.Errorf("no network is specified")
+	}
+	nets, err := parseCIDRs(rawNetRanges)
+	if err != nil || s.exclude == nil {
+		return nets, err
+	}
+	excluded, err := s.exclude.networks()
+	if err != nil {
+		return nil, err
+	}
+	return filter.Difference(nets, excluded)
+}
+
+// build loads all networks and creates the filter. Networks of cached files
+// are loaded from their snapshots, unless networks are removed from the
+// source, which snapshots do not support.
+func (s *source) build() (filter.Filter, error) {
+	uncached := *s
+	uncached.files = nil
+	var snapshots multiFilter
+	for _, file := range s.files {
+		if !file.cache || s.exclude != nil {
+			uncached.files = append(uncached.files, file)
+			continue
+		}
+		f, err := file.snapshot()
+		if err != nil {
+			snapshots.Close()
+			return nil, fmt.Errorf("Unable to load networks from local file: %v", err)
+		}
+		snapshots = append(snapshots, f)
+	}
+	if len(snapshots) > 0 && len(uncached.nets) == 0 && len(uncached.files) == 0 {
+		if len(snapshots) == 1 {
+			return snapshots[0], nil
+		}
+		return snapshots, nil
+	}
+
+	sources, err := uncached.networks()
+	if err != nil {
+		snapshots.Close()
+		return nil, err
+	}
+	// the ranges filter holds both IPv4 and IPv6 networks, unlike the trie.
+	f, err := filter.New("ranges", sources)
+	if err != nil {
+		snapshots.Close()
+		return nil, fmt.Errorf("Unable to initialize filter: %v", err)
+	}
+	if len(snapshots) > 0 {
+		// the first filter takes networks added later.
+		return append(multiFilter{f}, snapshots...), nil
+	}
+	return f, nil
+}
+
+// filter creates the filter of the source. Filters loaded from local files
+// are rebuilt once the files change.
+func (s *source) filter(c *caddy.Controller, rl *reloader) (filter.Filter, error) {
+	if !s.hasFiles() {
+		f, err := s.build()
+		if err != nil {
+			return nil, c.Errf("%v", err)
+		}
+		return f, nil
+	}
+	rf, err := newReloadableFilter(s.build)
+	if err != nil {
+		return nil, c.Errf("%v", err)
+	}
+	for _, name := range s.watched() {
+		rl.Watch(name, rf.load)
+	}
+	return rf, nil
+}
+
+// policyClauses defines all keywords which start a new clause in a policy.
+var policyClauses = map[string]bool{
+	"net":      true,
+	"file":     true,
+	"proto":    true,
+	"listen":   true,
+	"ecs":      true,
+	"domains":  true,
+	"except":   true,
+	"name":     true,
+	"geo":      true,
+	"asn":      true,
+	"tunnel":   true,
+	"opcode":   true,
+	"class":    true,
+	"flags":    true,
+	"edns":     true,
+	"schedule": true,
+	// clauses of answer policies.
+	"response": true,
+}
+
+// clauseValues splits args into the values of current clause and the
+// remaining clauses.
+func clauseValues(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if policyClauses[strings.ToLower(arg)] {
+			return args[:i], args[i:]
+		}
+	}
+	return args, nil
+}
+
+// parseNetworks parses IP addresses or subnets in CIDR notation.
+func parseNetworks(c *caddy.Controller, rawNets []string) ([]net.IPNet, error) {
+	nets, err := parseCIDRs(rawNets)
+	if err != nil {
+		return nil, c.Errf("%v", err)
+	}
+	return nets, nil
+}
+
+func parseCIDRs(rawNets []string) ([]net.IPNet, error) {
+	var nets []net.IPNet
+	for _, rawNet := range rawNets {
+		rawNet = normalize(rawNet)
+		_, n, err := net.ParseCIDR(rawNet)
+		if err != nil {
+			return nil, fmt.Errorf("Illegal CIDR notation '%s'", rawNet)
+		}
+		nets = append(nets, *n)
+	}
+	return nets, nil
+}
+
+func isProto(proto string) bool {
+	switch proto {
+	case "udp", "tcp", transport.TLS, transport.HTTPS, transport.GRPC:
+		return true
+	}
+	return false
+}
+
+func isPolicyAction(action string) bool {
+	switch action {
+	case ALLOW, BLOCK, TRUNCATE, RATELIMIT:
+		return true
+	}
+	return false
+}
+
+// parseBlockResponse parses the response of a block policy, i.e., 'refuse',
+// 'nxdomain' or 'drop', and returns the action taken instead of BLOCK, or
+// empty for REFUSED.
+func parseBlockResponse(raw string) (string, error) {
+	switch strings.ToLower(raw) {
+	case "refuse":
+		return "", nil
+	case "nxdomain":
+		return NXDOMAIN, nil
+	case "drop":
+		return DROP, nil
+	}
+	return "", fmt.Errorf("Illegal response '%s'; expect 'refuse', 'nxdomain' or 'drop'", raw)
+}
+
+// normalize appends '/32' for any single IPv4 address, or '/128' for any
+// single IPv6 address.
 func normalize(rawNet string) string {
 	if idx := strings.IndexAny(rawNet, "/"); idx >= 0 {
 		return rawNet
 	}
+	if strings.Contains(rawNet, ":") {
+		return rawNet + "/128"
+	}
 	return rawNet + "/32"
 }
 
+// isNetworkKeyword reports whether rawNet is a keyword standing for networks,
+// i.e., PRIVATE, LOCAL, ANY or *.
+func isNetworkKeyword(rawNet string) bool {
+	switch rawNet {
+	case "PRIVATE", "LOCAL", "ANY", "*":
+		return true
+	}
+	return false
+}
+
 func preprocessNetworks(rawNets []string) []string {
 	var nets []string
 	for _, rawNet := range rawNets {
@@ -189,7 +915,7 @@ func preprocessNetworks(rawNets []string) []string {
 		case "*":
 			fallthrough
 		case "ANY":
-			return []string{"0.0.0.0/0"}
+			return []string{"0.0.0.0/0", "::/0"}
 		default:
 			nets = append(nets, rawNet)
 		}
@@ -198,25 +924,6 @@ func preprocessNetworks(rawNets []string) []string {
 	return nets
 }
 
-func loadNetworksFromLocalFile(fileName string) ([]string, error) {
-	var nets []string
-	file, err := os.Open(fileName)
-	defer file.Close()
-	if err != nil {
-		return nil, err
-	}
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := stripComment(scanner.Text())
-		// skip empty line.
-		if line == "" {
-			continue
-		}
-		nets = append(nets, line)
-	}
-	return nets, nil
-}
-
 // remove comments.
 func stripComment(line string) string {
 	commentCh := "#"
@@ -236,6 +943,8 @@ func parseQype(raw string) (uint16, error) {
 		return dns.TypeAAAA, nil
 	case "AFSDB":
 		return dns.TypeAFSDB, nil
+	case "AXFR":
+		return dns.TypeAXFR, nil
 	case "CAA":
 		return dns.TypeCAA, nil
 	case "CDNSKEY":
@@ -258,6 +967,8 @@ func parseQype(raw string) (uint16, error) {
 		return dns.TypeDS, nil
 	case "HIP":
 		return dns.TypeHIP, nil
+	case "IXFR":
+		return dns.TypeIXFR, nil
 	case "KEY":
 		return dns.TypeKEY, nil
 	case "KX":
@@ -314,3 +1025,34 @@ func parseQype(raw string) (uint16, error) {
 		return 0, fmt.Errorf("Unexpected token '%s'; expect legal QTYPE", raw)
 	}
 }
+
+// parseOpcode parses an opcode, i.e., QUERY, IQUERY, NOTIFY or UPDATE.
+func parseOpcode(raw string) (int, error) {
+	switch strings.ToUpper(raw) {
+	case "QUERY":
+		return dns.OpcodeQuery, nil
+	case "IQUERY":
+		return dns.OpcodeIQuery, nil
+	case "NOTIFY":
+		return dns.OpcodeNotify, nil
+	case "UPDATE":
+		return dns.OpcodeUpdate, nil
+	}
+	return 0, fmt.Errorf("Illegal opcode '%s'; expect 'QUERY', 'IQUERY', 'NOTIFY' or 'UPDATE'", raw)
+}
+
+// parseClass parses a query class, i.e., IN, CH, HS or ANY. Unlike QTYPE,
+// ANY stands for the class ANY of queries, rather than all classes.
+func parseClass(raw string) (uint16, error) {
+	switch strings.ToUpper(raw) {
+	case "IN":
+		return dns.ClassINET, nil
+	case "CH":
+		return dns.ClassCHAOS, nil
+	case "HS":
+		return dns.ClassHESIOD, nil
+	case "ANY":
+		return dns.ClassANY, nil
+	}
+	return 0, fmt.Errorf("Illegal class '%s'; expect 'IN', 'CH', 'HS' or 'ANY'", raw)
+}
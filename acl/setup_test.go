@@ -12,6 +12,17 @@ var (
 		"acl-setup-test-1.txt": `10.218.128.0/24
 35.39.53.223/32
 43.105.127.35/18`,
+		"acl-setup-test-rpz.db": `$ORIGIN rpz.example.
+@ 300 SOA localhost. admin.localhost. 1 3600 600 86400 300
+bad.example.com 300 CNAME .`,
+		"acl-setup-test-bad-rpz.db": `bad.example.com. 300 CNAME .`,
+		"acl-setup-test-2.txt": `10.0.0.0/8
+10.0.0`,
+		"acl-setup-test-empty.txt": `# no networks yet`,
+		"acl-setup-test-policy.yaml": `policies:
+  - {name: block-lab, action: block, networks: [192.168.1.0/24]}`,
+		"acl-setup-test-domains.txt": `0.0.0.0 ads.example.com
+tracker.example.com`,
 	}
 )
 
@@ -41,6 +52,7 @@ func envCleanup(files map[string]string) {
 func Test_setup(t *testing.T) {
 	envSetup(setupTestFiles)
 	defer envCleanup(setupTestFiles)
+	defer os.Remove("acl-setup-test-2.txt" + snapshotSuffix)
 
 	tests := []struct {
 		name    string
@@ -161,6 +173,678 @@ func Test_setup(t *testing.T) {
 			`),
 			false,
 		},
+		{
+			"Local file bad line",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A file acl-setup-test-2.txt
+			}
+			`),
+			true,
+		},
+		{
+			"Local file skip bad lines",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A file acl-setup-test-2.txt skip_bad_lines
+			}
+			`),
+			false,
+		},
+		{
+			"Local file cache",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A file acl-setup-test-2.txt cache skip_bad_lines
+			}
+			`),
+			false,
+		},
+		{
+			"Network set",
+			caddy.NewTestController("dns", `
+			acl {
+				netset corp net 10.1.0.0/16 file acl-setup-test-1.txt
+				block type A net 10.0.0.0/8 except @corp
+			}
+			`),
+			false,
+		},
+		{
+			"Block response",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A net 10.0.0.0/8 response nxdomain
+			}
+			`),
+			false,
+		},
+		{
+			"Illegal block response",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A net 10.0.0.0/8 response slip
+			}
+			`),
+			true,
+		},
+		{
+			"Response without block",
+			caddy.NewTestController("dns", `
+			acl {
+				allow type A net 10.0.0.0/8 response drop
+			}
+			`),
+			true,
+		},
+		{
+			"Network set undefined",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A net @corp
+			}
+			`),
+			true,
+		},
+		{
+			"Network set defined twice",
+			caddy.NewTestController("dns", `
+			acl {
+				netset corp net 10.1.0.0/16
+				netset corp net 10.2.0.0/16
+			}
+			`),
+			true,
+		},
+		{
+			"Network set illegal clause",
+			caddy.NewTestController("dns", `
+			acl {
+				netset corp domains acl-setup-test-1.txt
+			}
+			`),
+			true,
+		},
+		{
+			"Except without source",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A domains acl-setup-test-1.txt except 10.1.0.0/16
+			}
+			`),
+			true,
+		},
+		{
+			"Inline exception",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A net 10.0.0.0/8 except net 10.1.0.0/16 file acl-setup-test-1.txt name *.corp. proto udp
+			}
+			`),
+			false,
+		},
+		{
+			"Inline exception twice",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A net 10.0.0.0/8 except net 10.1.0.0/16 proto udp except name corp.
+			}
+			`),
+			true,
+		},
+		{
+			"Inline exception illegal name",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A net 10.0.0.0/8 except name bad..name
+			}
+			`),
+			true,
+		},
+		{
+			"Inline exception empty",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A net 10.0.0.0/8 except
+			}
+			`),
+			true,
+		},
+		{
+			"Opcodes and classes",
+			caddy.NewTestController("dns", `
+			acl {
+				allow type ANY opcode notify update net 192.0.2.1
+				block type ANY opcode NOTIFY UPDATE
+				block type ANY class ch hs net ANY
+			}
+			`),
+			false,
+		},
+		{
+			"Illegal opcode",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY opcode STATUS
+			}
+			`),
+			true,
+		},
+		{
+			"Illegal class",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY class CHAOS
+			}
+			`),
+			true,
+		},
+		{
+			"No class",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY class
+			}
+			`),
+			true,
+		},
+		{
+			"Local file glob cache",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A file acl-setup-test-[1].txt cache
+			}
+			`),
+			true,
+		},
+		{
+			"Local file glob",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A file acl-setup-test-[1].txt
+			}
+			`),
+			false,
+		},
+		{
+			"Local file empty",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A file acl-setup-test-empty.txt
+			}
+			`),
+			false,
+		},
+		{
+			"Local file illegal option",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A file acl-setup-test-2.txt lenient
+			}
+			`),
+			true,
+		},
+		{
+			"Truncate 1",
+			caddy.NewTestController("dns", `
+			acl {
+				truncate type ANY net 192.168.0.0/16
+			}
+			`),
+			false,
+		},
+		{
+			"Transport 1",
+			caddy.NewTestController("dns", `
+			acl {
+				allow type AXFR net 10.0.0.0/8 proto tcp tls listen 10.0.0.1
+				block type ANY net ANY proto udp
+			}
+			`),
+			false,
+		},
+		{
+			"Transport illegal proto",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY net ANY proto sctp
+			}
+			`),
+			true,
+		},
+		{
+			"Transport missing listen address",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY net ANY listen
+			}
+			`),
+			true,
+		},
+		{
+			"Transport missing source",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY proto udp
+			}
+			`),
+			true,
+		},
+		{
+			"ECS 1",
+			caddy.NewTestController("dns", `
+			acl {
+				trusted_proxies 10.0.0.0/24 10.0.1.1
+				client_ip ecs
+				block type ANY net 192.168.0.0/16
+				block type ANY net ANY ecs 172.16.0.0/12
+			}
+			`),
+			false,
+		},
+		{
+			"Client IP 1",
+			caddy.NewTestController("dns", `
+			acl {
+				trusted_proxies 10.0.0.0/24
+				client_ip proxy header X-Forwarded-For ecs
+				block type ANY net 192.168.0.0/16
+			}
+			`),
+			false,
+		},
+		{
+			"ECS without trusted proxies",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY net ANY ecs 172.16.0.0/12
+			}
+			`),
+			true,
+		},
+		{
+			"Client IP without trusted proxies",
+			caddy.NewTestController("dns", `
+			acl {
+				client_ip ecs
+				block type ANY net 192.168.0.0/16
+			}
+			`),
+			true,
+		},
+		{
+			"Client IP illegal source",
+			caddy.NewTestController("dns", `
+			acl {
+				trusted_proxies 10.0.0.0/24
+				client_ip header
+				block type ANY net 192.168.0.0/16
+			}
+			`),
+			true,
+		},
+		{
+			"Answer 1",
+			caddy.NewTestController("dns", `
+			acl {
+				allow answer net 192.168.1.0/24
+				block answer net PRIVATE 127.0.0.0/8 except zones corp.example.com response nxdomain
+			}
+			`),
+			false,
+		},
+		{
+			"Answer illegal action",
+			caddy.NewTestController("dns", `
+			acl {
+				truncate answer net PRIVATE
+			}
+			`),
+			true,
+		},
+		{
+			"Answer illegal response",
+			caddy.NewTestController("dns", `
+			acl {
+				block answer net PRIVATE response servfail
+			}
+			`),
+			true,
+		},
+		{
+			"Answer missing zones",
+			caddy.NewTestController("dns", `
+			acl {
+				block answer net PRIVATE except corp.example.com
+			}
+			`),
+			true,
+		},
+		{
+			"RPZ 1",
+			caddy.NewTestController("dns", `
+			acl {
+				rpz acl-setup-test-rpz.db
+				reload 10s
+				block type ANY net 192.168.0.0/16
+			}
+			`),
+			false,
+		},
+		{
+			"RPZ missing file",
+			caddy.NewTestController("dns", `
+			acl {
+				rpz acl-setup-test-missing.db
+			}
+			`),
+			true,
+		},
+		{
+			"RPZ missing SOA",
+			caddy.NewTestController("dns", `
+			acl {
+				rpz acl-setup-test-bad-rpz.db
+			}
+			`),
+			true,
+		},
+		{
+			"Policy file 1",
+			caddy.NewTestController("dns", `
+			acl {
+				allow type ANY net 192.168.1.1
+				policy_file acl-setup-test-policy.yaml
+				block type ANY net ANY
+			}
+			`),
+			false,
+		},
+		{
+			"Policy file missing file",
+			caddy.NewTestController("dns", `
+			acl {
+				policy_file acl-setup-test-missing.yaml
+			}
+			`),
+			true,
+		},
+		{
+			"Policy file missing argument",
+			caddy.NewTestController("dns", `
+			acl {
+				policy_file
+			}
+			`),
+			true,
+		},
+		{
+			"Schedule 1",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY net 192.168.10.0/24 schedule days mon-fri sat time 22:00-07:00 tz Europe/Berlin
+				allow type ANY net 10.0.0.0/8 schedule from 2026-01-01 until 2026-02-01T12:00 proto tcp
+			}
+			`),
+			false,
+		},
+		{
+			"Schedule empty",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY net 192.168.10.0/24 schedule
+			}
+			`),
+			true,
+		},
+		{
+			"Schedule illegal day",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY net 192.168.10.0/24 schedule days monday
+			}
+			`),
+			true,
+		},
+		{
+			"Schedule illegal time zone",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY net 192.168.10.0/24 schedule tz Mars/Olympus
+			}
+			`),
+			true,
+		},
+		{
+			"Explain 1",
+			caddy.NewTestController("dns", `
+			acl {
+				explain 10.0.0.0/8 LOCAL
+				block type ANY net 192.168.1.0/24
+			}
+			`),
+			false,
+		},
+		{
+			"Explain twice",
+			caddy.NewTestController("dns", `
+			acl example.org {
+				explain 192.168.0.0/16
+			}
+			acl example.com {
+				explain 10.0.0.0/8
+			}
+			`),
+			true,
+		},
+		{
+			"Explain for loopback admins",
+			caddy.NewTestController("dns", `
+			acl example.org {
+				explain
+			}
+			`),
+			false,
+		},
+		{
+			"Explain illegal network",
+			caddy.NewTestController("dns", `
+			acl {
+				explain 10.0.0.0/33
+			}
+			`),
+			true,
+		},
+		{
+			"Match longest-prefix",
+			caddy.NewTestController("dns", `
+			acl {
+				match longest-prefix
+				block type ANY net 10.0.0.0/8
+				allow type ANY net 10.1.0.0/16
+			}
+			`),
+			false,
+		},
+		{
+			"Match illegal mode",
+			caddy.NewTestController("dns", `
+			acl {
+				match best
+			}
+			`),
+			true,
+		},
+		{
+			"Match longest-prefix with policy file",
+			caddy.NewTestController("dns", `
+			acl {
+				match longest-prefix
+				policy_file acl-setup-test-policy.yaml
+			}
+			`),
+			true,
+		},
+		{
+			"Lint 1",
+			caddy.NewTestController("dns", `
+			acl {
+				lint fatal
+				block type A net 10.0.0.0/8
+				allow type A net 192.168.0.0/16
+			}
+			`),
+			false,
+		},
+		{
+			"Lint fatal non-canonical CIDR",
+			caddy.NewTestController("dns", `
+			acl {
+				lint fatal
+				block type A file acl-setup-test-1.txt
+			}
+			`),
+			true,
+		},
+		{
+			"Lint fatal shadowed policy",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY net ANY
+				allow type A net 10.0.0.0/8
+				lint fatal
+			}
+			`),
+			true,
+		},
+		{
+			"Lint off",
+			caddy.NewTestController("dns", `
+			acl {
+				lint off
+				block type ANY net ANY
+				allow type A net 10.0.0.0/8
+			}
+			`),
+			false,
+		},
+		{
+			"Lint illegal mode",
+			caddy.NewTestController("dns", `
+			acl {
+				lint strict
+			}
+			`),
+			true,
+		},
+		{
+			"Reload illegal interval",
+			caddy.NewTestController("dns", `
+			acl {
+				reload often
+			}
+			`),
+			true,
+		},
+		{
+			"Domains 1",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A domains acl-setup-test-domains.txt
+			}
+			`),
+			false,
+		},
+		{
+			"Domains 2",
+			caddy.NewTestController("dns", `
+			acl {
+				block type ANY net PRIVATE domains acl-setup-test-domains.txt except domains acl-setup-test-domains.txt
+			}
+			`),
+			false,
+		},
+		{
+			"Domains missing file",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A domains acl-setup-test-missing.txt
+			}
+			`),
+			true,
+		},
+		{
+			"Domains missing argument",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A domains
+			}
+			`),
+			true,
+		},
+		{
+			"Except domains without domains",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A net ANY except domains acl-setup-test-domains.txt
+			}
+			`),
+			true,
+		},
+		{
+			"Except illegal clause",
+			caddy.NewTestController("dns", `
+			acl {
+				block type A domains acl-setup-test-domains.txt except acl-setup-test-domains.txt
+			}
+			`),
+			true,
+		},
+		{
+			"Ratelimit 1",
+			caddy.NewTestController("dns", `
+			acl {
+				ratelimit 50/s burst 100 type ANY net ANY
+			}
+			`),
+			false,
+		},
+		{
+			"Ratelimit 2",
+			caddy.NewTestController("dns", `
+			acl {
+				ratelimit 600/m prefix 24 prefix6 56 size 1000 response slip type A net 192.168.0.0/16
+			}
+			`),
+			false,
+		},
+		{
+			"Ratelimit missing rate",
+			caddy.NewTestController("dns", `
+			acl {
+				ratelimit type ANY net ANY
+			}
+			`),
+			true,
+		},
+		{
+			"Ratelimit illegal response",
+			caddy.NewTestController("dns", `
+			acl {
+				ratelimit 50/s response ignore type ANY net ANY
+			}
+			`),
+			true,
+		},
+		{
+			"Ratelimit illegal prefix",
+			caddy.NewTestController("dns", `
+			acl {
+				ratelimit 50/s prefix 33 type ANY net ANY
+			}
+			`),
+			true,
+		},
 		{
 			"Missing argument 1",
 			caddy.NewTestController("dns", `
@@ -283,6 +967,16 @@ func Test_normalize(t *testing.T) {
 			args{"10.218.10.8"},
 			"10.218.10.8/32",
 		},
+		{
+			"IPv6 network range",
+			args{"2001:db8::/32"},
+			"2001:db8::/32",
+		},
+		{
+			"IPv6 address",
+			args{"fd00::1"},
+			"fd00::1/128",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,149 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/ihac/acl/acl/filter"
+)
+
+// snapshotSuffix is appended to the path of a network file for the path of
+// its snapshot.
+const snapshotSuffix = ".snapshot"
+
+// snapshotPath returns the path of the snapshot of the file, which is next
+// to it.
+func (nf networkFile) snapshotPath() string {
+	return filepath.Clean(nf.pattern) + snapshotSuffix
+}
+
+// fingerprint identifies the current state of the files matched by the
+// pattern by their names, sizes and modification times, so that snapshots
+// of stale files are detected without reading them.
+func (nf networkFile) fingerprint() ([32]byte, error) {
+	files, err := nf.expand()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "skip_bad_lines=%v\n", nf.skipBadLines)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// snapshot returns the filter of the networks in the file. It is loaded from
+// the snapshot of the file if it is up to date, or otherwise built from the
+// file and written to the snapshot, unless the file is read-only.
+func (nf networkFile) snapshot() (filter.Filter, error) {
+	fp, err := nf.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	path := nf.snapshotPath()
+	s, err := filter.OpenSnapshot(path)
+	switch {
+	case err == nil && s.Fingerprint() == fp:
+		return s, nil
+	case err == nil:
+		s.Close()
+	case !os.IsNotExist(err):
+		log.Warningf("Ignore snapshot '%s': %v", path, err)
+	}
+
+	rawNets, err := nf.load()
+	if err != nil {
+		return nil, err
+	}
+	nets, err := parseCIDRs(rawNets)
+	if err != nil {
+		return nil, err
+	}
+	// the ranges filter holds both IPv4 and IPv6 networks, unlike the trie.
+	f, err := filter.New("ranges", nets)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to initialize filter: %v", err)
+	}
+	if nf.readOnly {
+		return f, nil
+	}
+	if err := writeSnapshot(path, f, fp); err != nil {
+		// the filter works without its snapshot.
+		log.Warningf("Failed to write snapshot '%s': %v", path, err)
+	}
+	return f, nil
+}
+
+// writeSnapshot writes the snapshot of f to a temporary file, and renames it
+// to path, so that snapshots being mapped are never modified.
+func writeSnapshot(path string, f filter.Filter, fingerprint [32]byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := filter.WriteSnapshot(tmp, f, fingerprint); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// multiFilter is a filter.Filter containing the addresses contained by any
+// of its filters.
+type multiFilter []filter.Filter
+
+var _ filter.Filter = multiFilter{}
+
+func (mf multiFilter) Add(subnet net.IPNet) error {
+	return mf[0].Add(subnet)
+}
+
+func (mf multiFilter) Contains(ip net.IP) bool {
+	for _, f := range mf {
+		if f.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mf multiFilter) ContainsAddr(a filter.Addr) bool {
+	for _, f := range mf {
+		if f.ContainsAddr(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the filters which hold resources, e.g., mapped snapshots.
+func (mf multiFilter) Close() error {
+	for _, f := range mf {
+		closeFilter(f)
+	}
+	return nil
+}
+
+// closeFilter closes f if it holds resources, e.g., mapped snapshots.
+func closeFilter(f filter.Filter) {
+	if c, ok := f.(io.Closer); ok {
+		c.Close()
+	}
+}
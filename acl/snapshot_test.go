@@ -0,0 +1,164 @@
+package acl
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/ihac/acl/acl/filter"
+	"github.com/miekg/dns"
+)
+
+func Test_networkFile_snapshot(t *testing.T) {
+	files := map[string]string{"acl-test-cache.txt": "10.1.0.0/16\n"}
+	envSetup(files)
+	defer envCleanup(files)
+	nf := networkFile{pattern: "acl-test-cache.txt", cache: true}
+	defer os.Remove(nf.snapshotPath())
+
+	config := `acl example.org {
+		block type ANY file acl-test-cache.txt cache
+		block type ANY net 192.168.0.0/16
+	}`
+	serve := func(source string) int {
+		a, err := parseACL(caddy.NewTestController("dns", config))
+		if err != nil {
+			t.Fatalf("cannot parse acl from config: %v", err)
+		}
+		a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+		w := &testResponseWriter{}
+		w.setRemoteIP(source)
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.", dns.TypeA)
+		if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+			t.Fatalf("acl.ServeDNS() error = %v", err)
+		}
+		return w.Rcode
+	}
+
+	if rcode := serve("10.1.0.1"); rcode != dns.RcodeRefused {
+		t.Fatalf("acl.ServeDNS() Rcode = %v, want %v", rcode, dns.RcodeRefused)
+	}
+	info, err := os.Stat(nf.snapshotPath())
+	if err != nil {
+		t.Fatalf("snapshot is not written: %v", err)
+	}
+
+	// an up-to-date snapshot is loaded rather than rewritten.
+	f, err := nf.snapshot()
+	if err != nil {
+		t.Fatalf("networkFile.snapshot() error = %v", err)
+	}
+	if _, ok := f.(*filter.Snapshot); !ok {
+		t.Errorf("networkFile.snapshot() = %T, want *filter.Snapshot", f)
+	}
+	f.(*filter.Snapshot).Close()
+	if after, err := os.Stat(nf.snapshotPath()); err != nil || !after.ModTime().Equal(info.ModTime()) {
+		t.Errorf("up-to-date snapshot is rewritten")
+	}
+
+	// a stale snapshot is rebuilt.
+	envSetup(map[string]string{"acl-test-cache.txt": "10.2.0.0/16\n"})
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes("acl-test-cache.txt", later, later); err != nil {
+		t.Fatal(err)
+	}
+	if rcode := serve("10.1.0.1"); rcode != dns.RcodeSuccess {
+		t.Errorf("acl.ServeDNS() Rcode with stale snapshot = %v, want %v", rcode, dns.RcodeSuccess)
+	}
+	if rcode := serve("10.2.0.1"); rcode != dns.RcodeRefused {
+		t.Errorf("acl.ServeDNS() Rcode with stale snapshot = %v, want %v", rcode, dns.RcodeRefused)
+	}
+
+	// a corrupt snapshot is ignored.
+	if err := ioutil.WriteFile(nf.snapshotPath(), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rcode := serve("10.2.0.1"); rcode != dns.RcodeRefused {
+		t.Errorf("acl.ServeDNS() Rcode with corrupt snapshot = %v, want %v", rcode, dns.RcodeRefused)
+	}
+	if rcode := serve("192.168.0.1"); rcode != dns.RcodeRefused {
+		t.Errorf("acl.ServeDNS() Rcode = %v, want %v", rcode, dns.RcodeRefused)
+	}
+}
+
+func Test_networkFile_snapshotIPv6(t *testing.T) {
+	files := map[string]string{"acl-test-cache.txt": "10.1.0.0/16\n2001:db8::/32\n"}
+	envSetup(files)
+	defer envCleanup(files)
+	nf := networkFile{pattern: "acl-test-cache.txt", cache: true}
+	defer os.Remove(nf.snapshotPath())
+
+	f, err := nf.snapshot()
+	if err != nil {
+		t.Fatalf("networkFile.snapshot() error = %v", err)
+	}
+	for _, ip := range []string{"10.1.0.1", "2001:db8::1"} {
+		if !f.Contains(net.ParseIP(ip)) {
+			t.Errorf("networkFile.snapshot() does not contain %s", ip)
+		}
+	}
+	if _, err := os.Stat(nf.snapshotPath()); err != nil {
+		t.Fatalf("snapshot is not written: %v", err)
+	}
+
+	// the snapshot loaded holds IPv6 networks as well.
+	f, err = nf.snapshot()
+	if err != nil {
+		t.Fatalf("networkFile.snapshot() error = %v", err)
+	}
+	defer closeFilter(f)
+	if _, ok := f.(*filter.Snapshot); !ok {
+		t.Fatalf("networkFile.snapshot() = %T, want *filter.Snapshot", f)
+	}
+	for _, ip := range []string{"10.1.0.1", "2001:db8::1"} {
+		if !f.Contains(net.ParseIP(ip)) {
+			t.Errorf("snapshot does not contain %s", ip)
+		}
+	}
+	if f.Contains(net.ParseIP("2001:db9::1")) {
+		t.Errorf("snapshot contains 2001:db9::1")
+	}
+}
+
+func Test_acl_close(t *testing.T) {
+	files := map[string]string{"acl-test-cache.txt": "10.1.0.0/16\n"}
+	envSetup(files)
+	defer envCleanup(files)
+	nf := networkFile{pattern: "acl-test-cache.txt", cache: true}
+	defer os.Remove(nf.snapshotPath())
+
+	config := `acl example.org {
+		block type ANY file acl-test-cache.txt cache
+	}`
+	// the first setup writes the snapshot, which later ones map.
+	if _, err := nf.snapshot(); err != nil {
+		t.Fatalf("networkFile.snapshot() error = %v", err)
+	}
+
+	a, err := parseACL(caddy.NewTestController("dns", config))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	rf := a.Rules[0].Policies[0].filter.(*reloadableFilter)
+	if _, ok := rf.filter.(*filter.Snapshot); !ok {
+		t.Fatalf("filter = %T, want *filter.Snapshot", rf.filter)
+	}
+	if !rf.Contains(net.ParseIP("10.1.0.1")) {
+		t.Fatalf("filter does not contain 10.1.0.1")
+	}
+	if err := a.close(); err != nil {
+		t.Fatalf("acl.close() error = %v", err)
+	}
+	if _, ok := rf.filter.(*filter.Snapshot); ok {
+		t.Errorf("snapshot is not closed")
+	}
+	if rf.Contains(net.ParseIP("10.1.0.1")) {
+		t.Errorf("closed filter contains 10.1.0.1")
+	}
+}
@@ -0,0 +1,356 @@
+package acl
+
+import (
+	"container/list"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/ihac/acl/acl/filter"
+)
+
+const (
+	// defaultTunnelQnameLen, defaultTunnelLabelLen and defaultTunnelLabels
+	// bound the structure of names, which legitimate names rarely exceed.
+	defaultTunnelQnameLen  = 120
+	defaultTunnelLabelLen  = 40
+	defaultTunnelLabels    = 10
+	defaultTunnelEntropy   = 4.0
+	defaultTunnelRatio     = 0.7
+	defaultTunnelUnique    = 30
+	defaultTunnelParent    = 2
+	defaultTunnelCacheSize = 10000
+	// minTunnelSubdomainLen is the minimum length of the subdomains whose
+	// content is checked, as the entropy of short strings is meaningless.
+	minTunnelSubdomainLen = 12
+	// minEncodedLabelLen is the minimum length of labels which may look
+	// like hex or base32.
+	minEncodedLabelLen = 8
+)
+
+// tunnelMatcher matches queries which look like DNS tunneling, i.e., data
+// encoded into the names of queries.
+//
+// Names longer than qnameLen, with labels longer than labelLen or with more
+// than labels labels are matched. The subdomain of a name, i.e., the labels
+// left of its parent of the rightmost parent labels, is matched if its
+// Shannon entropy or the ratio of its hex/base32-looking characters reaches
+// the thresholds, once the client has queried more than unique subdomains of
+// the parent in the current minute. Zero disables a threshold.
+type tunnelMatcher struct {
+	qnameLen int
+	labelLen int
+	labels   int
+	entropy  float64
+	ratio    float64
+	unique   int
+	parent   int
+
+	tracker *subdomainTracker
+}
+
+func newTunnelMatcher() *tunnelMatcher {
+	return &tunnelMatcher{
+		qnameLen: defaultTunnelQnameLen,
+		labelLen: defaultTunnelLabelLen,
+		labels:   defaultTunnelLabels,
+		entropy:  defaultTunnelEntropy,
+		ratio:    defaultTunnelRatio,
+		unique:   defaultTunnelUnique,
+		parent:   defaultTunnelParent,
+		tracker:  newSubdomainTracker(defaultTunnelCacheSize),
+	}
+}
+
+// parseTunnel parses the settings of a 'tunnel' clause, i.e., pairs of a
+// setting and its value.
+func parseTunnel(c *caddy.Controller, values []string) (*tunnelMatcher, error) {
+	/*
+	 * tunnel [qname_len N] [label_len N] [labels N] [entropy F] [ratio F] [unique N] [parent N] [size N]
+	 */
+	t := newTunnelMatcher()
+	for i := 0; i < len(values); i += 2 {
+		setting := strings.ToLower(values[i])
+		if i+1 == len(values) {
+			return nil, c.ArgErr()
+		}
+		raw := values[i+1]
+		var err error
+		switch setting {
+		case "qname_len":
+			t.qnameLen, err = parseTunnelInt(raw, 0)
+		case "label_len":
+			t.labelLen, err = parseTunnelInt(raw, 0)
+		case "labels":
+			t.labels, err = parseTunnelInt(raw, 0)
+		case "unique":
+			t.unique, err = parseTunnelInt(raw, 0)
+		case "parent":
+			t.parent, err = parseTunnelInt(raw, 1)
+		case "size":
+			t.tracker.size, err = parseTunnelInt(raw, 1)
+		case "entropy":
+			t.entropy, err = parseTunnelFloat(raw, math.Log2(256))
+		case "ratio":
+			t.ratio, err = parseTunnelFloat(raw, 1)
+		default:
+			return nil, c.Errf("Unexpected token '%s'; expect 'qname_len', 'label_len', 'labels', 'entropy', 'ratio', 'unique', 'parent' or 'size'", values[i])
+		}
+		if err != nil {
+			return nil, c.Errf("Illegal value '%s' of '%s'", raw, setting)
+		}
+	}
+	return t, nil
+}
+
+func parseTunnelInt(raw string, min int) (int, error) {
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < min {
+		return 0, strconv.ErrSyntax
+	}
+	return n, nil
+}
+
+func parseTunnelFloat(raw string, max float64) (float64, error) {
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f < 0 || f > max {
+		return 0, strconv.ErrSyntax
+	}
+	return f, nil
+}
+
+// matches reports whether the query looks like DNS tunneling. Reverse
+// lookups, whose names are long by design, are never matched.
+func (t *tunnelMatcher) matches(q *query) bool {
+	name := strings.TrimSuffix(q.qname, ".")
+	if name == "" || hasSuffixFold(name, ".arpa") {
+		return false
+	}
+	if t.qnameLen > 0 && len(name) > t.qnameLen {
+		return true
+	}
+
+	labels, start := 0, 0
+	for i := 0; i <= len(name); i++ {
+		if i < len(name) && name[i] != '.' {
+			continue
+		}
+		labels++
+		if t.labelLen > 0 && i-start > t.labelLen {
+			return true
+		}
+		start = i + 1
+	}
+	if t.labels > 0 && labels > t.labels {
+		return true
+	}
+
+	if (t.entropy == 0 && t.ratio == 0) || labels <= t.parent {
+		return false
+	}
+	// the subdomain ends before the dot preceding the parent.
+	end := len(name)
+	for n := 0; n < t.parent; n++ {
+		end = strings.LastIndexByte(name[:end], '.')
+	}
+	subdomain, parent := name[:end], name[end+1:]
+	if len(subdomain) < minTunnelSubdomainLen {
+		return false
+	}
+	if !(t.entropy > 0 && shannonEntropy(subdomain) >= t.entropy) &&
+		!(t.ratio > 0 && encodedRatio(subdomain) >= t.ratio) {
+		return false
+	}
+	if t.unique == 0 {
+		return true
+	}
+	if q.dryRun {
+		return t.tracker.peek(q.ip, parent, subdomain) > t.unique
+	}
+	return t.tracker.observe(q.ip, parent, subdomain, t.unique+1) > t.unique
+}
+
+// hasSuffixFold is like strings.HasSuffix, but ignores the case of ASCII
+// letters.
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// shannonEntropy returns the Shannon entropy of the characters of a
+// subdomain in bits per character, ignoring dots and the case of letters.
+func shannonEntropy(s string) float64 {
+	var counts [256]int
+	total := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '.' {
+			continue
+		}
+		counts[lower(s[i])]++
+		total++
+	}
+	entropy := 0.0
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// encodedRatio returns the ratio of the characters of a subdomain, ignoring
+// dots, which belong to labels looking like hex or base32, i.e., long labels
+// of either alphabet with digits among letters. Trailing digits, e.g., of
+// 'server01', do not count.
+func encodedRatio(s string) float64 {
+	encoded, total := 0, 0
+	for _, label := range strings.Split(s, ".") {
+		total += len(label)
+		if looksEncoded(label) {
+			encoded += len(label)
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(encoded) / float64(total)
+}
+
+func looksEncoded(label string) bool {
+	if len(label) < minEncodedLabelLen {
+		return false
+	}
+	hex, base32 := true, true
+	firstDigit, lastLetter := -1, -1
+	for i := 0; i < len(label); i++ {
+		c := lower(label[i])
+		switch {
+		case c >= '0' && c <= '9':
+			if firstDigit < 0 {
+				firstDigit = i
+			}
+			if c < '2' || c > '7' {
+				base32 = false
+			}
+		case c >= 'a' && c <= 'z':
+			lastLetter = i
+			if c > 'f' {
+				hex = false
+			}
+		default:
+			return false
+		}
+	}
+	return (hex || base32) && firstDigit >= 0 && firstDigit < lastLetter
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// subdomainTracker counts the unique subdomains of each parent queried by
+// each client in the current minute. The number of counters kept in memory
+// is bounded by an LRU list.
+type subdomainTracker struct {
+	size int
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[subdomainKey]*list.Element
+	lru     *list.List
+}
+
+type subdomainKey struct {
+	client filter.Addr
+	parent string
+}
+
+type subdomainEntry struct {
+	key    subdomainKey
+	minute int64
+	// hashes are the hashes of the subdomains queried in minute.
+	hashes map[uint64]struct{}
+}
+
+func newSubdomainTracker(size int) *subdomainTracker {
+	return &subdomainTracker{
+		size:    size,
+		now:     time.Now,
+		entries: make(map[subdomainKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// observe records a query from client towards subdomain of parent, and
+// returns the number of unique subdomains of parent queried by client in the
+// current minute. It counts up to limit, so that the memory of each counter
+// is bounded.
+func (st *subdomainTracker) observe(client filter.Addr, parent, subdomain string, limit int) int {
+	minute := st.now().Unix() / 60
+	key := subdomainKey{client: client, parent: strings.ToLower(parent)}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var e *subdomainEntry
+	if elem, ok := st.entries[key]; ok {
+		st.lru.MoveToFront(elem)
+		e = elem.Value.(*subdomainEntry)
+		if e.minute != minute {
+			e.minute = minute
+			e.hashes = make(map[uint64]struct{})
+		}
+	} else {
+		if st.lru.Len() >= st.size {
+			oldest := st.lru.Back()
+			st.lru.Remove(oldest)
+			delete(st.entries, oldest.Value.(*subdomainEntry).key)
+		}
+		e = &subdomainEntry{key: key, minute: minute, hashes: make(map[uint64]struct{})}
+		st.entries[key] = st.lru.PushFront(e)
+	}
+	if len(e.hashes) < limit {
+		e.hashes[hashFold(subdomain)] = struct{}{}
+	}
+	return len(e.hashes)
+}
+
+// peek is like observe, but leaves the counters unchanged.
+func (st *subdomainTracker) peek(client filter.Addr, parent, subdomain string) int {
+	minute := st.now().Unix() / 60
+	key := subdomainKey{client: client, parent: strings.ToLower(parent)}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	elem, ok := st.entries[key]
+	if !ok {
+		return 1
+	}
+	e := elem.Value.(*subdomainEntry)
+	if e.minute != minute {
+		return 1
+	}
+	if _, ok := e.hashes[hashFold(subdomain)]; ok {
+		return len(e.hashes)
+	}
+	return len(e.hashes) + 1
+}
+
+// hashFold returns the 64-bit FNV-1a hash of s, ignoring the case of ASCII
+// letters.
+func hashFold(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(lower(s[i]))
+		h *= 1099511628211
+	}
+	return h
+}
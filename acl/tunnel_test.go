@@ -0,0 +1,185 @@
+package acl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// tunnelTestGood are the names of legitimate queries.
+var tunnelTestGood = []string{
+	"www.google.com.",
+	"mail.example.org.",
+	"_dmarc.example.com.",
+	"selector1._domainkey.example.com.",
+	"e1234.dscb.akamaiedge.net.",
+	"ec2-54-12-34-56.compute-1.amazonaws.com.",
+	"r3---sn-4g5e6nze.googlevideo.com.",
+	"clients4.google.com.",
+	"safebrowsing.googleapis.com.",
+	"login.microsoftonline.com.",
+	"s3.us-west-2.amazonaws.com.",
+	"xn--bcher-kva.example.",
+	"www.tripadvisor.co.uk.",
+	"4.3.2.1.in-addr.arpa.",
+	"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.",
+}
+
+// tunnelTestBad are the names of queries of DNS tunneling tools.
+var tunnelTestBad = []string{
+	// iodine.
+	"paaahhmh2bqaaaaaaaaaaaaaaaab0yyhn0s1csaaaaaaaaaaa.t.example.com.",
+	// dnscat2.
+	"0b6d01f37e9100000000000000000000.skullseclabs.org.",
+	"dnscat.8e9a01e3c46c7d1002e7d3b1f8a6c2.example.com.",
+	// base32 exfiltration.
+	"mzxw6ytboi2gk3tq.mfrggzdfmztwq2lk.exfil.example.net.",
+	"gezdgnbvgy3tqojq.t.example.net.",
+	// long names.
+	"aGVsbG8gd29ybGQgdGhp.cyBpcyBhIHRlc3Qgb2Yg.ZG5zIHR1bm5lbGluZyB3.aXRoIGxvbmcgbmFtZXMg.YW5kIG1vcmUgZGF0YSBo.ZXJlIGFuZCB0aGVyZQ.example.com.",
+	// many labels.
+	"a.b.c.d.e.f.g.h.i.j.k.example.com.",
+}
+
+func tunnelTestQuery(client, qname string) *query {
+	return &query{ip: testAddr(client), qname: qname, qtype: dns.TypeA}
+}
+
+func Test_tunnelMatcher_corpus(t *testing.T) {
+	// content checks are not backed by the counter.
+	m, err := parseTunnel(caddy.NewTestController("dns", ""), []string{"unique", "0"})
+	if err != nil {
+		t.Fatalf("parseTunnel() error = %v", err)
+	}
+	for _, name := range tunnelTestGood {
+		if m.matches(tunnelTestQuery("10.0.0.1", name)) {
+			t.Errorf("tunnelMatcher.matches(%s) = true, want false (entropy %.2f, ratio %.2f)", name, shannonEntropy(name), encodedRatio(name))
+		}
+	}
+	for _, name := range tunnelTestBad {
+		if !m.matches(tunnelTestQuery("10.0.0.1", name)) {
+			t.Errorf("tunnelMatcher.matches(%s) = false, want true (entropy %.2f, ratio %.2f)", name, shannonEntropy(name), encodedRatio(name))
+		}
+	}
+}
+
+func Test_tunnelMatcher_unique(t *testing.T) {
+	m := newTunnelMatcher()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.tracker.now = func() time.Time { return now }
+
+	// a single hash-like name of a CDN.
+	if m.matches(tunnelTestQuery("10.0.0.1", "d1a2b3c4d5e6f7.cloudfront.net.")) {
+		t.Errorf("tunnelMatcher.matches() of a single hash-like name = true, want false")
+	}
+
+	stream := func(i int) string {
+		return fmt.Sprintf("f%015x.t.example.net.", uint64(i+1)*0x9e3779b97f4a7c15)
+	}
+	for i := 0; i < defaultTunnelUnique; i++ {
+		if m.matches(tunnelTestQuery("10.0.0.1", stream(i))) {
+			t.Fatalf("tunnelMatcher.matches() of subdomain #%d = true, want false", i+1)
+		}
+	}
+	// repeated subdomains are not counted.
+	if m.matches(tunnelTestQuery("10.0.0.1", stream(0))) {
+		t.Errorf("tunnelMatcher.matches() of a repeated subdomain = true, want false")
+	}
+	if !m.matches(tunnelTestQuery("10.0.0.1", stream(defaultTunnelUnique))) {
+		t.Errorf("tunnelMatcher.matches() over the unique subdomains = false, want true")
+	}
+	// counted by the parent, ignoring case.
+	if !m.matches(tunnelTestQuery("10.0.0.1", strings.ToUpper(stream(999)))) {
+		t.Errorf("tunnelMatcher.matches() of the parent in upper case = false, want true")
+	}
+	// counted by the client.
+	if m.matches(tunnelTestQuery("10.0.0.2", stream(0))) {
+		t.Errorf("tunnelMatcher.matches() from another client = true, want false")
+	}
+	// and by the minute.
+	now = now.Add(time.Minute)
+	if m.matches(tunnelTestQuery("10.0.0.1", stream(defaultTunnelUnique+1))) {
+		t.Errorf("tunnelMatcher.matches() in the next minute = true, want false")
+	}
+
+	// counters are bounded by an LRU list.
+	m.tracker = newSubdomainTracker(2)
+	m.matches(tunnelTestQuery("10.0.0.2", stream(0)))
+	m.matches(tunnelTestQuery("10.0.0.3", stream(0)))
+	m.matches(tunnelTestQuery("10.0.0.4", stream(0)))
+	if len(m.tracker.entries) != 2 || m.tracker.lru.Len() != 2 {
+		t.Errorf("subdomainTracker keeps %d counters, want 2", len(m.tracker.entries))
+	}
+}
+
+func Test_acl_ServeDNS_tunnel(t *testing.T) {
+	a, err := parseACL(caddy.NewTestController("dns", `acl example.org {
+		allow type ANY net 10.1.0.0/16
+		block type ANY tunnel qname_len 60 unique 2
+	}`))
+	if err != nil {
+		t.Fatalf("cannot parse acl from config: %v", err)
+	}
+	a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	tests := []struct {
+		name      string
+		source    string
+		qname     string
+		wantRcode int
+	}{
+		{"Good name", "10.0.0.1", "www.example.org.", dns.RcodeSuccess},
+		{"Long name", "10.0.0.1", "aGVsbG8gd29ybGQgdGhp.cyBpcyBhIHRlc3Qgb2Yg.ZG5zIHR1bm5lbGluZyB3.example.org.", dns.RcodeRefused},
+		{"Long label", "10.0.0.1", "paaahhmh2bqaaaaaaaaaaaaaaaab0yyhn0s1csaaaaaaaaaaa.example.org.", dns.RcodeRefused},
+		{"First encoded subdomain", "10.0.0.1", "mzxw6ytboi2gk3tq.example.org.", dns.RcodeSuccess},
+		{"Second encoded subdomain", "10.0.0.1", "mfrggzdfmztwq2lk.example.org.", dns.RcodeSuccess},
+		{"Third encoded subdomain", "10.0.0.1", "gezdgnbvgy3tqojq.example.org.", dns.RcodeRefused},
+		{"Allowed before", "10.1.0.1", "paaahhmh2bqaaaaaaaaaaaaaaaab0yyhn0s1csaaaaaaaaaaa.example.org.", dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testResponseWriter{}
+			w.setRemoteIP(tt.source)
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, dns.TypeTXT)
+			if _, err := a.ServeDNS(context.Background(), w, m); err != nil {
+				t.Fatalf("acl.ServeDNS() error = %v", err)
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("acl.ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+		})
+	}
+}
+
+func Test_setup_tunnel(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"Defaults", "block type ANY tunnel", false},
+		{"Thresholds", "block type TXT tunnel qname_len 100 label_len 50 labels 8 entropy 3.5 ratio 0.5 unique 10 parent 3 size 100 net 10.0.0.0/8", false},
+		{"Disabled thresholds", "block type ANY tunnel labels 0 entropy 0 ratio 0 unique 0", false},
+		{"Unknown setting", "block type ANY tunnel length 100", true},
+		{"Missing value", "block type ANY tunnel entropy", true},
+		{"Illegal length", "block type ANY tunnel qname_len -1", true},
+		{"Illegal entropy", "block type ANY tunnel entropy 9", true},
+		{"Illegal ratio", "block type ANY tunnel ratio 1.5", true},
+		{"Illegal parent", "block type ANY tunnel parent 0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseACL(caddy.NewTestController("dns", "acl {\n"+tt.config+"\n}"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseACL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+// Command aclcheck validates the acl stanzas of a Corefile and evaluates
+// queries against them offline.
+//
+// Usage:
+//
+//	aclcheck [-conf Corefile] [-rules] [-name QNAME -type QTYPE -source IP [-tcp]] [-batch FILE]
+//
+// Each line of a batch file is a query in the form of
+//
+//	QNAME QTYPE SOURCE [udp|tcp] [ACTION]
+//
+// where ACTION, if given, is the expected action. aclcheck exits with status
+// 1 if the Corefile is invalid or any query does not meet its expectation.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/ihac/acl/acl"
+	"github.com/miekg/dns"
+)
+
+// query is a query to be checked, with the expected action if any.
+type query struct {
+	acl.CheckQuery
+	expect string
+}
+
+func main() {
+	// the packages of caddy and coredns register flags of their own to the
+	// default set.
+	flags := flag.NewFlagSet("aclcheck", flag.ExitOnError)
+	conf := flags.String("conf", "Corefile", "Corefile to check")
+	rules := flags.Bool("rules", false, "print the compiled rules")
+	name := flags.String("name", "", "name of the query to check")
+	qtype := flags.String("type", "A", "type of the query to check")
+	source := flags.String("source", "", "source address of the query to check")
+	tcp := flags.Bool("tcp", false, "check the query as received over TCP")
+	batch := flags.String("batch", "", "file of queries to check, one per line")
+	flags.Parse(os.Args[1:])
+
+	file, err := os.Open(*conf)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	checkers, err := acl.NewCheckers(*conf, file)
+	file.Close()
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	if *rules {
+		for _, ch := range checkers {
+			fmt.Printf("# %s\n%s", strings.Join(ch.Keys, " "), ch)
+		}
+	}
+
+	var queries []query
+	if *name != "" {
+		q, err := parseQuery([]string{*name, *qtype, *source})
+		if err != nil {
+			fatalf("%v", err)
+		}
+		q.TCP = *tcp
+		queries = append(queries, q)
+	}
+	if *batch != "" {
+		file, err := os.Open(*batch)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		qs, err := parseBatch(*batch, file)
+		file.Close()
+		if err != nil {
+			fatalf("%v", err)
+		}
+		queries = append(queries, qs...)
+	}
+
+	failed := false
+	for _, q := range queries {
+		if !check(os.Stdout, checkers, q) {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// check checks a query against the server block serving it, prints the
+// result to out, and reports whether the result meets the expectation.
+func check(out io.Writer, checkers []*acl.Checker, q query) bool {
+	proto := "udp"
+	if q.TCP {
+		proto = "tcp"
+	}
+	desc := fmt.Sprintf("%s %s from %s (%s)", dns.Fqdn(q.Name), dns.TypeToString[q.Type], q.Source, proto)
+
+	// the server block with the longest matching zone serves the query.
+	var ch *acl.Checker
+	longest := ""
+	for _, c := range checkers {
+		if zone := c.Match(q.Name); zone != "" && len(zone) > len(longest) {
+			ch, longest = c, zone
+		}
+	}
+	result := acl.CheckResult{Action: acl.ALLOW}
+	if ch != nil {
+		var err error
+		result, err = ch.Check(q.CheckQuery)
+		if err != nil {
+			fmt.Fprintf(out, "%s: error: %v\n", desc, err)
+			return false
+		}
+	}
+
+	matched := " (no matching policy)"
+	if result.Policy != "" {
+		matched = fmt.Sprintf(" by '%s' in acl %s", result.Policy, strings.Join(result.Zones, " "))
+	}
+	if q.expect != "" && !strings.EqualFold(q.expect, result.Action) {
+		fmt.Fprintf(out, "%s: %s%s, want %s\n", desc, result.Action, matched, q.expect)
+		return false
+	}
+	fmt.Fprintf(out, "%s: %s%s\n", desc, result.Action, matched)
+	return true
+}
+
+// parseBatch parses queries in a batch file. Empty lines and comments
+// starting with '#' are skipped.
+func parseBatch(fileName string, r io.Reader) ([]query, error) {
+	var queries []query
+	lineNum := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		q, err := parseQuery(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, lineNum, err)
+		}
+		queries = append(queries, q)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return queries, nil
+}
+
+// parseQuery parses a query in the form of 'QNAME QTYPE SOURCE [udp|tcp] [ACTION]'.
+func parseQuery(fields []string) (query, error) {
+	q := query{}
+	if len(fields) < 3 || len(fields) > 5 {
+		return q, fmt.Errorf("Illegal query '%s'; expect 'QNAME QTYPE SOURCE [udp|tcp] [ACTION]'", strings.Join(fields, " "))
+	}
+	if _, ok := dns.IsDomainName(fields[0]); !ok {
+		return q, fmt.Errorf("Illegal name '%s'", fields[0])
+	}
+	q.Name = dns.Fqdn(fields[0])
+
+	qtype, ok := dns.StringToType[strings.ToUpper(fields[1])]
+	if !ok {
+		return q, fmt.Errorf("Illegal type '%s'", fields[1])
+	}
+	q.Type = qtype
+
+	q.Source = net.ParseIP(fields[2])
+	if q.Source == nil {
+		return q, fmt.Errorf("Illegal source address '%s'", fields[2])
+	}
+
+	for _, field := range fields[3:] {
+		switch strings.ToLower(field) {
+		case "udp":
+		case "tcp":
+			q.TCP = true
+		default:
+			q.expect = strings.ToLower(field)
+		}
+	}
+	return q, nil
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "aclcheck: "+format+"\n", args...)
+	os.Exit(1)
+}
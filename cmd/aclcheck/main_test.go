@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ihac/acl/acl"
+	"github.com/miekg/dns"
+)
+
+func Test_parseBatch(t *testing.T) {
+	batch := `# comment
+foo.example.org TXT 10.1.2.3
+foo.example.org a 10.1.2.3 tcp block
+
+example.com AAAA 2001:db8::1 udp allow # trailing comment
+`
+	queries, err := parseBatch("batch", strings.NewReader(batch))
+	if err != nil {
+		t.Fatalf("parseBatch() error = %v", err)
+	}
+	if len(queries) != 3 {
+		t.Fatalf("parseBatch() returns %d queries, want 3", len(queries))
+	}
+	if q := queries[1]; q.Name != "foo.example.org." || q.Type != dns.TypeA || !q.TCP || q.expect != "block" {
+		t.Errorf("parseBatch() = %+v, want a TCP query for A of foo.example.org. expecting block", q)
+	}
+	if q := queries[2]; q.TCP || q.expect != "allow" {
+		t.Errorf("parseBatch() = %+v, want a UDP query expecting allow", q)
+	}
+
+	tests := []struct {
+		name  string
+		batch string
+	}{
+		{"Missing source", "foo.example.org TXT"},
+		{"Illegal type", "foo.example.org XYZ 10.1.2.3"},
+		{"Illegal source", "foo.example.org TXT 10.1.2"},
+		{"Too many fields", "foo.example.org TXT 10.1.2.3 udp allow more"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseBatch("batch", strings.NewReader("# comment\n"+tt.batch))
+			if err == nil || !strings.HasPrefix(err.Error(), "batch:2: ") {
+				t.Errorf("parseBatch() error = %v, want an error at batch:2", err)
+			}
+		})
+	}
+}
+
+func Test_check(t *testing.T) {
+	corefile := `
+example.org {
+    acl {
+        block type TXT net 10.0.0.0/8
+    }
+}
+`
+	checkers, err := acl.NewCheckers("Corefile", strings.NewReader(corefile))
+	if err != nil {
+		t.Fatalf("NewCheckers() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		line    string
+		want    bool
+		wantOut string
+	}{
+		{"Blocked", "foo.example.org TXT 10.1.2.3 block", true, "foo.example.org. TXT from 10.1.2.3 (udp): block by 'block type TXT net 10.0.0.0/8' in acl example.org.\n"},
+		{"Not matched", "foo.example.org A 10.1.2.3", true, "foo.example.org. A from 10.1.2.3 (udp): allow (no matching policy)\n"},
+		{"Other server block", "example.com TXT 10.1.2.3 tcp allow", true, "example.com. TXT from 10.1.2.3 (tcp): allow (no matching policy)\n"},
+		{"Unexpected", "foo.example.org TXT 10.1.2.3 allow", false, "foo.example.org. TXT from 10.1.2.3 (udp): block by 'block type TXT net 10.0.0.0/8' in acl example.org., want allow\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseQuery(strings.Fields(tt.line))
+			if err != nil {
+				t.Fatalf("parseQuery() error = %v", err)
+			}
+			var out bytes.Buffer
+			if got := check(&out, checkers, q); got != tt.want {
+				t.Errorf("check() = %v, want %v", got, tt.want)
+			}
+			if out.String() != tt.wantOut {
+				t.Errorf("check() prints %q, want %q", out.String(), tt.wantOut)
+			}
+		})
+	}
+}
@@ -7,6 +7,8 @@ require (
 	github.com/coredns/coredns v1.6.1
 	github.com/ihac/firewall v0.0.0-20190808011812-8396d9f228d7 // indirect
 	github.com/miekg/dns v1.1.15
+	github.com/oschwald/maxminddb-golang v1.3.1
 	github.com/prometheus/client_golang v1.1.0
 	github.com/seiflotfy/cuckoofilter v0.0.0-20190302225222-764cb5258d9b
+	gopkg.in/yaml.v2 v2.4.0
 )